@@ -0,0 +1,304 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+// Package blocklist matches names against domain blocklists. Lists can be
+// in hosts format (0.0.0.0 domain), plain domain lists or adblock syntax
+// (||domain^) and are loaded from files or HTTP URLs.
+package blocklist
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+const fetchTimeout = 30 * time.Second
+
+// Config stores options for blocklists
+type Config struct {
+	// Files or http(s) URLs of the lists
+	Sources []string
+	// Domains that are never blocked, including their subdomains
+	Allow []string
+	// How often the sources are reloaded, zero disables reloading
+	Refresh time.Duration
+}
+
+type list struct {
+	blocked []string
+	allowed []string
+}
+
+// Blocklist holds the merged domains of all sources
+type Blocklist struct {
+	config  *Config
+	client  *http.Client
+	lists   map[string]*list // last successfully loaded list by source
+	blocked map[string]struct{}
+	allowed map[string]struct{}
+	mutex   sync.RWMutex
+}
+
+// New loads the sources and starts reloading them periodically if
+// configured. It fails if a source cannot be loaded initially.
+func New(config *Config) (*Blocklist, error) {
+	b := &Blocklist{
+		config: config,
+		client: &http.Client{Timeout: fetchTimeout},
+		lists:  make(map[string]*list),
+	}
+
+	for _, source := range config.Sources {
+		l, err := b.load(source)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading blocklist %s: %s", source, err)
+		}
+		b.lists[source] = l
+	}
+	b.merge()
+
+	if config.Refresh > 0 {
+		go b.refreshLists(config.Refresh)
+	}
+
+	return b, nil
+}
+
+// Blocked returns true if name or one of its parent domains is blocked and
+// not allowed. The most specific match wins, so an allowed subdomain of a
+// blocked domain is not blocked.
+func (b *Blocklist) Blocked(name string) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	for {
+		if _, ok := b.allowed[name]; ok {
+			return false
+		}
+		if _, ok := b.blocked[name]; ok {
+			return true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return false
+		}
+		name = name[i+1:]
+	}
+}
+
+// Len returns the number of blocked domains
+func (b *Blocklist) Len() int {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return len(b.blocked)
+}
+
+func (b *Blocklist) refreshLists(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	for range ticker.C {
+		for _, source := range b.config.Sources {
+			l, err := b.load(source)
+			if err != nil {
+				// keep the previous version of the list
+				log.Warnf("Error reloading blocklist %s: %s", source, err)
+				continue
+			}
+			b.lists[source] = l
+		}
+		b.merge()
+		log.Debugf("Reloaded blocklists, %d domains blocked", b.Len())
+	}
+}
+
+func (b *Blocklist) merge() {
+	blocked := make(map[string]struct{})
+	allowed := make(map[string]struct{})
+	for _, l := range b.lists {
+		for _, d := range l.blocked {
+			blocked[d] = struct{}{}
+		}
+		for _, d := range l.allowed {
+			allowed[d] = struct{}{}
+		}
+	}
+	for _, d := range b.config.Allow {
+		allowed[strings.TrimSuffix(strings.ToLower(d), ".")] = struct{}{}
+	}
+
+	b.mutex.Lock()
+	b.blocked = blocked
+	b.allowed = allowed
+	b.mutex.Unlock()
+}
+
+func (b *Blocklist) load(source string) (*list, error) {
+	data, err := b.read(source)
+	if err != nil {
+		return nil, err
+	}
+
+	l, _ := parseList(string(data))
+	log.Debugf("Loaded blocklist %s: %d blocked, %d allowed", source, len(l.blocked), len(l.allowed))
+	return l, nil
+}
+
+func (b *Blocklist) read(source string) ([]byte, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		return b.fetch(source)
+	}
+	return os.ReadFile(source)
+}
+
+// Problem is a line of a list that is skipped
+type Problem struct {
+	Line    int
+	Message string
+}
+
+// Check loads the list at source like New does and returns the lines that
+// are skipped because they hold no valid domain
+func Check(source string) ([]Problem, error) {
+	b := &Blocklist{client: &http.Client{Timeout: fetchTimeout}}
+	data, err := b.read(source)
+	if err != nil {
+		return nil, err
+	}
+	_, problems := parseList(string(data))
+	return problems, nil
+}
+
+func (b *Blocklist) fetch(url string) ([]byte, error) {
+	resp, err := b.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// names in hosts format lists that must never be blocked
+var hostsIgnore = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// parseList parses a list in any of the supported formats, detected per line:
+//
+//	0.0.0.0 ads.example.com tracker.example.com   hosts format
+//	ads.example.com                               domain list
+//	||ads.example.com^                            adblock rule
+//	@@||cdn.example.com^                          adblock exception
+//
+// Comments start with '#' or '!'. Adblock rules with anything but a plain
+// domain are skipped, other lines without a valid domain are returned as
+// problems.
+func parseList(data string) (*list, []Problem) {
+	l := new(list)
+	var problems []Problem
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+
+		if strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@||") {
+			allow := strings.HasPrefix(line, "@@")
+			if d, ok := parseAdblock(strings.TrimPrefix(line, "@@")); ok {
+				if allow {
+					l.allowed = append(l.allowed, d)
+				} else {
+					l.blocked = append(l.blocked, d)
+				}
+			}
+			continue
+		}
+
+		// strip trailing comments
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if net.ParseIP(fields[0]) != nil {
+			for _, f := range fields[1:] {
+				d, ok := normalize(f)
+				if !ok {
+					problems = append(problems, Problem{i + 1, fmt.Sprintf("Invalid domain: %s", f)})
+					continue
+				}
+				if !hostsIgnore[d] {
+					l.blocked = append(l.blocked, d)
+				}
+			}
+			continue
+		}
+
+		if len(fields) > 1 {
+			problems = append(problems, Problem{i + 1, fmt.Sprintf("Not a hosts entry, domain or adblock rule: %s", line)})
+			continue
+		}
+		if d, ok := normalize(strings.TrimPrefix(fields[0], "*.")); ok {
+			l.blocked = append(l.blocked, d)
+		} else {
+			problems = append(problems, Problem{i + 1, fmt.Sprintf("Invalid domain: %s", fields[0])})
+		}
+	}
+	return l, problems
+}
+
+// parseAdblock returns the domain of a '||domain^' rule. Rules with paths,
+// wildcards or modifiers other than $important are not DNS rules.
+func parseAdblock(rule string) (string, bool) {
+	rule = strings.TrimPrefix(rule, "||")
+	if i := strings.IndexByte(rule, '$'); i >= 0 {
+		if rule[i+1:] != "important" {
+			return "", false
+		}
+		rule = rule[:i]
+	}
+	if !strings.HasSuffix(rule, "^") {
+		return "", false
+	}
+	return normalize(strings.TrimSuffix(rule, "^"))
+}
+
+func normalize(domain string) (string, bool) {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if domain == "" || strings.ContainsAny(domain, "*/:^|") {
+		return "", false
+	}
+	if _, ok := dns.IsDomainName(domain); !ok {
+		return "", false
+	}
+	return domain, true
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package blocklist
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseList(t *testing.T) {
+	data := `# hosts format
+127.0.0.1 localhost
+0.0.0.0 ads.example.com tracker.example.com # trailing comment
+:: ipv6.example.com
+! adblock format
+[Adblock Plus 2.0]
+||adblock.example.net^
+||important.example.net^$important
+||thirdparty.example.net^$third-party
+||example.org/path^
+@@||cdn.adblock.example.net^
+# domain list
+plain.example.org
+*.wild.example.org
+not a domain line
+0.0.0.0 bad..domain
+`
+	l, problems := parseList(data)
+
+	blocked := []string{"ads.example.com", "tracker.example.com", "ipv6.example.com",
+		"adblock.example.net", "important.example.net", "plain.example.org", "wild.example.org"}
+	if fmt.Sprint(l.blocked) != fmt.Sprint(blocked) {
+		t.Errorf("expected blocked %v, got %v", blocked, l.blocked)
+	}
+	if len(l.allowed) != 1 || l.allowed[0] != "cdn.adblock.example.net" {
+		t.Errorf("expected allowed [cdn.adblock.example.net], got %v", l.allowed)
+	}
+	if len(problems) != 2 || problems[0].Line != 15 || problems[1].Line != 16 {
+		t.Errorf("expected problems on lines 15 and 16, got %v", problems)
+	}
+}
+
+func TestBlocked(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hosts")
+	if err := os.WriteFile(path, []byte("0.0.0.0 example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "||ads.example.net^\n@@||ok.ads.example.net^")
+	}))
+	defer srv.Close()
+
+	b, err := New(&Config{
+		Sources: []string{path, srv.URL + "/list.txt"},
+		Allow:   []string{"www.example.com."},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := map[string]bool{
+		"example.com.":            true,
+		"Sub.Example.COM.":        true,
+		"www.example.com.":        false,
+		"sub.www.example.com.":    false,
+		"notexample.com.":         false,
+		"ads.example.net.":        true,
+		"x.ads.example.net.":      true,
+		"ok.ads.example.net.":     false,
+		"example.net.":            false,
+		".":                       false,
+		"deep.x.ads.example.net.": true,
+	}
+	for name, expected := range testcases {
+		if blocked := b.Blocked(name); blocked != expected {
+			t.Errorf("Blocked(%q): expected %t, got %t", name, expected, blocked)
+		}
+	}
+
+	if _, err := New(&Config{Sources: []string{filepath.Join(dir, "missing")}}); err == nil {
+		t.Error("expected error for missing source")
+	}
+	if _, err := Check(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected check to fail for missing source")
+	}
+	if problems, err := Check(srv.URL + "/list.txt"); err != nil || len(problems) > 0 {
+		t.Errorf("expected a valid list, got %v %v", problems, err)
+	}
+}
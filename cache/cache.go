@@ -32,8 +32,24 @@ type elem struct {
 	hits            uint
 	staleHits       uint
 	ttlSeconds      uint32
+	validation      Validation
 }
 
+// Validation is the DNSSEC validation state of a cached message
+type Validation uint8
+
+const (
+	// Unvalidated messages were not validated, e.g. because the client
+	// disabled checking
+	Unvalidated Validation = iota
+	// Insecure messages were validated and are not signed
+	Insecure
+	// Secure messages were validated along the whole chain of trust
+	Secure
+	// Bogus messages failed validation
+	Bogus
+)
+
 // Cache is a cache that holds on the a number of RRs or DNS messages. The cache
 // eviction is randomized.
 type Cache struct {
@@ -47,6 +63,10 @@ type Cache struct {
 	ttlMax        time.Duration
 	ttlMinSeconds uint32
 	ttlMaxSeconds uint32
+
+	// Validated denial records by zone, see InsertDenials
+	zones   map[string]*zoneDenials
+	denials int
 }
 
 var qTypeToName = map[uint16]string{
@@ -90,7 +110,7 @@ func (c *Cache) DumpCache() string {
 	fmt.Fprintln(w)
 	fmt.Fprintf(w, "Dumped at: %v\n", now.Format(time.RFC3339))
 	fmt.Fprintln(w)
-	fmt.Fprintln(w, "QType\tExpired\tStaleExpired\tTTL(s)\tExpire In\tStaleExpire In\tQuestion\tHits\tStaleHits")
+	fmt.Fprintln(w, "QType\tExpired\tStaleExpired\tTTL(s)\tExpire In\tStaleExpire In\tQuestion\tHits\tStaleHits\tAnswer")
 	for _, v := range c.m {
 		var sb strings.Builder
 		qType := uint16(0)
@@ -101,7 +121,7 @@ func (c *Cache) DumpCache() string {
 			sb.WriteString(v.msg.Question[i].Name)
 			sb.WriteString(",")
 		}
-		fmt.Fprintf(w, "%s\t%t\t%t\t%d\t%v\t%v\t%s\t%d\t%d\n", getRecordTypeName(qType), time.Since(v.expiration) > 0, time.Since(v.staleExpiration) > 0, v.ttlSeconds, v.expiration.Sub(now).Truncate(time.Second), v.staleExpiration.Sub(now).Truncate(time.Second), strings.Trim(sb.String(), ","), v.hits, v.staleHits)
+		fmt.Fprintf(w, "%s\t%t\t%t\t%d\t%v\t%v\t%s\t%d\t%d\t%s\n", getRecordTypeName(qType), time.Since(v.expiration) > 0, time.Since(v.staleExpiration) > 0, v.ttlSeconds, v.expiration.Sub(now).Truncate(time.Second), v.staleExpiration.Sub(now).Truncate(time.Second), strings.Trim(sb.String(), ","), v.hits, v.staleHits, answerSummary(v.msg))
 	}
 	fmt.Fprintln(w)
 	fmt.Fprintln(w, "=== END CACHE DUMP ===")
@@ -109,6 +129,21 @@ func (c *Cache) DumpCache() string {
 	return sb.String()
 }
 
+// answerSummary returns the type and data of the answer records, e.g.
+// "CNAME www.example.com.,A 192.0.2.1"
+func answerSummary(msg *dns.Msg) string {
+	var answers []string
+	for _, rr := range msg.Answer {
+		hdr := rr.Header()
+		data := strings.TrimPrefix(rr.String(), hdr.String())
+		answers = append(answers, dns.TypeToString[hdr.Rrtype]+" "+data)
+	}
+	if len(answers) == 0 {
+		return dns.RcodeToString[msg.Rcode]
+	}
+	return strings.Join(answers, ",")
+}
+
 // New returns a new cache with the capacity and the ttl and stale ttl specified.
 func New(capacity, ttl int, staleTtl int, ttlFromResp bool, ttlMax int) *Cache {
 	c := new(Cache)
@@ -129,6 +164,25 @@ func (c *Cache) Remove(s string) {
 	c.Unlock()
 }
 
+// RemoveName removes all messages cached for the given name, regardless of
+// the question type or the key flags. It returns the number of removed messages.
+func (c *Cache) RemoveName(name string) int {
+	name = dns.Fqdn(name)
+	removed := 0
+	c.Lock()
+	for k, v := range c.m {
+		for _, q := range v.msg.Question {
+			if strings.EqualFold(q.Name, name) {
+				delete(c.m, k)
+				removed++
+				break
+			}
+		}
+	}
+	c.Unlock()
+	return removed
+}
+
 // Identical to EvictRandom() but can evict only stale stale records
 // Created to keep compatibility with calls to EvictRandom()
 func (c *Cache) evictRandomInternal(onlyStale bool) {
@@ -164,16 +218,27 @@ func (c *Cache) EvictRandom() {
 
 // InsertMessage inserts a message in the Cache. We will cache it for ttl seconds, which
 // should be a small (60...300) integer.
+//
+// Answers with an EDNS client subnet scope are only returned to queries from
+// the network of the scope, see HitSubnet.
 func (c *Cache) InsertMessage(s string, msg *dns.Msg) {
+	c.InsertValidated(s, msg, Unvalidated)
+}
+
+// InsertValidated inserts a message in the Cache together with its DNSSEC
+// validation state, see Lookup. A message cached with another state is
+// replaced.
+func (c *Cache) InsertValidated(s string, msg *dns.Msg, validation Validation) {
 	if c.capacity <= 0 {
 		return
 	}
+	s = scopeKey(s, msg)
 
 	c.Lock()
 	renew := false
 	_, ok := c.m[s]
 	if ok {
-		renew = time.Since(c.m[s].expiration) > 0 && time.Since(c.m[s].staleExpiration) < 0
+		renew = time.Since(c.m[s].expiration) > 0 && time.Since(c.m[s].staleExpiration) < 0 || c.m[s].validation != validation
 	}
 	if !ok || renew {
 		exp := time.Now().UTC().Add(c.ttl)
@@ -185,7 +250,7 @@ func (c *Cache) InsertMessage(s string, msg *dns.Msg) {
 			exp = time.Now().UTC().Add(ttlD)
 			ttlSeconds = lowestTll
 		}
-		c.m[s] = &elem{exp, msg.Copy(), time.Now().UTC().Add(c.staleTtl), 0, 0, ttlSeconds}
+		c.m[s] = &elem{exp, msg.Copy(), time.Now().UTC().Add(c.staleTtl), 0, 0, ttlSeconds, validation}
 		logMsg := fmt.Sprintf("Insert into cache: %v", msg.Answer)
 		if renew {
 			logMsg = fmt.Sprintf("Renew entry: %v", msg.Answer)
@@ -200,17 +265,22 @@ func (c *Cache) InsertMessage(s string, msg *dns.Msg) {
 // Search returns a dns.Msg, the expiration time and a boolean indicating if we found something
 // in the cache.
 func (c *Cache) Search(s string) (*dns.Msg, time.Time, time.Time, bool) {
+	m, exp, staleExp, _, ok := c.search(s)
+	return m, exp, staleExp, ok
+}
+
+func (c *Cache) search(s string) (*dns.Msg, time.Time, time.Time, Validation, bool) {
 	if c.capacity <= 0 {
-		return nil, time.Time{}, time.Time{}, false
+		return nil, time.Time{}, time.Time{}, Unvalidated, false
 	}
 	c.RLock()
 	if e, ok := c.m[s]; ok {
 		e1 := e.msg.Copy()
 		c.RUnlock()
-		return e1, e.expiration, e.staleExpiration, true
+		return e1, e.expiration, e.staleExpiration, e.validation, true
 	}
 	c.RUnlock()
-	return nil, time.Time{}, time.Time{}, false
+	return nil, time.Time{}, time.Time{}, Unvalidated, false
 }
 
 // Key creates a hash key from a question section. It creates a different key
@@ -5,6 +5,8 @@
 package cache
 
 import (
+	"net"
+	"strings"
 	"testing"
 	"time"
 
@@ -142,3 +144,192 @@ func TestExpireMessageWithExpiredStale(t *testing.T) {
 	}
 
 }
+
+func TestRemoveName(t *testing.T) {
+	cch := New(10, testTTL, testStaleTTL, false, 0)
+
+	testcases := []testcase{
+		{newMsg("example.com.", dns.TypeA), false, false},
+		{newMsg("Example.COM.", dns.TypeAAAA), true, false},
+		{newMsg("example.com.", dns.TypeMX), false, true},
+		{newMsg("example.net.", dns.TypeA), false, false},
+	}
+	for _, tc := range testcases {
+		cch.InsertMessage(Key(tc.msg.Question[0], tc.dnssec, tc.tcp), tc.msg)
+	}
+
+	if removed := cch.RemoveName("example.com"); removed != 3 {
+		t.Fatalf("expected 3 removed messages, got %d", removed)
+	}
+	for _, tc := range testcases[:3] {
+		if cMsg := cch.Hit(tc.msg.Question[0], tc.dnssec, tc.tcp, tc.msg.Id, false, false); cMsg != nil {
+			t.Fatalf("expected <nil> after removal, got %s", cMsg)
+		}
+	}
+	if cMsg := cch.Hit(testcases[3].msg.Question[0], false, false, 0, false, false); cMsg == nil {
+		t.Fatal("expected example.net. to remain in the cache")
+	}
+}
+
+func TestDumpCacheAnswers(t *testing.T) {
+	cch := New(10, testTTL, testStaleTTL, false, 0)
+
+	msg := newMsg("www.example.com.", dns.TypeA)
+	for _, s := range []string{"www.example.com. 60 IN CNAME lb.example.com.", "lb.example.com. 60 IN A 10.0.0.1"} {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Answer = append(msg.Answer, rr)
+	}
+	cch.InsertMessage(Key(msg.Question[0], false, false), msg)
+	nx := newMsg("nx.example.com.", dns.TypeA)
+	nx.Rcode = dns.RcodeNameError
+	cch.InsertMessage(Key(nx.Question[0], false, false), nx)
+
+	dump := cch.DumpCache()
+	for _, expected := range []string{"CNAME lb.example.com.,A 10.0.0.1", "NXDOMAIN"} {
+		if !strings.Contains(dump, expected) {
+			t.Errorf("expected %q in the cache dump:\n%s", expected, dump)
+		}
+	}
+}
+
+func subnetMsg(addr string, source, scope uint8, answer string) *dns.Msg {
+	msg := newMsg("cdn.example.", dns.TypeA)
+	msg.SetEdns0(4096, false)
+	ip := net.ParseIP(addr)
+	family := uint16(2)
+	if ip.To4() != nil {
+		family = 1
+	}
+	opt := msg.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: family, SourceNetmask: source, SourceScope: scope, Address: ip})
+	if answer != "" {
+		rr, _ := dns.NewRR("cdn.example. 60 IN A " + answer)
+		msg.Answer = []dns.RR{rr}
+	}
+	return msg
+}
+
+func TestSubnetScope(t *testing.T) {
+	cch := New(10, testTTL, testStaleTTL, false, 0)
+	q := dns.Question{Name: "cdn.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	key := Key(q, false, false)
+
+	cch.InsertMessage(key, subnetMsg("192.0.2.0", 24, 16, "198.51.100.1"))
+	cch.InsertMessage(key, subnetMsg("2001:db8::", 56, 48, "198.51.100.2"))
+	// scope longer than the source prefix is cached for the source network
+	cch.InsertMessage(key, subnetMsg("203.0.113.0", 24, 32, "198.51.100.3"))
+
+	tests := []struct {
+		addr   string
+		source uint8
+		answer string
+	}{
+		{"192.0.7.0", 24, "198.51.100.1"},
+		{"192.1.2.0", 24, ""},
+		{"192.0.2.0", 8, ""},
+		{"2001:db8:0:ff00::", 56, "198.51.100.2"},
+		{"2001:db8:1::", 56, ""},
+		{"203.0.113.0", 24, "198.51.100.3"},
+	}
+	for _, tc := range tests {
+		ecs := Subnet(subnetMsg(tc.addr, tc.source, 0, ""))
+		m := cch.HitSubnet(q, ecs, false, false, 1, false, false)
+		switch {
+		case tc.answer == "" && m != nil:
+			t.Errorf("%s/%d: expected no answer, got %v", tc.addr, tc.source, m.Answer)
+		case tc.answer != "" && (m == nil || m.Answer[0].(*dns.A).A.String() != tc.answer):
+			t.Errorf("%s/%d: expected %s, got %v", tc.addr, tc.source, tc.answer, m)
+		}
+	}
+	if m := cch.Hit(q, false, false, 1, false, false); m != nil {
+		t.Errorf("expected no answer without a client subnet, got %v", m.Answer)
+	}
+
+	// answers with scope 0 are valid for all clients
+	cch.InsertMessage(key, subnetMsg("192.0.2.0", 24, 0, "198.51.100.4"))
+	ecs := Subnet(subnetMsg("10.0.0.0", 24, 0, ""))
+	if m := cch.HitSubnet(q, ecs, false, false, 1, false, false); m == nil || m.Answer[0].(*dns.A).A.String() != "198.51.100.4" {
+		t.Errorf("expected the global answer, got %v", m)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	cch := New(10, testTTL, testStaleTTL, false, 0)
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	key := Key(q, false, false)
+	msg := new(dns.Msg)
+	msg.SetQuestion(q.Name, q.Qtype)
+
+	cch.InsertValidated(key, msg, Unvalidated)
+	if _, v := cch.Lookup(q, nil, false, false, 1, false, false); v != Unvalidated {
+		t.Errorf("expected an unvalidated message, got %d", v)
+	}
+	// a validated message replaces the unvalidated one
+	cch.InsertValidated(key, msg, Secure)
+	if m, v := cch.Lookup(q, nil, false, false, 1, false, false); m == nil || v != Secure {
+		t.Errorf("expected a secure message, got %d", v)
+	}
+}
+
+func TestSynthesize(t *testing.T) {
+	cch := New(10, testTTL, testStaleTTL, false, 0)
+	nxdomain := new(dns.Msg)
+	nxdomain.SetQuestion("b.example.", dns.TypeA)
+	nxdomain.Response = true
+	nxdomain.Rcode = dns.RcodeNameError
+	for _, s := range []string{
+		"example. 300 IN SOA ns.example. hostmaster.example. 1 3600 600 86400 60",
+		"example. 300 IN RRSIG SOA 13 1 300 20300101000000 20200101000000 1 example. AAAA",
+		"example. 300 IN NSEC a.example. NS SOA RRSIG NSEC DNSKEY",
+		"example. 300 IN RRSIG NSEC 13 1 300 20300101000000 20200101000000 1 example. AAAA",
+		"a.example. 300 IN NSEC x.example. A RRSIG NSEC",
+		"a.example. 300 IN RRSIG NSEC 13 2 300 20300101000000 20200101000000 1 example. AAAA",
+	} {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nxdomain.Ns = append(nxdomain.Ns, rr)
+	}
+
+	q := dns.Question{Name: "c.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	cch.InsertDenials(nxdomain)
+	if m := cch.Synthesize(q, true, 1); m != nil {
+		t.Fatalf("expected denials without the AD bit to be ignored, got %v", m)
+	}
+
+	nxdomain.AuthenticatedData = true
+	cch.InsertDenials(nxdomain)
+	m := cch.Synthesize(q, true, 1)
+	if m == nil || m.Rcode != dns.RcodeNameError || !m.AuthenticatedData || len(m.Ns) != 6 {
+		t.Fatalf("expected NXDOMAIN with the SOA and both NSEC records and signatures, got %v", m)
+	}
+	for _, rr := range m.Ns {
+		if ttl := rr.Header().Ttl; ttl > 60 {
+			t.Errorf("expected the negative TTL of the SOA, got %d", ttl)
+		}
+	}
+	if m := cch.Synthesize(q, false, 1); m == nil || len(m.Ns) != 1 {
+		t.Errorf("expected only the SOA without DNSSEC records, got %v", m)
+	}
+
+	q.Name = "a.example."
+	if m := cch.Synthesize(q, true, 1); m != nil {
+		t.Errorf("expected no answer for an existing name, got %v", m)
+	}
+	q.Qtype = dns.TypeMX
+	if m := cch.Synthesize(q, true, 1); m == nil || m.Rcode != dns.RcodeSuccess {
+		t.Errorf("expected NODATA for a missing type, got %v", m)
+	}
+	q.Name = "y.example."
+	if m := cch.Synthesize(q, true, 1); m != nil {
+		t.Errorf("expected no answer for a name not covered, got %v", m)
+	}
+	q.Name = "c.example.org."
+	if m := cch.Synthesize(q, true, 1); m != nil {
+		t.Errorf("expected no answer for another zone, got %v", m)
+	}
+}
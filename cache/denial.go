@@ -0,0 +1,215 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package cache
+
+import (
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/claranet/go-dnsmasq/dnssec"
+)
+
+// Aggressive use of DNSSEC-validated cache (RFC 8198): the NSEC and NSEC3
+// records of validated negative answers also prove that other names of the
+// zone do not exist.
+
+// denial is an NSEC or NSEC3 record followed by its signatures
+type denial struct {
+	rrs        []dns.RR
+	expiration time.Time
+}
+
+type zoneDenials struct {
+	soa     *denial
+	records map[string]*denial // by owner name and type
+}
+
+// InsertDenials keeps the NSEC and NSEC3 records of a validated negative
+// answer, see Synthesize. Messages without the AD bit are ignored.
+func (c *Cache) InsertDenials(msg *dns.Msg) {
+	if c.capacity <= 0 || !msg.AuthenticatedData {
+		return
+	}
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return
+	}
+
+	var soa *dns.SOA
+	for _, rr := range msg.Ns {
+		if t, ok := rr.(*dns.SOA); ok {
+			soa = t
+			break
+		}
+	}
+	if soa == nil {
+		return
+	}
+	zone := strings.ToLower(soa.Hdr.Name)
+	now := time.Now()
+	// Negative answers are cached no longer than the SOA allows (RFC 9077)
+	ttl := min(soa.Hdr.Ttl, soa.Minttl)
+
+	var records []*denial
+	for _, rr := range msg.Ns {
+		hdr := rr.Header()
+		if hdr.Rrtype != dns.TypeNSEC && hdr.Rrtype != dns.TypeNSEC3 {
+			continue
+		}
+		sigs := signatures(msg.Ns, hdr.Name, hdr.Rrtype, zone)
+		if len(sigs) == 0 {
+			continue
+		}
+		expiration := now.Add(time.Duration(min(hdr.Ttl, ttl)) * time.Second)
+		records = append(records, &denial{rrs: append([]dns.RR{rr}, sigs...), expiration: expiration})
+	}
+	if len(records) == 0 {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.zones == nil {
+		c.zones = make(map[string]*zoneDenials)
+	}
+	z, ok := c.zones[zone]
+	if !ok {
+		z = &zoneDenials{records: make(map[string]*denial)}
+		c.zones[zone] = z
+	}
+	z.soa = &denial{rrs: append([]dns.RR{soa}, signatures(msg.Ns, soa.Hdr.Name, dns.TypeSOA, zone)...), expiration: now.Add(time.Duration(ttl) * time.Second)}
+	for _, d := range records {
+		hdr := d.rrs[0].Header()
+		key := strings.ToLower(hdr.Name) + "/" + dns.TypeToString[hdr.Rrtype]
+		if _, ok := z.records[key]; !ok {
+			c.denials++
+		}
+		z.records[key] = d
+	}
+	log.Debugf("Keeping %d denial records of zone %s", len(records), zone)
+	c.evictDenials(now)
+}
+
+// evictDenials removes expired records and random ones above the capacity.
+// Must be called under a write lock.
+func (c *Cache) evictDenials(now time.Time) {
+	if c.denials <= c.capacity {
+		return
+	}
+	for name, z := range c.zones {
+		for key, d := range z.records {
+			if now.After(d.expiration) || c.denials > c.capacity {
+				delete(z.records, key)
+				c.denials--
+			}
+		}
+		if len(z.records) == 0 {
+			delete(c.zones, name)
+		}
+	}
+}
+
+// Synthesize returns a negative answer to question from the kept denial
+// records of its zone, nil if they do not prove that the name or type does
+// not exist. With dnssec the answer includes the proof and signatures.
+func (c *Cache) Synthesize(question dns.Question, dnssec bool, msgid uint16) *dns.Msg {
+	if c.capacity <= 0 {
+		return nil
+	}
+	name := strings.ToLower(question.Name)
+	now := time.Now()
+
+	c.RLock()
+	defer c.RUnlock()
+	var z *zoneDenials
+	for zone := name; z == nil && zone != ""; zone = parent(zone) {
+		z = c.zones[zone]
+	}
+	if z == nil || now.After(z.soa.expiration) {
+		return nil
+	}
+	proof, rcode := z.deny(name, question.Qtype, now)
+	if proof == nil {
+		return nil
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(question.Name, question.Qtype)
+	m.Id = msgid
+	m.Response = true
+	m.Rcode = rcode
+	m.AuthenticatedData = true
+	m.Ns = remaining(z.soa, dnssec, now)
+	if dnssec {
+		for _, d := range proof {
+			m.Ns = append(m.Ns, remaining(d, true, now)...)
+		}
+	}
+	return m
+}
+
+// deny returns the records proving that name or type does not exist, and
+// the response code of the answer
+func (z *zoneDenials) deny(name string, qtype uint16, now time.Time) ([]*denial, int) {
+	var records []dns.RR
+	kept := make(map[dns.RR]*denial)
+	for _, d := range z.records {
+		if now.Before(d.expiration) {
+			records = append(records, d.rrs[0])
+			kept[d.rrs[0]] = d
+		}
+	}
+	rrs, rcode := dnssec.Deny(name, qtype, records)
+	if len(rrs) == 0 {
+		return nil, 0
+	}
+	proof := make([]*denial, len(rrs))
+	for i, rr := range rrs {
+		proof[i] = kept[rr]
+	}
+	return proof, rcode
+}
+
+// parent returns the name without its first label, "" for the root
+func parent(name string) string {
+	if name == "." {
+		return ""
+	}
+	if i, end := dns.NextLabel(name, 0); !end {
+		return name[i:]
+	}
+	return "."
+}
+
+// remaining returns copies of the records with the TTL they have left
+func remaining(d *denial, sigs bool, now time.Time) []dns.RR {
+	ttl := uint32(d.expiration.Sub(now) / time.Second)
+	var rrs []dns.RR
+	for i, rr := range d.rrs {
+		if i > 0 && !sigs {
+			break
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = ttl
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+// signatures returns the signatures of a zone in section covering the
+// records of name and type
+func signatures(section []dns.RR, name string, rrtype uint16, zone string) []dns.RR {
+	var sigs []dns.RR
+	for _, rr := range section {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == rrtype && strings.EqualFold(sig.Hdr.Name, name) && strings.EqualFold(sig.SignerName, zone) {
+			sigs = append(sigs, sig)
+		}
+	}
+	return sigs
+}
@@ -13,8 +13,38 @@ import (
 // Hit returns a dns message from the cache. If the message's TTL is expired nil
 // is returned and the message is removed from the cache.
 func (c *Cache) Hit(question dns.Question, dnssec, tcp bool, msgid uint16, keepStale bool, returnStale bool) *dns.Msg {
+	m, _ := c.hit(Key(question, dnssec, tcp), msgid, keepStale, returnStale)
+	return m
+}
+
+// HitSubnet is like Hit for a query with an EDNS client subnet option. It
+// returns the answer for the most specific network containing the subnet of
+// the query, or an answer valid for all clients.
+func (c *Cache) HitSubnet(question dns.Question, ecs *dns.EDNS0_SUBNET, dnssec, tcp bool, msgid uint16, keepStale bool, returnStale bool) *dns.Msg {
+	m, _ := c.Lookup(question, ecs, dnssec, tcp, msgid, keepStale, returnStale)
+	return m
+}
+
+// Lookup is like HitSubnet and also returns the DNSSEC validation state the
+// message was inserted with.
+func (c *Cache) Lookup(question dns.Question, ecs *dns.EDNS0_SUBNET, dnssec, tcp bool, msgid uint16, keepStale bool, returnStale bool) (*dns.Msg, Validation) {
 	key := Key(question, dnssec, tcp)
-	m1, exp, staleExp, hit := c.Search(key)
+	if ecs != nil && ecs.Address != nil && c.capacity > 0 {
+		for prefix := ecs.SourceNetmask; prefix > 0; prefix-- {
+			k := subnetKey(key, ecs.Address, prefix)
+			if k == "" {
+				continue
+			}
+			if m, v := c.hit(k, msgid, keepStale, returnStale); m != nil {
+				return m, v
+			}
+		}
+	}
+	return c.hit(key, msgid, keepStale, returnStale)
+}
+
+func (c *Cache) hit(key string, msgid uint16, keepStale bool, returnStale bool) (*dns.Msg, Validation) {
+	m1, exp, staleExp, validation, hit := c.search(key)
 	valid := time.Since(exp) < 0
 	if hit {
 		// Cache hit! \o/
@@ -34,12 +64,12 @@ func (c *Cache) Hit(question dns.Question, dnssec, tcp bool, msgid uint16, keepS
 			if time.Since(staleExp) > 0 {
 				c.Remove(key)
 			}
-			return m1
+			return m1, validation
 		}
 		// Expired! /o\
 		if !keepStale {
 			c.Remove(key)
 		}
 	}
-	return nil
+	return nil, Unvalidated
 }
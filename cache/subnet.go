@@ -0,0 +1,66 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package cache
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// Subnet returns the EDNS client subnet option (RFC 7871) of a message, nil
+// if there is none.
+func Subnet(m *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+// subnetKey extends a key with the network of ip with the prefix length.
+// Answers with a client subnet scope are cached under the network of the
+// scope and only returned to queries from that network.
+func subnetKey(key string, ip net.IP, prefix uint8) string {
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+	if int(prefix) > bits {
+		return ""
+	}
+	network := ip.Mask(net.CIDRMask(int(prefix), bits))
+	return key + "/" + network.String() + "/" + strconv.Itoa(int(prefix))
+}
+
+// scopeKey returns the key of a message with a client subnet scope, or the
+// key itself if the answer is valid for all clients.
+func scopeKey(key string, msg *dns.Msg) string {
+	e := Subnet(msg)
+	if e == nil || e.SourceScope == 0 || e.Address == nil {
+		return key
+	}
+	// Answers for a more specific network than asked for are cached for
+	// the network of the query
+	scope := e.SourceScope
+	if scope > e.SourceNetmask {
+		scope = e.SourceNetmask
+	}
+	if scope == 0 {
+		return key
+	}
+	if k := subnetKey(key, e.Address, scope); k != "" {
+		return k
+	}
+	return key
+}
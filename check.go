@@ -0,0 +1,306 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+
+	"github.com/claranet/go-dnsmasq/blocklist"
+	"github.com/claranet/go-dnsmasq/hostsfile"
+	"github.com/claranet/go-dnsmasq/leases"
+	"github.com/claranet/go-dnsmasq/records"
+	"github.com/claranet/go-dnsmasq/rpz"
+	"github.com/claranet/go-dnsmasq/server"
+)
+
+// checkAction validates the configuration given by the global options and
+// all local data sources, prints the effective configuration and fails if
+// any errors were found.
+func checkAction(c *cli.Context) error {
+	// Keep stdout for the report
+	log.SetOutput(os.Stderr)
+
+	// The options are global flags of the parent context
+	g := c.Parent()
+
+	var errors, warnings int
+	report := func(source string, line int, warning bool, msg string) {
+		level := "error"
+		if warning {
+			level = "warning"
+			warnings++
+		} else {
+			errors++
+		}
+		switch {
+		case source == "":
+			fmt.Printf("%s: %s\n", level, msg)
+		case line > 0:
+			fmt.Printf("%s:%d: %s: %s\n", source, line, level, msg)
+		default:
+			fmt.Printf("%s: %s: %s\n", source, level, msg)
+		}
+	}
+
+	config, views, errs := newConfig(g)
+	for _, err := range errs {
+		report("", 0, false, err.Error())
+	}
+
+	if path := config.Hostsfile; path != "" {
+		problems, err := hosts.Check(path)
+		if err != nil {
+			report(path, 0, false, err.Error())
+		}
+		for _, p := range problems {
+			report(path, p.Line, p.Ignored, p.Message)
+		}
+	}
+
+	for _, path := range g.StringSlice("leasefile") {
+		problems, err := leases.Check(path)
+		if err != nil {
+			report(path, 0, false, err.Error())
+		}
+		for _, p := range problems {
+			report(path, p.Line, false, p.Message)
+		}
+	}
+
+	if path := g.String("records-file"); path != "" {
+		problems, err := records.Check(path)
+		if err != nil && !os.IsNotExist(err) {
+			report(path, 0, false, err.Error())
+		}
+		for _, p := range problems {
+			report(path, 0, false, p)
+		}
+	}
+
+	for _, source := range g.StringSlice("blocklist") {
+		problems, err := blocklist.Check(source)
+		if err != nil {
+			report(source, 0, false, err.Error())
+		}
+		for _, p := range problems {
+			report(source, p.Line, true, p.Message)
+		}
+	}
+
+	zones, _ := rpzZones(g)
+	for _, zc := range zones {
+		// zones are transferred from their primaries only by the server
+		if zc.File == "" {
+			continue
+		}
+		if _, err := rpz.New(&rpz.Config{Zones: []rpz.ZoneConfig{zc}}); err != nil {
+			report("", 0, false, err.Error())
+		}
+	}
+
+	for _, v := range views {
+		if path := v.Hostsfile; path != "" {
+			problems, err := hosts.Check(path)
+			if err != nil {
+				report(path, 0, false, err.Error())
+			}
+			for _, p := range problems {
+				report(path, p.Line, p.Ignored, p.Message)
+			}
+		}
+	}
+
+	if errors+warnings > 0 {
+		fmt.Println()
+	}
+	printConfig(g, config, zones, views)
+
+	fmt.Printf("\n%d error(s), %d warning(s)\n", errors, warnings)
+	if errors > 0 {
+		return cli.NewExitError("", 1)
+	}
+	return nil
+}
+
+func printConfig(c *cli.Context, config *server.Config, zones []rpz.ZoneConfig, views []*server.View) {
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 2, ' ', 0)
+	orNone := func(values []string) string {
+		if len(values) == 0 {
+			return "-"
+		}
+		return strings.Join(values, ", ")
+	}
+	orAll := func(values []string) string {
+		if len(values) == 0 {
+			return "all"
+		}
+		return strings.Join(values, ", ")
+	}
+
+	nsSource := "/etc/resolv.conf"
+	if c.String("nameservers") != "" {
+		nsSource = "--nameservers"
+	}
+	search := "disabled"
+	if config.EnableSearch {
+		search = orNone(config.SearchDomains)
+	}
+	cache := "disabled"
+	if config.RCache > 0 {
+		cache = fmt.Sprintf("capacity %d, ttl %ds, stale ttl %ds", config.RCache, config.RCacheTtl, config.RStaleTtl)
+	}
+	docker := "disabled"
+	if c.Bool("docker") {
+		docker = fmt.Sprintf("%s (domain %s)", c.String("docker-socket"), c.String("docker-domain"))
+	}
+
+	ratelimit := "disabled"
+	if config.RateLimit > 0 {
+		ratelimit = fmt.Sprintf("%d/s per /%d and /%d, burst %d, slip %d", config.RateLimit,
+			config.RateLimitIPv4Prefix, config.RateLimitIPv6Prefix, config.RateLimitBurst, config.RateLimitSlip)
+		if config.RateLimitPerName {
+			ratelimit += ", per name"
+		}
+		if len(config.RateLimitExempt) > 0 {
+			ratelimit += ", exempt " + strings.Join(config.RateLimitExempt, ", ")
+		}
+	}
+
+	rebind := "disabled"
+	if config.StopRebind {
+		rebind = config.RebindAction
+		if len(config.RebindDomainsOK) > 0 {
+			rebind += ", allowed for " + strings.Join(config.RebindDomainsOK, ", ")
+		}
+	}
+	fmt.Fprintln(w, "Effective configuration:")
+	fmt.Fprintf(w, "  Listen\t%s\n", config.DnsAddr)
+	fmt.Fprintf(w, "  Nameservers\t%s (from %s)\n", orNone(config.Nameservers), nsSource)
+	fmt.Fprintf(w, "  Recursion\t%t\n", !config.NoRec)
+	fmt.Fprintf(w, "  ndots\t%d\n", config.Ndots)
+	fmt.Fprintf(w, "  fwd-ndots\t%d\n", config.FwdNdots)
+	fmt.Fprintf(w, "  Search domains\t%s\n", search)
+	fmt.Fprintf(w, "  Local domains\t%s\n", orNone(config.LocalDomains))
+	fmt.Fprintf(w, "  Hosts file\t%s\n", orNone(nonEmpty(config.Hostsfile)))
+	fmt.Fprintf(w, "  Lease files\t%s\n", orNone(c.StringSlice("leasefile")))
+	fmt.Fprintf(w, "  Docker\t%s\n", docker)
+	fmt.Fprintf(w, "  Records file\t%s\n", orNone(nonEmpty(c.String("records-file"))))
+	fmt.Fprintf(w, "  Allowed clients\t%s\n", orAll(config.AllowClients))
+	fmt.Fprintf(w, "  Denied clients\t%s\n", orNone(config.DenyClients))
+	fmt.Fprintf(w, "  Recursion allowed\t%s\n", orAll(config.AllowRecursion))
+	fmt.Fprintf(w, "  Recursion denied\t%s\n", orNone(config.DenyRecursion))
+	if len(config.AllowClients)+len(config.DenyClients)+len(config.AllowRecursion)+len(config.DenyRecursion) > 0 {
+		fmt.Fprintf(w, "  Deny action\t%s\n", config.DenyAction)
+	}
+	fmt.Fprintf(w, "  Rewrites\t%s\n", orNone(config.Rewrites))
+	if len(config.Rewrites) > 0 {
+		fmt.Fprintf(w, "  Rewrite answer\t%s\n", config.RewriteAnswer)
+	}
+	fmt.Fprintf(w, "  Rebind protection\t%s\n", rebind)
+	fmt.Fprintf(w, "  Address overrides\t%s\n", orNone(config.Addresses))
+	fmt.Fprintf(w, "  Address aliases\t%s\n", orNone(config.Aliases))
+	fmt.Fprintf(w, "  ANY queries\t%s\n", config.AnyResponse)
+	fmt.Fprintf(w, "  Query type policy\t%s\n", orNone(config.QtypePolicy))
+	ecs := config.ECS
+	if ecs == "add" || ecs == "replace" {
+		ecs += fmt.Sprintf(", source prefix /%d and /%d", config.ECSIPv4Prefix, config.ECSIPv6Prefix)
+	}
+	fmt.Fprintf(w, "  Client subnet\t%s\n", ecs)
+	fmt.Fprintf(w, "  EDNS buffer size\t%d\n", config.EDNSBufferSize)
+	fmt.Fprintf(w, "  TCP idle timeout\t%ds\n", config.TCPIdleTimeout)
+	cookies := "disabled"
+	if config.Cookies {
+		cookies = "enabled, random secret"
+		if len(config.CookieSecrets) > 0 {
+			cookies = fmt.Sprintf("enabled, %d configured secrets", len(config.CookieSecrets))
+		}
+		if config.RequireCookie {
+			cookies += ", required over UDP"
+		}
+	}
+	fmt.Fprintf(w, "  DNS cookies\t%s\n", cookies)
+	fmt.Fprintf(w, "  Randomize case\t%t\n", config.RandomizeCase)
+	validation := "disabled"
+	if config.DNSSEC {
+		validation = "enabled, built-in root trust anchors"
+		if config.TrustAnchorFile != "" {
+			validation = "enabled, trust anchors in " + config.TrustAnchorFile
+		}
+	}
+	fmt.Fprintf(w, "  DNSSEC validation\t%s\n", validation)
+	fmt.Fprintf(w, "  Aggressive NSEC\t%t\n", config.AggressiveNsec)
+	fmt.Fprintf(w, "  Rate limit\t%s\n", ratelimit)
+	fmt.Fprintf(w, "  Blocklists\t%s\n", orNone(c.StringSlice("blocklist")))
+	if len(c.StringSlice("blocklist")) > 0 {
+		fmt.Fprintf(w, "  Block response\t%s\n", config.BlockResponse)
+	}
+	var policyZones []string
+	for _, zc := range zones {
+		policyZones = append(policyZones, zc.String())
+	}
+	fmt.Fprintf(w, "  Policy zones\t%s\n", orNone(policyZones))
+	fmt.Fprintf(w, "  Response cache\t%s\n", cache)
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "Forwarding:")
+	if config.Stub != nil {
+		var zones []string
+		for zone := range *config.Stub {
+			zones = append(zones, zone)
+		}
+		sort.Strings(zones)
+		for _, zone := range zones {
+			fmt.Fprintf(w, "  %s\t%s\n", zone, strings.Join((*config.Stub)[zone], ", "))
+		}
+	}
+	for _, zone := range config.LocalDomains {
+		fmt.Fprintf(w, "  %s\t(local only)\n", zone)
+	}
+	fmt.Fprintf(w, "  .\t%s\n", orNone(config.Nameservers))
+
+	for _, v := range views {
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "View %s:\n", v.Name)
+		fmt.Fprintf(w, "  Clients\t%s\n", orAll(v.Clients))
+		fmt.Fprintf(w, "  Listeners\t%s\n", orAll(v.Listen))
+		if len(v.Nameservers) > 0 {
+			fmt.Fprintf(w, "  Nameservers\t%s\n", strings.Join(v.Nameservers, ", "))
+		}
+		var stubs []string
+		for zone := range v.Stub {
+			stubs = append(stubs, zone)
+		}
+		sort.Strings(stubs)
+		for _, zone := range stubs {
+			fmt.Fprintf(w, "  Stub %s\t%s\n", zone, strings.Join(v.Stub[zone], ", "))
+		}
+		if v.Hostsfile != "" {
+			fmt.Fprintf(w, "  Hosts file\t%s\n", v.Hostsfile)
+		}
+		if len(v.SearchDomains) > 0 {
+			fmt.Fprintf(w, "  Search domains\t%s\n", strings.Join(v.SearchDomains, ", "))
+		}
+		if v.RCache > 0 {
+			fmt.Fprintf(w, "  Response cache\tcapacity %d\n", v.RCache)
+		}
+	}
+	w.Flush()
+}
+
+func nonEmpty(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return []string{s}
+}
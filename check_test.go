@@ -0,0 +1,72 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+// runCheck runs the check command with the global options and returns
+// its report
+func runCheck(t *testing.T, args ...string) (string, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, exiter, errWriter := os.Stdout, cli.OsExiter, cli.ErrWriter
+	os.Stdout, cli.OsExiter, cli.ErrWriter = w, func(int) {}, io.Discard
+	defer func() { os.Stdout, cli.OsExiter, cli.ErrWriter = stdout, exiter, errWriter }()
+
+	out := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- string(data)
+	}()
+	err = newApp().Run(append(append([]string{"go-dnsmasq"}, args...), "check"))
+	w.Close()
+	return <-out, err
+}
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	hostsfile := filepath.Join(dir, "hosts")
+	if err := os.WriteFile(hostsfile, []byte("127.0.0.1 localhost\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	blocklist := filepath.Join(dir, "blocklist")
+	if err := os.WriteFile(blocklist, []byte("0.0.0.0 ads.example.com\nnot a domain\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the check does not transfer policy zones
+	report, err := runCheck(t, "--nameservers", "127.0.0.1:53", "--hostsfile", hostsfile, "--blocklist", blocklist,
+		"--rpz", "rpz.example.@127.0.0.1:1")
+	if err != nil || !strings.Contains(report, "0 error(s), 1 warning(s)") {
+		t.Errorf("expected a warning for the blocklist, got %v:\n%s", err, report)
+	}
+	if !strings.Contains(report, blocklist+":2: warning:") {
+		t.Errorf("expected the line of the blocklist warning, got:\n%s", report)
+	}
+
+	report, err = runCheck(t, "--nameservers", "127.0.0.1:53", "--hostsfile", hostsfile,
+		"--rcache-ttl", "0", "--ndots", "0", "--deny-action", "ignore",
+		"--edns-buffer-size", "100", "--blocklist", filepath.Join(dir, "missing"))
+	if err == nil || !strings.Contains(report, "5 error(s)") {
+		t.Errorf("expected every error to be reported, got %v:\n%s", err, report)
+	}
+	for _, expected := range []string{"'rcache-ttl'", "'ndots'", "'deny-action'", "'edns-buffer-size'", "missing: error:"} {
+		if !strings.Contains(report, expected) {
+			t.Errorf("expected an error for %s, got:\n%s", expected, report)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+
+	"github.com/claranet/go-dnsmasq/rpz"
+	"github.com/claranet/go-dnsmasq/server"
+)
+
+// newConfig builds the server configuration and the views from the command
+// line and resolv.conf. Rather than stopping at the first invalid option it
+// returns every problem found.
+func newConfig(c *cli.Context) (*server.Config, []*server.View, []error) {
+	var errs []error
+
+	var enableSearch bool
+	if c.IsSet("append-search-domains") {
+		log.Info("The flag '--append-search-domains' is deprecated. Please use '--enable-search' or '-search' instead.")
+		enableSearch = c.Bool("append-search-domains")
+	} else {
+		enableSearch = c.Bool("enable-search")
+	}
+
+	var nameservers []string
+	if ns := c.String("nameservers"); ns != "" {
+		for _, hostPort := range strings.Split(ns, ",") {
+			hostPort, err := parseHostPort(hostPort)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("Nameserver is invalid: %s", err))
+				continue
+			}
+			nameservers = append(nameservers, hostPort)
+		}
+	}
+
+	var searchDomains []string
+	if sd := c.String("search-domains"); sd != "" {
+		for _, domain := range strings.Split(sd, ",") {
+			if dns.CountLabel(domain) < 2 {
+				errs = append(errs, fmt.Errorf("Search domain must have at least one dot in name: %s", domain))
+				continue
+			}
+			domain = strings.TrimSpace(domain)
+			domain = dns.Fqdn(strings.ToLower(domain))
+			searchDomains = append(searchDomains, domain)
+		}
+	}
+
+	var localDomains []string
+	for _, ld := range c.StringSlice("local-domain") {
+		for _, domain := range strings.Split(ld, ",") {
+			domain = strings.TrimSpace(domain)
+			if dns.CountLabel(domain) < 1 {
+				errs = append(errs, fmt.Errorf("Local domain is not a fully-qualified domain name: %s", domain))
+				continue
+			}
+			localDomains = append(localDomains, dns.Fqdn(strings.ToLower(domain)))
+		}
+	}
+
+	_, rpzErrs := rpzZones(c)
+	errs = append(errs, rpzErrs...)
+
+	views, viewErrs := loadViews(c)
+	errs = append(errs, viewErrs...)
+
+	// Access lists may be comma separated or repeated
+	list := func(name string) []string {
+		var values []string
+		for _, v := range c.StringSlice(name) {
+			values = append(values, strings.Split(v, ",")...)
+		}
+		return values
+	}
+
+	var rebindDomains []string
+	for _, domain := range list("rebind-domain-ok") {
+		domain = strings.TrimSpace(domain)
+		if dns.CountLabel(domain) < 1 {
+			errs = append(errs, fmt.Errorf("Rebind domain is not a fully-qualified domain name: %s", domain))
+			continue
+		}
+		rebindDomains = append(rebindDomains, dns.Fqdn(strings.ToLower(domain)))
+	}
+
+	listen, err := parseHostPort(c.String("listen"))
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Listen address is invalid: %s", err))
+	}
+
+	config := &server.Config{
+		DnsAddr:             listen,
+		DefaultResolver:     c.Bool("default-resolver"),
+		Nameservers:         nameservers,
+		Systemd:             c.Bool("systemd"),
+		SearchDomains:       searchDomains,
+		EnableSearch:        enableSearch,
+		LocalDomains:        localDomains,
+		Hostsfile:           c.String("hostsfile"),
+		PollInterval:        c.Int("hostsfile-poll"),
+		RoundRobin:          c.Bool("round-robin"),
+		NoRec:               c.Bool("no-rec"),
+		FwdNdots:            c.Int("fwd-ndots"),
+		Ndots:               c.Int("ndots"),
+		ReadTimeout:         2 * time.Second,
+		RCache:              c.Int("rcache"),
+		RCacheTtl:           c.Int("rcache-ttl"),
+		RCacheTtlFromResp:   c.Bool("rcache-ttl-from-resp"),
+		RCacheTtlMax:        c.Int("rcache-ttl-max"),
+		RStaleTtl:           c.Int("rstale-ttl"),
+		RCacheNonNegative:   c.Bool("rcache-non-negative"),
+		AllowClients:        list("allow-client"),
+		DenyClients:         list("deny-client"),
+		AllowRecursion:      list("allow-recursion"),
+		DenyRecursion:       list("deny-recursion"),
+		DenyAction:          c.String("deny-action"),
+		Rewrites:            c.StringSlice("rewrite"),
+		RewriteAnswer:       c.String("rewrite-answer"),
+		StopRebind:          c.Bool("stop-dns-rebind"),
+		RebindDomainsOK:     rebindDomains,
+		RebindAction:        c.String("rebind-action"),
+		Addresses:           list("address"),
+		Aliases:             list("alias"),
+		QtypePolicy:         list("qtype-policy"),
+		AnyResponse:         c.String("any-response"),
+		ECS:                 c.String("ecs"),
+		ECSIPv4Prefix:       c.Int("ecs-ipv4-prefix"),
+		ECSIPv6Prefix:       c.Int("ecs-ipv6-prefix"),
+		EDNSBufferSize:      c.Int("edns-buffer-size"),
+		TCPIdleTimeout:      c.Int("tcp-idle-timeout"),
+		Cookies:             c.Bool("cookies"),
+		CookieSecrets:       list("cookie-secret"),
+		RequireCookie:       c.Bool("require-cookie"),
+		RandomizeCase:       c.Bool("randomize-case"),
+		DNSSEC:              c.Bool("dnssec"),
+		TrustAnchorFile:     c.String("trust-anchors"),
+		AggressiveNsec:      c.Bool("aggressive-nsec"),
+		RateLimit:           c.Int("ratelimit"),
+		RateLimitBurst:      c.Int("ratelimit-burst"),
+		RateLimitSlip:       c.Int("ratelimit-slip"),
+		RateLimitIPv4Prefix: c.Int("ratelimit-ipv4-prefix"),
+		RateLimitIPv6Prefix: c.Int("ratelimit-ipv6-prefix"),
+		RateLimitPerName:    c.Bool("ratelimit-per-name"),
+		RateLimitExempt:     list("ratelimit-exempt"),
+		BlockResponse:       c.String("block-response"),
+		Verbose:             c.Bool("verbose"),
+	}
+
+	if err := server.ResolvConf(config, c); err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("Error parsing resolv.conf: %s", err.Error())
+		}
+	}
+
+	if err := server.CheckConfig(config); err != nil {
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			errs = append(errs, joined.Unwrap()...)
+		} else {
+			errs = append(errs, err)
+		}
+	}
+
+	if stubzones := c.StringSlice("stubzones"); len(stubzones) > 0 {
+		stubmap := make(map[string][]string)
+		for _, stubzone := range stubzones {
+			segments := strings.Split(stubzone, "/")
+			if len(segments) != 2 || len(segments[0]) == 0 || len(segments[1]) == 0 {
+				errs = append(errs, fmt.Errorf("Invalid value for --stubzones: %s", stubzone))
+				continue
+			}
+
+			hosts := strings.Split(segments[1], ",")
+			for _, hostPort := range hosts {
+				hostPort, err := parseHostPort(hostPort)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("Stubzone server address is invalid: %s", err))
+					continue
+				}
+
+				for _, sdomain := range strings.Split(segments[0], ",") {
+					if dns.CountLabel(sdomain) < 1 {
+						errs = append(errs, fmt.Errorf("Stubzone domain is not a fully-qualified domain name: %s", sdomain))
+						continue
+					}
+					sdomain = strings.TrimSpace(sdomain)
+					sdomain = dns.Fqdn(sdomain)
+					stubmap[sdomain] = append(stubmap[sdomain], hostPort)
+				}
+			}
+		}
+		config.Stub = &stubmap
+	}
+
+	return config, views, errs
+}
+
+// rpzZones parses the policy zones, given as <zone>=<file> or as
+// <zone>@<host[:port]> to transfer the zone from a primary.
+func rpzZones(c *cli.Context) ([]rpz.ZoneConfig, []error) {
+	var zones []rpz.ZoneConfig
+	var errs []error
+	for _, value := range c.StringSlice("rpz") {
+		var zc rpz.ZoneConfig
+		if i := strings.IndexAny(value, "=@"); i > 0 && i < len(value)-1 {
+			zc.Name = dns.Fqdn(strings.ToLower(value[:i]))
+			if value[i] == '=' {
+				zc.File = value[i+1:]
+			} else {
+				primary, err := parseHostPort(value[i+1:])
+				if err != nil {
+					errs = append(errs, fmt.Errorf("Policy zone primary is invalid: %s", err))
+					continue
+				}
+				zc.Primary = primary
+			}
+		}
+		if zc.Name == "" || dns.CountLabel(zc.Name) < 1 {
+			errs = append(errs, fmt.Errorf("Invalid value for --rpz: %s", value))
+			continue
+		}
+		zones = append(zones, zc)
+	}
+	return zones, errs
+}
+
+// loadViews reads the views from the JSON file given by --views and
+// normalizes their addresses and domains.
+func loadViews(c *cli.Context) ([]*server.View, []error) {
+	path := c.String("views")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, []error{fmt.Errorf("Error reading views: %s", err)}
+	}
+	var views []*server.View
+	if err := json.Unmarshal(data, &views); err != nil {
+		return nil, []error{fmt.Errorf("Error parsing views %s: %s", path, err)}
+	}
+
+	var errs []error
+	names := make(map[string]bool)
+	for i, v := range views {
+		if v.Name == "" {
+			v.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if names[v.Name] {
+			errs = append(errs, fmt.Errorf("Duplicate view name: %s", v.Name))
+		}
+		names[v.Name] = true
+
+		if _, err := server.NewACL(v.Clients, nil); err != nil {
+			errs = append(errs, fmt.Errorf("Invalid clients of view %s: %s", v.Name, err))
+		}
+		for j, hostPort := range v.Listen {
+			hostPort, err := parseHostPort(hostPort)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("Listen address of view %s is invalid: %s", v.Name, err))
+				continue
+			}
+			// Compared with the local address of the connection
+			host, port, _ := net.SplitHostPort(hostPort)
+			v.Listen[j] = net.JoinHostPort(net.ParseIP(host).String(), port)
+		}
+		for j, hostPort := range v.Nameservers {
+			hostPort, err := parseHostPort(hostPort)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("Nameserver of view %s is invalid: %s", v.Name, err))
+				continue
+			}
+			v.Nameservers[j] = hostPort
+		}
+		if v.Stub != nil {
+			stubmap := make(map[string][]string)
+			for sdomain, hosts := range v.Stub {
+				if dns.CountLabel(sdomain) < 1 {
+					errs = append(errs, fmt.Errorf("Stubzone domain of view %s is not a fully-qualified domain name: %s", v.Name, sdomain))
+					continue
+				}
+				sdomain = dns.Fqdn(strings.TrimSpace(sdomain))
+				for _, hostPort := range hosts {
+					hostPort, err := parseHostPort(hostPort)
+					if err != nil {
+						errs = append(errs, fmt.Errorf("Stubzone server address of view %s is invalid: %s", v.Name, err))
+						continue
+					}
+					stubmap[sdomain] = append(stubmap[sdomain], hostPort)
+				}
+			}
+			v.Stub = stubmap
+		}
+		for j, domain := range v.SearchDomains {
+			if dns.CountLabel(domain) < 2 {
+				errs = append(errs, fmt.Errorf("Search domain of view %s must have at least one dot in name: %s", v.Name, domain))
+				continue
+			}
+			v.SearchDomains[j] = dns.Fqdn(strings.ToLower(strings.TrimSpace(domain)))
+		}
+		if v.RCache < 0 {
+			errs = append(errs, fmt.Errorf("Cache capacity of view %s must not be negative", v.Name))
+		}
+	}
+	return views, errs
+}
+
+// parseHostPort validates a <host[:port]> address, adding the default DNS
+// port if none is given.
+func parseHostPort(hostPort string) (string, error) {
+	hostPort = strings.TrimSpace(hostPort)
+	if strings.HasSuffix(hostPort, "]") {
+		hostPort += ":53"
+	} else if !strings.Contains(hostPort, ":") {
+		hostPort += ":53"
+	}
+	if err := validateHostPort(hostPort); err != nil {
+		return "", err
+	}
+	return hostPort, nil
+}
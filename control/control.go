@@ -3,9 +3,12 @@ package control
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"time"
 
 	"github.com/claranet/go-dnsmasq/cache"
+	"github.com/claranet/go-dnsmasq/records"
 	"github.com/claranet/go-dnsmasq/server"
 	log "github.com/sirupsen/logrus"
 )
@@ -13,14 +16,26 @@ import (
 const defaultControlAddr = "127.0.0.1"
 
 type control struct {
-	port int
-	cch  *cache.Cache
+	port  int
+	cch   *cache.Cache
+	store *records.Store
 }
 
 type PingResponse struct {
 	Ping string `json:"ping"`
 }
 
+type RecordRequest struct {
+	Name string `json:"name"`
+	IP   string `json:"ip"`
+	// TTL in seconds after which the record expires, '0' keeps it forever
+	TTL int `json:"ttl,omitempty"`
+}
+
+type RemoveRecordsResponse struct {
+	Removed int `json:"removed"`
+}
+
 type StatsResponse struct {
 	StatsForwardCount     int64   `json:"forwardCount"`
 	StatsStubForwardCount int64   `json:"stubForwardCount"`
@@ -28,12 +43,22 @@ type StatsResponse struct {
 	StatsRequestCount     int64   `json:"requestCount"`
 	StatsDnssecOkCount    int64   `json:"dnssecOkCount"`
 	StatsNameErrorCount   int64   `json:"nameErrorCount"`
+	StatsRefusedCount     int64   `json:"refusedCount"`
 	StatsNoDataCount      int64   `json:"noDataCount"`
 	StatsDnssecCacheMiss  int64   `json:"dnssecCacheMiss"`
 	StatsCacheMiss        int64   `json:"cacheMiss"`
 	StatsCacheHit         int64   `json:"cacheHit"`
 	StatsRequestFail      int64   `json:"requestFail"`
 	StatsStaleCacheHit    int64   `json:"staleCacheHit"`
+	StatsBlockedCount     int64   `json:"blockedCount"`
+	StatsPolicyCount      int64   `json:"policyCount"`
+	StatsRateLimitedCount int64   `json:"rateLimitedCount"`
+	StatsRebindCount      int64   `json:"rebindCount"`
+	StatsDnssecSecure     int64   `json:"dnssecSecure"`
+	StatsDnssecBogus      int64   `json:"dnssecBogus"`
+	StatsSynthesizedCount int64   `json:"synthesizedCount"`
+	StatsInvalidCount     int64   `json:"invalidCount"`
+	StatsBadCookieCount   int64   `json:"badCookieCount"`
 	StatsCacheSize        int     `json:"cacheSize"`
 	StatsCacheCapacity    int     `json:"cacheCapacity"`
 	StatsCacheHitRate     float64 `json:"cacheHitRate"`
@@ -73,12 +98,22 @@ func (c *control) statsHandler(w http.ResponseWriter, r *http.Request) {
 		StatsRequestCount:     server.StatsRequestCount.Count(),
 		StatsDnssecOkCount:    server.StatsDnssecOkCount.Count(),
 		StatsNameErrorCount:   server.StatsNameErrorCount.Count(),
+		StatsRefusedCount:     server.StatsRefusedCount.Count(),
 		StatsNoDataCount:      server.StatsNoDataCount.Count(),
 		StatsDnssecCacheMiss:  server.StatsDnssecCacheMiss.Count(),
 		StatsCacheMiss:        server.StatsCacheMiss.Count(),
 		StatsCacheHit:         server.StatsCacheHit.Count(),
 		StatsRequestFail:      server.StatsRequestFail.Count(),
 		StatsStaleCacheHit:    server.StatsStaleCacheHit.Count(),
+		StatsBlockedCount:     server.StatsBlockedCount.Count(),
+		StatsPolicyCount:      server.StatsPolicyCount.Count(),
+		StatsRateLimitedCount: server.StatsRateLimitedCount.Count(),
+		StatsRebindCount:      server.StatsRebindCount.Count(),
+		StatsDnssecSecure:     server.StatsDnssecSecure.Count(),
+		StatsDnssecBogus:      server.StatsDnssecBogus.Count(),
+		StatsSynthesizedCount: server.StatsSynthesizedCount.Count(),
+		StatsInvalidCount:     server.StatsInvalidCount.Count(),
+		StatsBadCookieCount:   server.StatsBadCookieCount.Count(),
 		StatsCacheSize:        c.cch.CacheSize(),
 		StatsCacheCapacity:    c.cch.Capacity(),
 		StatsCacheHitRate:     hitRate,
@@ -97,14 +132,63 @@ func (c *control) dumpHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (c *control) recordsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse, err := json.Marshal(c.store.List())
+		writeResponse(w, jsonResponse, err)
+	case http.MethodPost:
+		var req RecordRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %s", err), http.StatusBadRequest)
+			return
+		}
+		if req.TTL < 0 {
+			http.Error(w, "'ttl' must be equal or greater than 0", http.StatusBadRequest)
+			return
+		}
+		record, err := c.store.Add(req.Name, net.ParseIP(req.IP), time.Duration(req.TTL)*time.Second)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		jsonResponse, err := json.Marshal(record)
+		writeResponse(w, jsonResponse, err)
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			http.Error(w, "Missing 'name' parameter", http.StatusBadRequest)
+			return
+		}
+		var ip net.IP
+		if v := r.URL.Query().Get("ip"); v != "" {
+			if ip = net.ParseIP(v); ip == nil {
+				http.Error(w, fmt.Sprintf("Invalid IP address: %s", v), http.StatusBadRequest)
+				return
+			}
+		}
+		removed := c.store.Remove(name, ip)
+		if removed == 0 {
+			http.Error(w, "No matching records", http.StatusNotFound)
+			return
+		}
+		jsonResponse, err := json.Marshal(RemoveRecordsResponse{Removed: removed})
+		writeResponse(w, jsonResponse, err)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
 func getAddr(port int) string {
 	return fmt.Sprintf("%s:%d", defaultControlAddr, port)
 }
 
-func New(port int, cch *cache.Cache) *control {
+func New(port int, cch *cache.Cache, store *records.Store) *control {
 	return &control{
-		port: port,
-		cch:  cch,
+		port:  port,
+		cch:   cch,
+		store: store,
 	}
 }
 
@@ -113,6 +197,7 @@ func (c *control) Run() error {
 	http.HandleFunc("/ping", pingHandler)
 	http.HandleFunc("/stats", c.statsHandler)
 	http.HandleFunc("/dump", c.dumpHandler)
+	http.HandleFunc("/records", c.recordsHandler)
 
 	log.Infof("Control server listening on http://%s", addr)
 	return http.ListenAndServe(addr, nil)
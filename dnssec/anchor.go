@@ -0,0 +1,215 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package dnssec
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// Root zone key signing keys KSK-2017 and KSK-2024 as published by IANA
+var rootAnchors = []string{
+	". 0 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". 0 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// holdDown is the time a new key must be seen before it is trusted (RFC 5011)
+const holdDown = 30 * 24 * time.Hour
+
+// Key states of RFC 5011, keys that disappear before they are trusted are
+// forgotten.
+const (
+	stateAddPend = "addpend"
+	stateValid   = "valid"
+	stateRevoked = "revoked"
+)
+
+type anchorKey struct {
+	Key       string    `json:"key"`
+	State     string    `json:"state"`
+	FirstSeen time.Time `json:"first_seen"`
+
+	dnskey *dns.DNSKEY
+}
+
+// Anchors are the trust anchors of the root zone. They start out as the
+// DS records of the root key signing keys and follow key rollovers as
+// described in RFC 5011. The state is saved to a file if one is given.
+type Anchors struct {
+	path  string
+	ds    []*dns.DS
+	keys  []*anchorKey
+	mutex sync.Mutex
+}
+
+// LoadAnchors loads the trust anchor state from path. Without a path or if
+// the file does not exist yet, the built-in root anchors are used.
+func LoadAnchors(path string) (*Anchors, error) {
+	a := &Anchors{path: path}
+	for _, s := range rootAnchors {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return nil, err
+		}
+		a.ds = append(a.ds, rr.(*dns.DS))
+	}
+	if path == "" {
+		return a, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &a.keys); err != nil {
+		return nil, fmt.Errorf("Error parsing trust anchors %s: %s", path, err)
+	}
+	for _, k := range a.keys {
+		rr, err := dns.NewRR(k.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trust anchor in %s: %s", path, err)
+		}
+		dnskey, ok := rr.(*dns.DNSKEY)
+		if !ok {
+			return nil, fmt.Errorf("Trust anchor is not a DNSKEY record in %s: %s", path, k.Key)
+		}
+		switch k.State {
+		case stateAddPend, stateValid, stateRevoked:
+		default:
+			return nil, fmt.Errorf("Invalid trust anchor state in %s: %s", path, k.State)
+		}
+		k.dnskey = dnskey
+	}
+	return a, nil
+}
+
+// trusted returns true if key is a trust anchor
+func (a *Anchors) trusted(key *dns.DNSKEY) bool {
+	if key.Flags&dns.REVOKE != 0 {
+		return false
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if k := a.find(key); k != nil {
+		return k.State == stateValid
+	}
+	for _, ds := range a.ds {
+		if ds.KeyTag != key.KeyTag() || ds.Algorithm != key.Algorithm {
+			continue
+		}
+		if d := key.ToDS(ds.DigestType); d != nil && strings.EqualFold(d.Digest, ds.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// find returns the state of key, ignoring the revoke flag
+func (a *Anchors) find(key *dns.DNSKEY) *anchorKey {
+	for _, k := range a.keys {
+		if k.dnskey.Algorithm == key.Algorithm && k.dnskey.PublicKey == key.PublicKey {
+			return k
+		}
+	}
+	return nil
+}
+
+// update applies the root key set, validated by a trusted key, to the key
+// states: new key signing keys are trusted after the hold-down time, keys
+// that sign the key set with the revoke flag set are no longer trusted.
+func (a *Anchors) update(keys []*dns.DNSKEY, sigs []*dns.RRSIG, now time.Time) {
+	rrset := make([]dns.RR, len(keys))
+	for i, key := range keys {
+		rrset[i] = key
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	changed := false
+	seen := make(map[*anchorKey]bool)
+	for _, key := range keys {
+		if key.Flags&dns.SEP == 0 {
+			continue
+		}
+		k := a.find(key)
+		if key.Flags&dns.REVOKE != 0 {
+			if k != nil && k.State != stateRevoked && signs(key, sigs, rrset, now) {
+				log.Warnf("DNSSEC trust anchor %d revoked", key.KeyTag())
+				k.State = stateRevoked
+				changed = true
+			}
+			continue
+		}
+		if k == nil {
+			state := stateAddPend
+			if a.trustedByDS(key) {
+				state = stateValid
+			} else {
+				log.Infof("New DNSSEC root key %d, trusted after %s", key.KeyTag(), holdDown)
+			}
+			k = &anchorKey{Key: key.String(), State: state, FirstSeen: now, dnskey: key}
+			a.keys = append(a.keys, k)
+			changed = true
+		}
+		if k.State == stateAddPend && now.Sub(k.FirstSeen) >= holdDown {
+			log.Infof("DNSSEC root key %d is now a trust anchor", key.KeyTag())
+			k.State = stateValid
+			changed = true
+		}
+		seen[k] = true
+	}
+
+	kept := a.keys[:0]
+	for _, k := range a.keys {
+		if k.State == stateAddPend && !seen[k] {
+			changed = true
+			continue
+		}
+		kept = append(kept, k)
+	}
+	a.keys = kept
+
+	if changed {
+		if err := a.save(); err != nil {
+			log.Errorf("Error saving trust anchors: %s", err)
+		}
+	}
+}
+
+func (a *Anchors) trustedByDS(key *dns.DNSKEY) bool {
+	for _, ds := range a.ds {
+		if d := key.ToDS(ds.DigestType); d != nil && ds.KeyTag == key.KeyTag() && strings.EqualFold(d.Digest, ds.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Anchors) save() error {
+	if a.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(a.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := a.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
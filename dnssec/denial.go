@@ -0,0 +1,380 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package dnssec
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Proofs of nonexistence from NSEC (RFC 4035) and NSEC3 (RFC 5155) records.
+// The records must have been validated before.
+
+func denialRecords(section []dns.RR) ([]*dns.NSEC, []*dns.NSEC3) {
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, rr := range section {
+		switch t := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, t)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, t)
+		}
+	}
+	return nsecs, nsec3s
+}
+
+// provesNoName returns true if section proves that name does not exist. For
+// a wildcard answer the closest encloser is known and only the query name
+// must be denied, otherwise there must be no matching wildcard either.
+func provesNoName(name, closest string, section []dns.RR) bool {
+	nsecs, nsec3s := denialRecords(section)
+
+	for _, nsec := range nsecs {
+		if !covers(nsec, name) {
+			continue
+		}
+		if closest != "" {
+			return true
+		}
+		ce := closestEncloser(name, nsec)
+		for _, w := range nsecs {
+			if covers(w, wildcardOf(ce)) {
+				return true
+			}
+		}
+	}
+
+	if len(nsec3s) == 0 {
+		return false
+	}
+	if closest == "" {
+		closest = closestEncloser3(name, nsec3s)
+		if closest == "" {
+			return false
+		}
+		if !covered3(nsec3s, wildcardOf(closest)) {
+			return false
+		}
+	}
+	return covered3(nsec3s, nextCloser(name, closest))
+}
+
+// provesNoType returns true if section proves that name has no records of
+// qtype, and whether name is a delegation. For NSEC3 opt-out only proves
+// that there may be an insecure delegation.
+func provesNoType(name string, qtype uint16, section []dns.RR) (denied, delegation, optOut bool) {
+	nsecs, nsec3s := denialRecords(section)
+
+	for _, nsec := range nsecs {
+		if strings.EqualFold(nsec.Hdr.Name, name) {
+			return lacks(nsec.TypeBitMap, qtype), hasDelegation(nsec.TypeBitMap), false
+		}
+	}
+	// NODATA for a name matching a wildcard
+	for _, nsec := range nsecs {
+		if covers(nsec, name) {
+			wildcard := wildcardOf(closestEncloser(name, nsec))
+			for _, w := range nsecs {
+				if strings.EqualFold(w.Hdr.Name, wildcard) {
+					return lacks(w.TypeBitMap, qtype), false, false
+				}
+			}
+		}
+	}
+
+	for _, nsec3 := range nsec3s {
+		if nsec3.Match(name) {
+			return lacks(nsec3.TypeBitMap, qtype), hasDelegation(nsec3.TypeBitMap), false
+		}
+	}
+	closest := closestEncloser3(name, nsec3s)
+	if closest == "" {
+		return false, false, false
+	}
+	next := nextCloser(name, closest)
+	for _, nsec3 := range nsec3s {
+		if nsec3.Cover(next) && !nsec3.Match(next) && nsec3.Flags&1 == 1 {
+			return true, false, true
+		}
+	}
+	for _, nsec3 := range nsec3s {
+		if nsec3.Match(wildcardOf(closest)) {
+			return covered3(nsec3s, next) && lacks(nsec3.TypeBitMap, qtype), false, false
+		}
+	}
+	return false, false, false
+}
+
+// wildcardOf returns the wildcard name directly below an encloser
+func wildcardOf(encloser string) string {
+	if encloser == "." {
+		return "*."
+	}
+	return "*." + encloser
+}
+
+func lacks(types []uint16, qtype uint16) bool {
+	for _, t := range types {
+		if t == qtype || t == dns.TypeCNAME {
+			return false
+		}
+	}
+	return true
+}
+
+// hasDelegation returns true for the type bitmap of a delegation point
+func hasDelegation(types []uint16) bool {
+	ns, soa := false, false
+	for _, t := range types {
+		switch t {
+		case dns.TypeNS:
+			ns = true
+		case dns.TypeSOA:
+			soa = true
+		}
+	}
+	return ns && !soa
+}
+
+// covers returns true if name sorts between the owner and the next name of
+// an NSEC record
+func covers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if compare(owner, next) < 0 {
+		return compare(owner, name) < 0 && compare(name, next) < 0
+	}
+	// The last NSEC of the zone points back to the apex
+	return compare(owner, name) < 0 || compare(name, next) < 0
+}
+
+// closestEncloser returns the longest existing ancestor of name that an
+// NSEC record covering name proves
+func closestEncloser(name string, nsec *dns.NSEC) string {
+	ce := commonAncestor(name, nsec.Hdr.Name)
+	if c := commonAncestor(name, nsec.NextDomain); dns.CountLabel(c) > dns.CountLabel(ce) {
+		ce = c
+	}
+	return ce
+}
+
+func commonAncestor(a, b string) string {
+	labels := dns.SplitDomainName(a)
+	n := dns.CompareDomainName(a, b)
+	if n == 0 {
+		return "."
+	}
+	return strings.ToLower(strings.Join(labels[len(labels)-n:], ".")) + "."
+}
+
+// closestEncloser3 returns the longest ancestor of name matched by an NSEC3
+// record
+func closestEncloser3(name string, nsec3s []*dns.NSEC3) string {
+	for ancestor := parent(name); ; ancestor = parent(ancestor) {
+		for _, nsec3 := range nsec3s {
+			if nsec3.Match(ancestor) {
+				return ancestor
+			}
+		}
+		if ancestor == "." {
+			return ""
+		}
+	}
+}
+
+// nextCloser returns the ancestor of name one label longer than closest
+func nextCloser(name, closest string) string {
+	labels := dns.SplitDomainName(name)
+	n := dns.CountLabel(closest) + 1
+	if n > len(labels) {
+		return name
+	}
+	return strings.Join(labels[len(labels)-n:], ".") + "."
+}
+
+func covered3(nsec3s []*dns.NSEC3, name string) bool {
+	for _, nsec3 := range nsec3s {
+		if nsec3.Cover(name) && !nsec3.Match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// compare orders names canonically (RFC 4034 section 6.1)
+func compare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// Deny returns the records among validated NSEC or NSEC3 records of one zone
+// that prove that name does not exist or has no records of qtype, and the
+// response code of the proven answer, to answer without asking upstream
+// (RFC 8198). It returns no records if they prove neither.
+func Deny(name string, qtype uint16, records []dns.RR) ([]dns.RR, int) {
+	name = strings.ToLower(dns.Fqdn(name))
+	nsecs, nsec3s := denialRecords(records)
+	if proof, rcode := denyNSEC(name, qtype, nsecs); proof != nil {
+		return proof, rcode
+	}
+	return denyNSEC3(name, qtype, nsec3s)
+}
+
+func denyNSEC(name string, qtype uint16, nsecs []*dns.NSEC) ([]dns.RR, int) {
+	for _, nsec := range nsecs {
+		if strings.EqualFold(nsec.Hdr.Name, name) {
+			if noData(nsec.TypeBitMap, qtype) {
+				return []dns.RR{nsec}, dns.RcodeSuccess
+			}
+			return nil, 0
+		}
+	}
+	for _, nsec := range nsecs {
+		if !covers(nsec, name) || below(name, nsec.Hdr.Name, nsec.TypeBitMap) {
+			continue
+		}
+		wildcard := wildcardOf(closestEncloser(name, nsec))
+		for _, w := range nsecs {
+			switch {
+			case covers(w, wildcard):
+				return proof(nsec, w), dns.RcodeNameError
+			case strings.EqualFold(w.Hdr.Name, wildcard):
+				// Answers synthesized from the wildcard itself need its data
+				if lacks(w.TypeBitMap, qtype) {
+					return proof(nsec, w), dns.RcodeSuccess
+				}
+				return nil, 0
+			}
+		}
+	}
+	return nil, 0
+}
+
+func denyNSEC3(name string, qtype uint16, nsec3s []*dns.NSEC3) ([]dns.RR, int) {
+	h := make(hashes)
+	for _, nsec3 := range nsec3s {
+		if h.matches(nsec3, name) {
+			if noData(nsec3.TypeBitMap, qtype) {
+				return []dns.RR{nsec3}, dns.RcodeSuccess
+			}
+			return nil, 0
+		}
+	}
+
+	// Closest encloser proof (RFC 5155 section 7.2.1)
+	var closest *dns.NSEC3
+	encloser := name
+	for encloser != "." && closest == nil {
+		encloser = parent(encloser)
+		for _, nsec3 := range nsec3s {
+			if h.matches(nsec3, encloser) {
+				closest = nsec3
+				break
+			}
+		}
+	}
+	if closest == nil || below(name, encloser, closest.TypeBitMap) {
+		return nil, 0
+	}
+	next := h.covering(nsec3s, nextCloser(name, encloser))
+	// Opt-out leaves room for unsigned delegations
+	if next == nil || next.Flags&1 == 1 {
+		return nil, 0
+	}
+	wildcard := wildcardOf(encloser)
+	if w := h.covering(nsec3s, wildcard); w != nil {
+		return proof(closest, next, w), dns.RcodeNameError
+	}
+	for _, w := range nsec3s {
+		if h.matches(w, wildcard) {
+			if lacks(w.TypeBitMap, qtype) {
+				return proof(closest, next, w), dns.RcodeSuccess
+			}
+			return nil, 0
+		}
+	}
+	return nil, 0
+}
+
+// noData returns true if the type bitmap of a name proves that it has no
+// records of qtype. The bitmap of a delegation only proves it for DS.
+func noData(types []uint16, qtype uint16) bool {
+	if hasDelegation(types) && qtype != dns.TypeDS {
+		return false
+	}
+	return lacks(types, qtype)
+}
+
+// below returns true if name is below a delegation or a DNAME at owner, so
+// that the records of the zone do not prove anything about it
+func below(name, owner string, types []uint16) bool {
+	if strings.EqualFold(name, owner) || !dns.IsSubDomain(owner, name) {
+		return false
+	}
+	for _, t := range types {
+		if t == dns.TypeDNAME {
+			return true
+		}
+	}
+	return hasDelegation(types)
+}
+
+// proof returns the distinct records of a proof
+func proof(rrs ...dns.RR) []dns.RR {
+	var distinct []dns.RR
+	for _, rr := range rrs {
+		if !slices.Contains(distinct, rr) {
+			distinct = append(distinct, rr)
+		}
+	}
+	return distinct
+}
+
+// hashes remembers the NSEC3 hashes of names, which are expensive to compute
+type hashes map[string]string
+
+func (h hashes) hash(nsec3 *dns.NSEC3, name string) string {
+	key := fmt.Sprintf("%d/%d/%s/%s", nsec3.Hash, nsec3.Iterations, nsec3.Salt, name)
+	hash, ok := h[key]
+	if !ok {
+		hash = dns.HashName(name, nsec3.Hash, nsec3.Iterations, nsec3.Salt)
+		h[key] = hash
+	}
+	return hash
+}
+
+func (h hashes) matches(nsec3 *dns.NSEC3, name string) bool {
+	owner := dns.SplitDomainName(nsec3.Hdr.Name)[0]
+	return strings.EqualFold(owner, h.hash(nsec3, name))
+}
+
+// covering returns the NSEC3 record whose hash interval contains the hash of
+// name, nil if there is none
+func (h hashes) covering(nsec3s []*dns.NSEC3, name string) *dns.NSEC3 {
+	for _, nsec3 := range nsec3s {
+		hash := h.hash(nsec3, name)
+		owner := strings.ToUpper(dns.SplitDomainName(nsec3.Hdr.Name)[0])
+		next := strings.ToUpper(nsec3.NextDomain)
+		switch c := strings.Compare(owner, next); {
+		case c < 0 && owner < hash && hash < next:
+			return nsec3
+		// The last record of the zone wraps around
+		case c >= 0 && (owner < hash || hash < next):
+			return nsec3
+		}
+	}
+	return nil
+}
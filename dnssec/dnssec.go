@@ -0,0 +1,567 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+// Package dnssec validates DNS responses. It builds the chain of trust from
+// the root trust anchors down to the zone of the answer, fetching the
+// DNSKEY and DS records it needs through the upstream nameservers.
+package dnssec
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// Result is the security status of a response (RFC 4035 section 4.3)
+type Result int
+
+const (
+	// Insecure responses are not signed because a zone on the way is not
+	Insecure Result = iota
+	// Secure responses are signed along the whole chain of trust
+	Secure
+	// Bogus responses should be signed but fail validation
+	Bogus
+	// Indeterminate responses could not be validated, e.g. because the keys
+	// could not be fetched
+	Indeterminate
+)
+
+func (r Result) String() string {
+	switch r {
+	case Insecure:
+		return "insecure"
+	case Secure:
+		return "secure"
+	case Bogus:
+		return "bogus"
+	}
+	return "indeterminate"
+}
+
+// Exchanger resolves the DNSKEY and DS records needed to validate a
+// response. It must request DNSSEC records and disable checking.
+type Exchanger func(name string, qtype uint16) (*dns.Msg, error)
+
+const (
+	// Validated keys and delegations are cached at most this long
+	maxCacheTtl = time.Hour
+	// Failed validations are cached this long
+	badCacheTtl = time.Minute
+)
+
+// Validator validates responses and caches the keys and delegations it
+// validated on the way.
+type Validator struct {
+	anchors  *Anchors
+	exchange Exchanger
+	now      func() time.Time
+
+	mutex sync.Mutex
+	keys  map[string]*keyEntry
+	cuts  map[string]*cutEntry
+}
+
+type keyEntry struct {
+	keys    []*dns.DNSKEY
+	result  Result
+	expires time.Time
+}
+
+// cut is what the DS records of a name say about it
+type cut int
+
+const (
+	notCut cut = iota
+	secureCut
+	insecureCut
+	bogusCut
+	// the DS records could not be fetched
+	indeterminateCut
+)
+
+type cutEntry struct {
+	cut     cut
+	expires time.Time
+}
+
+// New returns a validator trusting the anchors that resolves the records it
+// needs with exchange.
+func New(anchors *Anchors, exchange Exchanger) *Validator {
+	return &Validator{
+		anchors:  anchors,
+		exchange: exchange,
+		now:      time.Now,
+		keys:     make(map[string]*keyEntry),
+		cuts:     make(map[string]*cutEntry),
+	}
+}
+
+// Validate returns the security status of a response. The response must
+// have been requested with the DO bit set.
+func (v *Validator) Validate(m *dns.Msg) Result {
+	if len(m.Question) == 0 || m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return Insecure
+	}
+	q := m.Question[0]
+
+	result := Secure
+	merge := func(r Result) {
+		switch {
+		case result == Bogus || result == Indeterminate:
+		case r == Bogus || r == Indeterminate, r == Insecure:
+			result = r
+		}
+	}
+
+	// Follow the CNAME chain to the name the final answer is about
+	name := strings.ToLower(q.Name)
+	answered := false
+	for _, set := range rrsets(m.Answer) {
+		if set.rrtype == dns.TypeCNAME && synthesized(set, m.Answer) {
+			// CNAMEs synthesized from a DNAME are not signed
+			name = strings.ToLower(set.rrs[0].(*dns.CNAME).Target)
+			continue
+		}
+		r, wildcard := v.verifyRRset(set, m.Answer)
+		if r == Secure && wildcard != "" && !provesNoName(set.name, wildcard, m.Ns) {
+			log.Debugf("DNSSEC: wildcard answer for %s without proof that the name does not exist", set.name)
+			r = Bogus
+		}
+		merge(r)
+		if set.name == name {
+			switch set.rrtype {
+			case q.Qtype:
+				answered = true
+			case dns.TypeCNAME:
+				if q.Qtype != dns.TypeCNAME {
+					name = strings.ToLower(set.rrs[0].(*dns.CNAME).Target)
+				}
+			case dns.TypeDNAME:
+				answered = true
+			}
+		}
+	}
+	if answered || q.Qtype == dns.TypeANY && len(m.Answer) > 0 {
+		return result
+	}
+
+	// Negative answers need signed proof that the name or type does not exist
+	zone := v.zoneOf(name)
+	if zone == Insecure || zone == Bogus || zone == Indeterminate {
+		merge(zone)
+		return result
+	}
+	for _, set := range rrsets(m.Ns) {
+		switch set.rrtype {
+		case dns.TypeSOA, dns.TypeNSEC, dns.TypeNSEC3:
+			r, _ := v.verifyRRset(set, m.Ns)
+			merge(r)
+		}
+	}
+	if result != Secure {
+		return result
+	}
+	if m.Rcode == dns.RcodeNameError {
+		if !provesNoName(name, "", m.Ns) {
+			log.Debugf("DNSSEC: NXDOMAIN for %s without proof", name)
+			return Bogus
+		}
+		return Secure
+	}
+	denied, _, optOut := provesNoType(name, q.Qtype, m.Ns)
+	switch {
+	case !denied || optOut && q.Qtype != dns.TypeDS:
+		log.Debugf("DNSSEC: NODATA for %s %s without proof", name, dns.TypeToString[q.Qtype])
+		return Bogus
+	case optOut:
+		// Opt-out leaves room for an insecure delegation
+		return Insecure
+	}
+	return Secure
+}
+
+// synthesized returns true if a DNAME in the answer section covers the
+// owner of a CNAME RRset
+func synthesized(set rrset, answer []dns.RR) bool {
+	for _, rr := range answer {
+		if dname, ok := rr.(*dns.DNAME); ok && set.name != strings.ToLower(dname.Hdr.Name) && dns.IsSubDomain(dname.Hdr.Name, set.name) {
+			return len(signatures(set, answer)) == 0
+		}
+	}
+	return false
+}
+
+type rrset struct {
+	name   string
+	rrtype uint16
+	rrs    []dns.RR
+}
+
+// rrsets groups the records of a section by owner and type, leaving out
+// signatures and the OPT record
+func rrsets(section []dns.RR) []rrset {
+	var sets []rrset
+	index := make(map[string]int)
+	for _, rr := range section {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeRRSIG || hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+		name := strings.ToLower(hdr.Name)
+		key := fmt.Sprintf("%s/%d", name, hdr.Rrtype)
+		if i, ok := index[key]; ok {
+			sets[i].rrs = append(sets[i].rrs, rr)
+			continue
+		}
+		index[key] = len(sets)
+		sets = append(sets, rrset{name: name, rrtype: hdr.Rrtype, rrs: []dns.RR{rr}})
+	}
+	return sets
+}
+
+// signatures returns the signatures in section covering the RRset
+func signatures(set rrset, section []dns.RR) []*dns.RRSIG {
+	var sigs []*dns.RRSIG
+	for _, rr := range section {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == set.rrtype && strings.EqualFold(sig.Hdr.Name, set.name) {
+			sigs = append(sigs, sig)
+		}
+	}
+	return sigs
+}
+
+// verifyRRset validates an RRset with the signatures found in section. For
+// answers synthesized from a wildcard it also returns the closest encloser
+// the wildcard belongs to.
+func (v *Validator) verifyRRset(set rrset, section []dns.RR) (Result, string) {
+	sigs := signatures(set, section)
+	if len(sigs) == 0 {
+		// Unsigned data is fine in insecure zones only
+		r := v.zoneOf(set.name)
+		if r == Secure {
+			log.Debugf("DNSSEC: missing signature for %s %s", set.name, dns.TypeToString[set.rrtype])
+			return Bogus, ""
+		}
+		return r, ""
+	}
+
+	signer := strings.ToLower(sigs[0].SignerName)
+	if !dns.IsSubDomain(signer, set.name) {
+		log.Debugf("DNSSEC: signer %s is not a parent of %s", signer, set.name)
+		return Bogus, ""
+	}
+	keys, r := v.zoneKeys(signer)
+	if r != Secure {
+		return r, ""
+	}
+	for _, sig := range sigs {
+		if !strings.EqualFold(sig.SignerName, signer) {
+			continue
+		}
+		if verify(sig, keys, set.rrs, v.now()) {
+			wildcard := ""
+			if labels := dns.CountLabel(set.name); int(sig.Labels) < labels && !strings.HasPrefix(set.name, "*.") {
+				wildcard = strings.Join(dns.SplitDomainName(set.name)[labels-int(sig.Labels):], ".") + "."
+			}
+			return Secure, wildcard
+		}
+	}
+	log.Debugf("DNSSEC: no valid signature for %s %s", set.name, dns.TypeToString[set.rrtype])
+	return Bogus, ""
+}
+
+// verify returns true if sig is a currently valid signature of rrset made
+// by one of keys
+func verify(sig *dns.RRSIG, keys []*dns.DNSKEY, rrset []dns.RR, now time.Time) bool {
+	if !sig.ValidityPeriod(now) {
+		return false
+	}
+	for _, key := range keys {
+		if key.Flags&dns.ZONE == 0 || key.Flags&dns.REVOKE != 0 && sig.TypeCovered != dns.TypeDNSKEY {
+			continue
+		}
+		if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+			continue
+		}
+		if sig.Verify(key, rrset) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// signs returns true if key made one of sigs over rrset
+func signs(key *dns.DNSKEY, sigs []*dns.RRSIG, rrset []dns.RR, now time.Time) bool {
+	for _, sig := range sigs {
+		if verify(sig, []*dns.DNSKEY{key}, rrset, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// zoneKeys returns the validated keys of a zone. Zones below an insecure
+// delegation are Insecure.
+func (v *Validator) zoneKeys(zone string) ([]*dns.DNSKEY, Result) {
+	now := v.now()
+	v.mutex.Lock()
+	if e, ok := v.keys[zone]; ok && now.Before(e.expires) {
+		v.mutex.Unlock()
+		return e.keys, e.result
+	}
+	v.mutex.Unlock()
+
+	keys, result, ttl := v.fetchKeys(zone)
+	if result == Indeterminate {
+		// asked again next time
+		return keys, result
+	}
+	if result != Secure {
+		ttl = badCacheTtl
+	}
+	v.mutex.Lock()
+	v.keys[zone] = &keyEntry{keys: keys, result: result, expires: now.Add(ttl)}
+	v.mutex.Unlock()
+	return keys, result
+}
+
+func (v *Validator) fetchKeys(zone string) ([]*dns.DNSKEY, Result, time.Duration) {
+	var ds []*dns.DS
+	if zone != "." {
+		var c cut
+		c, ds = v.delegation(zone)
+		switch c {
+		case insecureCut:
+			return nil, Insecure, maxCacheTtl
+		case secureCut:
+		case indeterminateCut:
+			return nil, Indeterminate, 0
+		default:
+			log.Debugf("DNSSEC: no secure delegation to %s", zone)
+			return nil, Bogus, 0
+		}
+	}
+
+	r, err := v.exchange(zone, dns.TypeDNSKEY)
+	if err != nil {
+		log.Debugf("DNSSEC: error fetching the keys of %s: %s", zone, err)
+		return nil, Indeterminate, 0
+	}
+	set := rrset{name: zone, rrtype: dns.TypeDNSKEY}
+	var keys []*dns.DNSKEY
+	for _, rr := range r.Answer {
+		if key, ok := rr.(*dns.DNSKEY); ok && strings.EqualFold(key.Hdr.Name, zone) {
+			keys = append(keys, key)
+			set.rrs = append(set.rrs, key)
+		}
+	}
+	sigs := signatures(set, r.Answer)
+
+	// The key set must be signed by a key that is a trust anchor or matches
+	// a DS record of the parent
+	var entry []*dns.DNSKEY
+	for _, key := range keys {
+		if zone == "." && v.anchors.trusted(key) || zone != "." && matchesDS(key, ds) {
+			entry = append(entry, key)
+		}
+	}
+	if len(entry) == 0 && zone != "." && !supported(ds) {
+		// Zones signed only with algorithms we cannot verify are insecure
+		return nil, Insecure, maxCacheTtl
+	}
+	now := v.now()
+	for _, sig := range sigs {
+		if verify(sig, entry, set.rrs, now) {
+			if zone == "." {
+				v.anchors.update(keys, sigs, now)
+			}
+			return keys, Secure, ttl(set.rrs, sig)
+		}
+	}
+	log.Debugf("DNSSEC: no valid signature over the keys of %s", zone)
+	return nil, Bogus, 0
+}
+
+// matchesDS returns true if the key matches one of the DS records
+func matchesDS(key *dns.DNSKEY, ds []*dns.DS) bool {
+	for _, d := range ds {
+		if d.KeyTag != key.KeyTag() || d.Algorithm != key.Algorithm {
+			continue
+		}
+		if k := key.ToDS(d.DigestType); k != nil && strings.EqualFold(k.Digest, d.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// supported returns true if any DS record uses an algorithm and digest
+// type that can be verified
+func supported(ds []*dns.DS) bool {
+	for _, d := range ds {
+		switch d.Algorithm {
+		case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512, dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+		default:
+			continue
+		}
+		switch d.DigestType {
+		case dns.SHA1, dns.SHA256, dns.SHA384:
+			return true
+		}
+	}
+	return false
+}
+
+// ttl returns how long a validated RRset may be cached
+func ttl(rrs []dns.RR, sig *dns.RRSIG) time.Duration {
+	t := time.Duration(sig.OrigTtl) * time.Second
+	for _, rr := range rrs {
+		if d := time.Duration(rr.Header().Ttl) * time.Second; d < t {
+			t = d
+		}
+	}
+	if t > maxCacheTtl {
+		t = maxCacheTtl
+	}
+	return t
+}
+
+// delegation looks up the DS records of name and tells whether name is the
+// apex of a secure zone, an insecure zone or not a zone at all.
+func (v *Validator) delegation(name string) (cut, []*dns.DS) {
+	r, err := v.exchange(name, dns.TypeDS)
+	if err != nil {
+		log.Debugf("DNSSEC: error fetching the DS records of %s: %s", name, err)
+		return indeterminateCut, nil
+	}
+	if r.Rcode == dns.RcodeServerFailure || r.Rcode == dns.RcodeRefused {
+		log.Debugf("DNSSEC: %s fetching the DS records of %s", dns.RcodeToString[r.Rcode], name)
+		return indeterminateCut, nil
+	}
+
+	set := rrset{name: name, rrtype: dns.TypeDS}
+	var ds []*dns.DS
+	for _, rr := range r.Answer {
+		if d, ok := rr.(*dns.DS); ok && strings.EqualFold(d.Hdr.Name, name) {
+			ds = append(ds, d)
+			set.rrs = append(set.rrs, d)
+		}
+	}
+	// The records must be signed by the parent, unsigned records are only
+	// fine below an insecure delegation
+	verifyParent := func(set rrset, section []dns.RR) Result {
+		sigs := signatures(set, section)
+		if len(sigs) == 0 || strings.EqualFold(sigs[0].SignerName, name) {
+			if v.zoneOf(parent(name)) == Insecure {
+				return Insecure
+			}
+			return Bogus
+		}
+		result, _ := v.verifyRRset(set, section)
+		return result
+	}
+
+	if len(ds) > 0 {
+		switch verifyParent(set, r.Answer) {
+		case Secure:
+			return secureCut, ds
+		case Insecure:
+			return insecureCut, nil
+		case Indeterminate:
+			return indeterminateCut, nil
+		}
+		log.Debugf("DNSSEC: invalid DS records for %s", name)
+		return bogusCut, nil
+	}
+
+	// No DS records, the parent must prove it
+	if r.Rcode == dns.RcodeNameError {
+		return notCut, nil
+	}
+	proof := false
+	for _, set := range rrsets(r.Ns) {
+		if set.rrtype != dns.TypeNSEC && set.rrtype != dns.TypeNSEC3 {
+			continue
+		}
+		switch verifyParent(set, r.Ns) {
+		case Secure:
+			proof = true
+		case Insecure:
+			return insecureCut, nil
+		case Indeterminate:
+			return indeterminateCut, nil
+		default:
+			return bogusCut, nil
+		}
+	}
+	denied, delegation, optOut := provesNoType(name, dns.TypeDS, r.Ns)
+	switch {
+	case !proof || !denied:
+		if v.zoneOf(parent(name)) == Insecure {
+			return insecureCut, nil
+		}
+		log.Debugf("DNSSEC: no proof for the missing DS records of %s", name)
+		return bogusCut, nil
+	case delegation || optOut:
+		return insecureCut, nil
+	}
+	return notCut, nil
+}
+
+// zoneOf returns whether name belongs to a signed zone (Secure), a zone
+// below an insecure delegation (Insecure), or if that cannot be proven.
+func (v *Validator) zoneOf(name string) Result {
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		c := v.cut(strings.Join(labels[i:], ".") + ".")
+		switch c {
+		case insecureCut:
+			return Insecure
+		case bogusCut:
+			return Bogus
+		case indeterminateCut:
+			return Indeterminate
+		}
+	}
+	return Secure
+}
+
+// cut returns the cached delegation status of name
+func (v *Validator) cut(name string) cut {
+	now := v.now()
+	v.mutex.Lock()
+	if e, ok := v.cuts[name]; ok && now.Before(e.expires) {
+		v.mutex.Unlock()
+		return e.cut
+	}
+	v.mutex.Unlock()
+
+	c, _ := v.delegation(name)
+	if c == indeterminateCut {
+		// asked again next time
+		return c
+	}
+	expires := now.Add(maxCacheTtl)
+	if c == bogusCut {
+		expires = now.Add(badCacheTtl)
+	}
+	v.mutex.Lock()
+	v.cuts[name] = &cutEntry{cut: c, expires: expires}
+	v.mutex.Unlock()
+	return c
+}
+
+func parent(name string) string {
+	if i, end := dns.NextLabel(name, 0); !end {
+		return name[i:]
+	}
+	return "."
+}
@@ -0,0 +1,376 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package dnssec
+
+import (
+	"crypto"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type testZone struct {
+	name string
+	ksk  *dns.DNSKEY
+	zsk  *dns.DNSKEY
+	keys map[*dns.DNSKEY]crypto.Signer
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+	z := &testZone{name: name, keys: make(map[*dns.DNSKEY]crypto.Signer)}
+	z.ksk = z.newKey(t, dns.ZONE|dns.SEP)
+	z.zsk = z.newKey(t, dns.ZONE)
+	return z
+}
+
+func (z *testZone) newKey(t *testing.T, flags uint16) *dns.DNSKEY {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: z.name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z.keys[key] = priv.(crypto.Signer)
+	return key
+}
+
+func (z *testZone) sign(t *testing.T, key *dns.DNSKEY, rrs ...dns.RR) []dns.RR {
+	hdr := rrs[0].Header()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: hdr.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: hdr.Ttl},
+		KeyTag:     key.KeyTag(),
+		SignerName: z.name,
+		Algorithm:  key.Algorithm,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := sig.Sign(z.keys[key], rrs); err != nil {
+		t.Fatal(err)
+	}
+	return append(rrs, sig)
+}
+
+func (z *testZone) dnskeys(t *testing.T) []dns.RR {
+	return z.sign(t, z.ksk, z.ksk, z.zsk)
+}
+
+func rr(t *testing.T, s string) dns.RR {
+	r, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// testTree is a signed root with a secure zone example., a zone bogus. whose
+// DS does not match its keys and an insecure delegation to insecure.
+type testTree struct {
+	root, example, bogus *testZone
+	exchange             Exchanger
+	queries              int
+}
+
+func newTestTree(t *testing.T) *testTree {
+	tr := &testTree{
+		root:    newTestZone(t, "."),
+		example: newTestZone(t, "example."),
+		bogus:   newTestZone(t, "bogus."),
+	}
+	other := newTestZone(t, "bogus.")
+
+	answers := map[string]*dns.Msg{}
+	add := func(name string, qtype uint16, rcode int, answer, ns []dns.RR) {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		m.Rcode = rcode
+		m.Answer, m.Ns = answer, ns
+		answers[fmt.Sprintf("%s/%d", name, qtype)] = m
+	}
+	r, ex := tr.root, tr.example
+
+	add(".", dns.TypeDNSKEY, 0, r.dnskeys(t), nil)
+	add("example.", dns.TypeDNSKEY, 0, ex.dnskeys(t), nil)
+	add("bogus.", dns.TypeDNSKEY, 0, tr.bogus.dnskeys(t), nil)
+
+	ds := ex.ksk.ToDS(dns.SHA256)
+	ds.Hdr.Ttl = 3600
+	add("example.", dns.TypeDS, 0, r.sign(t, r.zsk, ds), nil)
+	bogusDS := other.ksk.ToDS(dns.SHA256)
+	bogusDS.Hdr.Name = "bogus."
+	bogusDS.Hdr.Ttl = 3600
+	add("bogus.", dns.TypeDS, 0, r.sign(t, r.zsk, bogusDS), nil)
+	add("insecure.", dns.TypeDS, 0, nil, r.sign(t, r.zsk, rr(t, "insecure. 3600 IN NSEC zzz. NS RRSIG NSEC")))
+	add("www.example.", dns.TypeDS, 0, nil, ex.sign(t, ex.zsk, rr(t, "www.example. 3600 IN NSEC example. A RRSIG NSEC")))
+	add("www.insecure.", dns.TypeDS, 0, nil, nil)
+
+	tr.exchange = func(name string, qtype uint16) (*dns.Msg, error) {
+		tr.queries++
+		if m, ok := answers[fmt.Sprintf("%s/%d", name, qtype)]; ok {
+			return m.Copy(), nil
+		}
+		if qtype == dns.TypeDS {
+			m := new(dns.Msg)
+			m.SetQuestion(name, qtype)
+			m.Rcode = dns.RcodeNameError
+			return m, nil
+		}
+		return nil, fmt.Errorf("no answer for %s %s", name, dns.TypeToString[qtype])
+	}
+	return tr
+}
+
+func (tr *testTree) validator() *Validator {
+	return New(&Anchors{ds: []*dns.DS{tr.root.ksk.ToDS(dns.SHA256)}}, tr.exchange)
+}
+
+func response(name string, qtype uint16, rcode int, answer, ns []dns.RR) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.Response = true
+	m.Rcode = rcode
+	m.Answer, m.Ns = answer, ns
+	return m
+}
+
+func TestValidate(t *testing.T) {
+	tr := newTestTree(t)
+	ex := tr.example
+
+	a := rr(t, "www.example. 300 IN A 192.0.2.1")
+	signed := ex.sign(t, ex.zsk, a)
+	tampered := ex.sign(t, ex.zsk, rr(t, "www.example. 300 IN A 192.0.2.1"))
+	tampered[0].(*dns.A).A[3] = 2
+	cname := ex.sign(t, ex.zsk, rr(t, "alias.example. 300 IN CNAME www.example."))
+	soa := ex.sign(t, ex.zsk, rr(t, "example. 300 IN SOA ns.example. hostmaster.example. 1 3600 600 86400 300"))
+	nxdomain := append(append(soa, ex.sign(t, ex.zsk, rr(t, "example. 300 IN NSEC www.example. NS SOA RRSIG NSEC DNSKEY"))...),
+		ex.sign(t, ex.zsk, rr(t, "www.example. 300 IN NSEC example. A RRSIG NSEC"))...)
+	wildcard := ex.sign(t, ex.zsk, rr(t, "*.example. 300 IN A 192.0.2.9"))
+	wildcard[0].Header().Name = "any.example."
+	wildcard[1].Header().Name = "any.example."
+
+	tests := []struct {
+		name   string
+		m      *dns.Msg
+		result Result
+	}{
+		{"signed answer", response("www.example.", dns.TypeA, dns.RcodeSuccess, signed, nil), Secure},
+		{"tampered answer", response("www.example.", dns.TypeA, dns.RcodeSuccess, tampered, nil), Bogus},
+		{"unsigned answer", response("www.example.", dns.TypeA, dns.RcodeSuccess, []dns.RR{a}, nil), Bogus},
+		{"signed CNAME chain", response("alias.example.", dns.TypeA, dns.RcodeSuccess, append(cname, signed...), nil), Secure},
+		{"NXDOMAIN with proof", response("nope.example.", dns.TypeA, dns.RcodeNameError, nil, nxdomain), Secure},
+		{"NXDOMAIN without proof", response("nope.example.", dns.TypeA, dns.RcodeNameError, nil, soa), Bogus},
+		{"NODATA with proof", response("www.example.", dns.TypeMX, dns.RcodeSuccess, nil, nxdomain), Secure},
+		{"NODATA for an existing type", response("www.example.", dns.TypeA, dns.RcodeSuccess, nil, nxdomain), Bogus},
+		{"wildcard with proof", response("any.example.", dns.TypeA, dns.RcodeSuccess, wildcard, nxdomain), Secure},
+		{"wildcard without proof", response("any.example.", dns.TypeA, dns.RcodeSuccess, wildcard, nil), Bogus},
+		{"insecure delegation", response("www.insecure.", dns.TypeA, dns.RcodeSuccess, []dns.RR{rr(t, "www.insecure. 300 IN A 192.0.2.7")}, nil), Insecure},
+		{"DS not matching the keys", response("www.bogus.", dns.TypeA, dns.RcodeSuccess, tr.bogus.sign(t, tr.bogus.zsk, rr(t, "www.bogus. 300 IN A 192.0.2.8")), nil), Bogus},
+		{"SERVFAIL", response("www.example.", dns.TypeA, dns.RcodeServerFailure, nil, nil), Insecure},
+	}
+	v := tr.validator()
+	for _, tc := range tests {
+		if result := v.Validate(tc.m); result != tc.result {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.result, result)
+		}
+	}
+
+	// keys and delegations are cached
+	queries := tr.queries
+	v.Validate(response("www.example.", dns.TypeA, dns.RcodeSuccess, signed, nil))
+	if tr.queries != queries {
+		t.Errorf("expected cached keys, got %d more queries", tr.queries-queries)
+	}
+}
+
+func TestValidateUntrustedRoot(t *testing.T) {
+	tr := newTestTree(t)
+	other := newTestZone(t, ".")
+	v := New(&Anchors{ds: []*dns.DS{other.ksk.ToDS(dns.SHA256)}}, tr.exchange)
+	m := response("www.example.", dns.TypeA, dns.RcodeSuccess, tr.example.sign(t, tr.example.zsk, rr(t, "www.example. 300 IN A 192.0.2.1")), nil)
+	if result := v.Validate(m); result != Bogus {
+		t.Errorf("expected bogus with an untrusted root key, got %s", result)
+	}
+}
+
+func TestValidateDeadUpstream(t *testing.T) {
+	tr := newTestTree(t)
+	m := response("www.example.", dns.TypeA, dns.RcodeSuccess, tr.example.sign(t, tr.example.zsk, rr(t, "www.example. 300 IN A 192.0.2.1")), nil)
+
+	var dsRcode int
+	dead := true
+	exchange := tr.exchange
+	v := New(&Anchors{ds: []*dns.DS{tr.root.ksk.ToDS(dns.SHA256)}}, func(name string, qtype uint16) (*dns.Msg, error) {
+		switch {
+		case qtype != dns.TypeDS || !dead:
+			return exchange(name, qtype)
+		case dsRcode != dns.RcodeSuccess:
+			r := new(dns.Msg)
+			r.SetQuestion(name, qtype)
+			r.Rcode = dsRcode
+			return r, nil
+		}
+		return nil, fmt.Errorf("read udp: i/o timeout")
+	})
+
+	for _, rcode := range []int{dns.RcodeSuccess, dns.RcodeServerFailure, dns.RcodeRefused} {
+		dsRcode = rcode
+		if result := v.Validate(m); result != Indeterminate {
+			t.Errorf("%s: expected indeterminate without the DS records, got %s", dns.RcodeToString[rcode], result)
+		}
+	}
+
+	// the failure is not cached
+	dead = false
+	if result := v.Validate(m); result != Secure {
+		t.Errorf("expected secure once the DS records are available, got %s", result)
+	}
+}
+
+func TestAnchorRollover(t *testing.T) {
+	root := newTestZone(t, ".")
+	a := &Anchors{ds: []*dns.DS{root.ksk.ToDS(dns.SHA256)}}
+	now := time.Now()
+
+	next := root.newKey(t, dns.ZONE|dns.SEP)
+	keys := []*dns.DNSKEY{root.ksk, root.zsk, next}
+	a.update(keys, nil, now)
+	if !a.trusted(root.ksk) {
+		t.Fatal("expected the key matching the DS anchor to be trusted")
+	}
+	if a.trusted(next) {
+		t.Fatal("expected a new key to be trusted only after the hold-down time")
+	}
+	a.update(keys, nil, now.Add(holdDown))
+	if !a.trusted(next) {
+		t.Fatal("expected the new key to be trusted after the hold-down time")
+	}
+
+	// the old key is revoked by signing the key set with the revoke flag set
+	revoked := *root.ksk
+	revoked.Flags |= dns.REVOKE
+	root.keys[&revoked] = root.keys[root.ksk]
+	rrset := []dns.RR{&revoked, root.zsk, next}
+	signed := root.sign(t, &revoked, rrset...)
+	a.update([]*dns.DNSKEY{&revoked, root.zsk, next}, []*dns.RRSIG{signed[len(signed)-1].(*dns.RRSIG)}, now)
+	if a.trusted(root.ksk) {
+		t.Fatal("expected the revoked key not to be trusted")
+	}
+	if !a.trusted(next) {
+		t.Fatal("expected the new key to stay trusted")
+	}
+
+	// a pending key that disappears is forgotten
+	pending := root.newKey(t, dns.ZONE|dns.SEP)
+	a.update([]*dns.DNSKEY{root.zsk, next, pending}, nil, now)
+	a.update([]*dns.DNSKEY{root.zsk, next}, nil, now.Add(holdDown))
+	a.update([]*dns.DNSKEY{root.zsk, next, pending}, nil, now.Add(holdDown))
+	if a.trusted(pending) {
+		t.Fatal("expected the hold-down time to restart for a key that disappeared")
+	}
+}
+
+func TestLoadAnchors(t *testing.T) {
+	path := t.TempDir() + "/anchors.json"
+	a, err := LoadAnchors(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.ds) != len(rootAnchors) {
+		t.Fatalf("expected the built-in root anchors, got %v", a.ds)
+	}
+
+	root := newTestZone(t, ".")
+	a.ds = []*dns.DS{root.ksk.ToDS(dns.SHA256)}
+	a.update([]*dns.DNSKEY{root.ksk, root.zsk}, nil, time.Now())
+
+	loaded, err := LoadAnchors(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.keys) != 1 || loaded.keys[0].State != stateValid || !loaded.trusted(root.ksk) {
+		t.Errorf("expected the saved root key to be trusted, got %v", loaded.keys)
+	}
+}
+
+func TestDeny(t *testing.T) {
+	var nsecs []dns.RR
+	for _, s := range []string{
+		"example. 300 IN NSEC a.example. NS SOA RRSIG NSEC DNSKEY",
+		"a.example. 300 IN NSEC sub.example. A RRSIG NSEC",
+		"sub.example. 300 IN NSEC *.w.example. NS RRSIG NSEC",
+		"*.w.example. 300 IN NSEC x.example. TXT RRSIG NSEC",
+		"x.example. 300 IN NSEC example. MX RRSIG NSEC",
+	} {
+		nsecs = append(nsecs, rr(t, s))
+	}
+
+	// NSEC3 records for the names example., a.example. and x.example.
+	// with the hash intervals between them
+	var nsec3s []dns.RR
+	names := []string{"example.", "a.example.", "x.example."}
+	types := map[string]string{"example.": "NS SOA RRSIG DNSKEY NSEC3PARAM", "a.example.": "A RRSIG", "x.example.": "MX RRSIG"}
+	hashed := map[string]string{}
+	var sorted []string
+	for _, name := range names {
+		h := dns.HashName(name, dns.SHA1, 0, "")
+		hashed[h] = name
+		sorted = append(sorted, h)
+	}
+	slices.Sort(sorted)
+	for i, h := range sorted {
+		next := sorted[(i+1)%len(sorted)]
+		nsec3s = append(nsec3s, rr(t, fmt.Sprintf("%s.example. 300 IN NSEC3 1 0 0 - %s %s", h, next, types[hashed[h]])))
+	}
+	var optOut []dns.RR
+	for _, r := range nsec3s {
+		o := dns.Copy(r).(*dns.NSEC3)
+		o.Flags = 1
+		optOut = append(optOut, o)
+	}
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		records []dns.RR
+		rcode   int
+		proof   int // number of proving records, 0 for none, -1 for any
+	}{
+		{"b.example.", dns.TypeA, nsecs, dns.RcodeNameError, 2},
+		{"a.example.", dns.TypeAAAA, nsecs, dns.RcodeSuccess, 1},
+		{"a.example.", dns.TypeA, nsecs, 0, 0},
+		{"a.example.", dns.TypeCNAME, nsecs, dns.RcodeSuccess, 1},
+		{"y.example.", dns.TypeA, nsecs, dns.RcodeNameError, 2},
+		{"b.w.example.", dns.TypeA, nsecs, dns.RcodeSuccess, 1},
+		{"b.w.example.", dns.TypeTXT, nsecs, 0, 0},
+		{"b.sub.example.", dns.TypeA, nsecs, 0, 0},
+		{"sub.example.", dns.TypeDS, nsecs, dns.RcodeSuccess, 1},
+		{"sub.example.", dns.TypeA, nsecs, 0, 0},
+		{"x.example.", dns.TypeA, nsec3s, dns.RcodeSuccess, 1},
+		{"x.example.", dns.TypeMX, nsec3s, 0, 0},
+		{"b.example.", dns.TypeA, nsec3s, dns.RcodeNameError, -1},
+		{"b.x.example.", dns.TypeA, nsec3s, dns.RcodeNameError, -1},
+		{"b.example.", dns.TypeA, optOut, 0, 0},
+		{"b.example.", dns.TypeA, nsec3s[:1], 0, 0},
+	}
+	for _, tc := range tests {
+		proof, rcode := Deny(tc.name, tc.qtype, tc.records)
+		if tc.proof < 0 && len(proof) > 0 {
+			tc.proof = len(proof)
+		}
+		if len(proof) != tc.proof || tc.proof != 0 && rcode != tc.rcode {
+			t.Errorf("%s %s: expected %s with %d records, got %s with %v", tc.name, dns.TypeToString[tc.qtype],
+				dns.RcodeToString[tc.rcode], tc.proof, dns.RcodeToString[rcode], proof)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+// Package docker provides address lookups for containers managed by a local
+// Docker daemon. Records are kept up to date by following the events stream
+// of the Docker Engine API.
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	composeServiceLabel = "com.docker.compose.service"
+	composeProjectLabel = "com.docker.compose.project"
+
+	requestTimeout = 10 * time.Second
+	maxRetryDelay  = 30 * time.Second
+)
+
+// Config stores options for the Docker provider
+type Config struct {
+	// Path to the unix socket of the Docker daemon
+	Socket string
+	// Domain the container names are qualified with, e.g. 'docker'
+	Domain string
+}
+
+type container struct {
+	names []string // fully qualified, lower case
+	ips   []net.IP
+}
+
+// Provider serves records for running containers
+type Provider struct {
+	config     *Config
+	client     *http.Client
+	domain     string
+	containers map[string]*container // by container ID
+	mutex      sync.RWMutex
+}
+
+// apiContainer is the subset of a container inspect response we need
+type apiContainer struct {
+	ID     string `json:"Id"`
+	Name   string `json:"Name"`
+	Config struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"Config"`
+	State struct {
+		Running bool `json:"Running"`
+	} `json:"State"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress         string `json:"IPAddress"`
+			GlobalIPv6Address string `json:"GlobalIPv6Address"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+type apiEvent struct {
+	Type   string `json:"Type"`
+	Action string `json:"Action"`
+	Actor  struct {
+		ID         string            `json:"ID"`
+		Attributes map[string]string `json:"Attributes"`
+	} `json:"Actor"`
+}
+
+// New returns a Provider holding the records of the running containers and
+// starts following the Docker events stream.
+func New(config *Config) (*Provider, error) {
+	socket := config.Socket
+	p := &Provider{
+		config:     config,
+		domain:     dns.Fqdn(strings.ToLower(strings.TrimLeft(config.Domain, "."))),
+		containers: make(map[string]*container),
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+
+	if err := p.sync(); err != nil {
+		return nil, err
+	}
+
+	go p.watchEvents()
+
+	return p, nil
+}
+
+func (p *Provider) FindHosts(name string) (addrs []net.IP, err error) {
+	name = dns.Fqdn(strings.ToLower(name))
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	for _, c := range p.containers {
+		for _, n := range c.names {
+			if n == name {
+				addrs = append(addrs, c.ips...)
+				break
+			}
+		}
+	}
+	return
+}
+
+// HasSubdomains reports whether there are containers below name
+func (p *Provider) HasSubdomains(name string) bool {
+	suffix := "." + dns.Fqdn(strings.ToLower(name))
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	for _, c := range p.containers {
+		for _, n := range c.names {
+			if strings.HasSuffix(n, suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *Provider) FindReverse(name string) (host string, err error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	for _, c := range p.containers {
+		for _, ip := range c.ips {
+			if r, _ := dns.ReverseAddr(ip.String()); name == r && len(c.names) > 0 {
+				return c.names[0], nil
+			}
+		}
+	}
+	return
+}
+
+// sync replaces all records with those of the currently running containers
+func (p *Provider) sync() error {
+	var list []struct {
+		ID string `json:"Id"`
+	}
+	if err := p.get("/containers/json", &list); err != nil {
+		return fmt.Errorf("Error listing containers: %s", err)
+	}
+
+	containers := make(map[string]*container)
+	for _, item := range list {
+		c, err := p.inspect(item.ID)
+		if err != nil {
+			log.Warnf("Error inspecting container %s: %s", shortID(item.ID), err)
+			continue
+		}
+		if c != nil {
+			containers[item.ID] = c
+		}
+	}
+
+	p.mutex.Lock()
+	p.containers = containers
+	p.mutex.Unlock()
+
+	log.Debugf("Found %d running containers", len(containers))
+	return nil
+}
+
+// inspect returns the records of a container, or nil if it is not running
+func (p *Provider) inspect(id string) (*container, error) {
+	var ac apiContainer
+	if err := p.get("/containers/"+url.PathEscape(id)+"/json", &ac); err != nil {
+		return nil, err
+	}
+	if !ac.State.Running {
+		return nil, nil
+	}
+
+	c := new(container)
+	if name := strings.TrimPrefix(ac.Name, "/"); name != "" {
+		c.names = append(c.names, p.qualify(name))
+	}
+	service, project := ac.Config.Labels[composeServiceLabel], ac.Config.Labels[composeProjectLabel]
+	if service != "" && project != "" {
+		c.names = append(c.names, p.qualify(service+"."+project))
+	}
+	for _, network := range ac.NetworkSettings.Networks {
+		for _, addr := range []string{network.IPAddress, network.GlobalIPv6Address} {
+			if ip := net.ParseIP(addr); ip != nil {
+				c.ips = append(c.ips, ip)
+			}
+		}
+	}
+
+	for _, name := range c.names {
+		if _, ok := dns.IsDomainName(name); !ok {
+			return nil, fmt.Errorf("Invalid name %q", name)
+		}
+		log.Debugf("Container %s: %s -> %v", shortID(id), name, c.ips)
+	}
+	return c, nil
+}
+
+func (p *Provider) update(id string) {
+	c, err := p.inspect(id)
+	if err != nil {
+		log.Warnf("Error inspecting container %s: %s", shortID(id), err)
+		return
+	}
+
+	p.mutex.Lock()
+	if c == nil {
+		delete(p.containers, id)
+	} else {
+		p.containers[id] = c
+	}
+	p.mutex.Unlock()
+}
+
+func (p *Provider) remove(id string) {
+	p.mutex.Lock()
+	delete(p.containers, id)
+	p.mutex.Unlock()
+	log.Debugf("Removed records of container %s", shortID(id))
+}
+
+// watchEvents follows the events stream, reconnecting with a growing delay
+// if the connection to the daemon is lost. After each reconnect the records
+// are resynchronised as events may have been missed.
+func (p *Provider) watchEvents() {
+	delay := time.Second
+	for {
+		connected, err := p.followEvents()
+		if connected {
+			delay = time.Second
+		}
+		log.Warnf("Docker events stream interrupted: %v. Reconnecting in %s", err, delay)
+		time.Sleep(delay)
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+func (p *Provider) followEvents() (bool, error) {
+	filters := `{"type":["container","network"]}`
+	resp, err := p.client.Get("http://docker/events?filters=" + url.QueryEscape(filters))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	if err := p.sync(); err != nil {
+		return true, err
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev apiEvent
+		if err := dec.Decode(&ev); err != nil {
+			return true, err
+		}
+		p.handleEvent(&ev)
+	}
+}
+
+func (p *Provider) handleEvent(ev *apiEvent) {
+	switch ev.Type {
+	case "container":
+		switch ev.Action {
+		case "start", "unpause", "rename":
+			p.update(ev.Actor.ID)
+		case "die", "destroy":
+			// kill is also sent for signals the container survives, and
+			// stop is always followed by die
+			p.remove(ev.Actor.ID)
+		}
+	case "network":
+		if id := ev.Actor.Attributes["container"]; id != "" && (ev.Action == "connect" || ev.Action == "disconnect") {
+			p.update(id)
+		}
+	}
+}
+
+func (p *Provider) get(path string, v interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://docker"+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s for %s", resp.Status, path)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (p *Provider) qualify(name string) string {
+	return dns.Fqdn(strings.ToLower(name)) + strings.TrimPrefix(p.domain, ".")
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
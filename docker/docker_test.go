@@ -0,0 +1,153 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDocker serves the subset of the Docker Engine API used by the provider
+type fakeDocker struct {
+	mutex      sync.Mutex
+	containers map[string]string // id -> inspect JSON
+	events     chan string
+}
+
+func newFakeDocker(t *testing.T) (*fakeDocker, string) {
+	f := &fakeDocker{containers: make(map[string]string), events: make(chan string, 10)}
+
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(f.serveHTTP))
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(func() {
+		close(f.events)
+		srv.Close()
+	})
+	return f, socket
+}
+
+func (f *fakeDocker) set(id, name, ip string, labels map[string]string) {
+	l, _ := json.Marshal(labels)
+	f.mutex.Lock()
+	f.containers[id] = fmt.Sprintf(`{"Id":%q,"Name":"/%s","Config":{"Labels":%s},"State":{"Running":true},
+		"NetworkSettings":{"Networks":{"bridge":{"IPAddress":%q,"GlobalIPv6Address":""}}}}`, id, name, l, ip)
+	f.mutex.Unlock()
+}
+
+func (f *fakeDocker) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	switch {
+	case r.URL.Path == "/containers/json":
+		var ids []string
+		for id := range f.containers {
+			ids = append(ids, fmt.Sprintf(`{"Id":%q}`, id))
+		}
+		fmt.Fprintf(w, "[%s]", strings.Join(ids, ","))
+	case strings.HasPrefix(r.URL.Path, "/containers/") && strings.HasSuffix(r.URL.Path, "/json"):
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/containers/"), "/json")
+		c, ok := f.containers[id]
+		if !ok {
+			http.Error(w, `{"message":"No such container"}`, http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, c)
+	case r.URL.Path == "/events":
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		f.mutex.Unlock()
+		defer f.mutex.Lock()
+		for ev := range f.events {
+			fmt.Fprintln(w, ev)
+			w.(http.Flusher).Flush()
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProvider(t *testing.T) {
+	f, socket := newFakeDocker(t)
+	f.set("aaaa", "web", "172.17.0.2", map[string]string{
+		composeServiceLabel: "web",
+		composeProjectLabel: "shop",
+	})
+
+	p, err := New(&Config{Socket: socket, Domain: "docker"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"web.docker.", "WEB.docker.", "web.shop.docker."} {
+		if ips, _ := p.FindHosts(name); len(ips) != 1 || !ips[0].Equal(net.ParseIP("172.17.0.2")) {
+			t.Errorf("expected 172.17.0.2 for %s, got %v", name, ips)
+		}
+	}
+	if !p.HasSubdomains("shop.docker.") || p.HasSubdomains("web.docker.") {
+		t.Error("expected names below shop.docker. only")
+	}
+	if host, _ := p.FindReverse("2.0.17.172.in-addr.arpa."); host != "web.docker." {
+		t.Errorf("expected reverse lookup to return web.docker., got %q", host)
+	}
+
+	// a second replica of the service is started
+	f.set("bbbb", "shop-web-2", "172.17.0.3", map[string]string{
+		composeServiceLabel: "web",
+		composeProjectLabel: "shop",
+	})
+	f.events <- `{"Type":"container","Action":"start","Actor":{"ID":"bbbb","Attributes":{"name":"shop-web-2"}}}`
+	waitFor(t, func() bool {
+		ips, _ := p.FindHosts("web.shop.docker.")
+		return len(ips) == 2
+	})
+	if ips, _ := p.FindHosts("shop-web-2.docker."); len(ips) != 1 {
+		t.Errorf("expected record for shop-web-2.docker., got %v", ips)
+	}
+
+	// the second one survives a signal, the first container stops
+	f.events <- `{"Type":"container","Action":"kill","Actor":{"ID":"bbbb","Attributes":{"name":"shop-web-2","signal":"1"}}}`
+	f.events <- `{"Type":"container","Action":"die","Actor":{"ID":"aaaa","Attributes":{"name":"web"}}}`
+	waitFor(t, func() bool {
+		ips, _ := p.FindHosts("web.docker.")
+		return len(ips) == 0
+	})
+	if ips, _ := p.FindHosts("web.shop.docker."); len(ips) != 1 || !ips[0].Equal(net.ParseIP("172.17.0.3")) {
+		t.Errorf("expected only 172.17.0.3 for web.shop.docker., got %v", ips)
+	}
+}
+
+func TestProviderUnavailable(t *testing.T) {
+	if _, err := New(&Config{Socket: filepath.Join(t.TempDir(), "missing.sock"), Domain: "docker"}); err == nil {
+		t.Fatal("expected error when the Docker daemon is unreachable")
+	}
+}
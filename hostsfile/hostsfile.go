@@ -74,6 +74,14 @@ func (h *Hostsfile) FindHosts(name string) (addrs []net.IP, err error) {
 	return
 }
 
+// HasSubdomains reports whether there are hosts below name
+func (h *Hostsfile) HasSubdomains(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	h.hostMutex.RLock()
+	defer h.hostMutex.RUnlock()
+	return h.hosts.HasSubdomains(name)
+}
+
 func (h *Hostsfile) FindReverse(name string) (host string, err error) {
 	h.hostMutex.RLock()
 	defer h.hostMutex.RUnlock()
@@ -3,6 +3,8 @@ package hosts
 import (
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -181,3 +183,52 @@ func TestHostname(t *testing.T) {
 		t.Errorf("Wildcard should be %t", wildcard)
 	}
 }
+
+func TestHasSubdomains(t *testing.T) {
+	hosts := newHostlistString("192.168.1.10 a.b.lan\n192.168.1.11 *.wild.lan")
+
+	for name, expected := range map[string]bool{"b.lan": true, "lan": true, "wild.lan": true, "a.b.lan": false, "c.lan": false, "b.la": false} {
+		if hosts.HasSubdomains(name) != expected {
+			t.Errorf("%s: expected subdomains %t", name, expected)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	data := `127.0.0.1 localhost
+# comment line
+
+fe80::1%lo0 localhost
+ff02::1 ip6-allnodes
+192.168.0.300 broken.domain
+10.0.0.1
+10.0.0.2 a bad..name
+10.0.0.2 a
+`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := Check(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Problem{
+		{Line: 4, Ignored: true},
+		{Line: 5, Ignored: true},
+		{Line: 6},
+		{Line: 7},
+		{Line: 8},
+		{Line: 9, Ignored: true},
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("expected %d problems, got %d: %v", len(expected), len(problems), problems)
+	}
+	for i, p := range problems {
+		if p.Line != expected[i].Line || p.Ignored != expected[i].Ignored {
+			t.Errorf("problem %d: expected line %d ignored=%t, got %+v", i, expected[i].Line, expected[i].Ignored, p)
+		}
+	}
+}
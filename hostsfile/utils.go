@@ -13,6 +13,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -91,6 +92,16 @@ func (h *hostlist) FindHosts(name string) (addrs []net.IP) {
 	return
 }
 
+// HasSubdomains reports whether a host, or a wildcard, is below name
+func (h *hostlist) HasSubdomains(name string) bool {
+	for _, hostname := range *h {
+		if hostname.wildcard && hostname.domain == name || strings.HasSuffix(hostname.domain, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
 func (h *hostlist) add(hostnamev *hostname) error {
 	hostname := newHostname(hostnamev.domain, hostnamev.ip, hostnamev.ipv6, hostnamev.wildcard)
 	for _, found := range *h {
@@ -114,15 +125,22 @@ func newHostname(domain string, ip net.IP, ipv6 bool, wildcard bool) (host *host
 //
 //	127.0.0.1 localhost mysite1 mysite2
 func parseLine(line string) hostlist {
+	hostnames, _ := checkLine(line)
+	return hostnames
+}
+
+// checkLine parses a line like parseLine and also returns the problems
+// that made it skip the line or some of its hostnames.
+func checkLine(line string) (hostlist, []Problem) {
 	var hostnames hostlist
 
 	if len(line) == 0 {
-		return hostnames
+		return hostnames, nil
 	}
 
 	// Parse leading # for disabled lines
 	if line[0:1] == "#" {
-		return hostnames
+		return hostnames, nil
 	}
 
 	// Parse other #s for actual comments
@@ -135,6 +153,9 @@ func parseLine(line string) hostlist {
 	}
 
 	line = strings.TrimSpace(line)
+	if line == "" {
+		return hostnames, nil
+	}
 
 	// Break line into words
 	words := strings.Split(line, " ")
@@ -147,7 +168,7 @@ func parseLine(line string) hostlist {
 	domains := words[1:]
 
 	if strings.Contains(address, "%") {
-		return hostnames
+		return hostnames, []Problem{{Message: fmt.Sprintf("Address with zone index ignored: %s", address), Ignored: true}}
 	}
 
 	ip := net.ParseIP(address)
@@ -155,31 +176,74 @@ func parseLine(line string) hostlist {
 	var isIPv6 bool
 
 	switch {
+	case ip == nil:
+		return hostnames, []Problem{{Message: fmt.Sprintf("Invalid IP address: %s", address)}}
 	case !ip.IsGlobalUnicast() && !ip.IsLoopback():
-		return hostnames
+		return hostnames, []Problem{{Message: fmt.Sprintf("Link-local, multicast or unspecified address ignored: %s", address), Ignored: true}}
 	case ip.Equal(net.ParseIP("fe00::")):
-		return hostnames
+		return hostnames, []Problem{{Message: fmt.Sprintf("Address ignored: %s", address), Ignored: true}}
 	case ip.To4() != nil:
 		isIPv6 = false
 	case ip.To16() != nil:
 		isIPv6 = true
-	default:
-		log.Warnf("Invalid IP address found in hostsfile: %s", address)
-		return hostnames
 	}
 
+	if len(domains) == 0 {
+		return hostnames, []Problem{{Message: fmt.Sprintf("No hostnames for address %s", address)}}
+	}
+
+	var problems []Problem
 	var isWildcard bool
 	for _, v := range domains {
 		isWildcard = false
-		if v[0:2] == "*." {
+		if strings.HasPrefix(v, "*.") {
 			v = v[2:]
 			isWildcard = true
 		}
+		if _, ok := dns.IsDomainName(v); !ok {
+			problems = append(problems, Problem{Message: fmt.Sprintf("Invalid hostname: %s", v)})
+		}
 		hostname := newHostname(v, ip, isIPv6, isWildcard)
 		hostnames = append(hostnames, hostname)
 	}
 
-	return hostnames
+	return hostnames, problems
+}
+
+// Problem describes an issue found in a line of a hosts file
+type Problem struct {
+	Line    int
+	Message string
+	// Ignored marks valid lines that are deliberately not served,
+	// e.g. link-local addresses
+	Ignored bool
+}
+
+// Check parses the hosts file at path and returns the problems found in it
+func Check(path string) ([]Problem, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []Problem
+	hosts := hostlist{}
+	for idx, line := range strings.Split(string(data), "\n") {
+		hostnames, lineProblems := checkLine(line)
+		for _, hostname := range hostnames {
+			if err := hosts.add(hostname); err != nil {
+				lineProblems = append(lineProblems, Problem{
+					Message: fmt.Sprintf("Duplicate entry for %s %s", hostname.ip, hostname.domain),
+					Ignored: true,
+				})
+			}
+		}
+		for _, p := range lineProblems {
+			p.Line = idx + 1
+			problems = append(problems, p)
+		}
+	}
+	return problems, nil
 }
 
 // hostsFileMetadata returns metadata about the hosts file.
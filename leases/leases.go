@@ -0,0 +1,242 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+// Package leases provides address lookups from DHCP lease files written by
+// dnsmasq (dnsmasq.leases) or the ISC DHCP server (dhcpd.leases).
+package leases
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// Config stores options for lease files
+type Config struct {
+	// Domain used to qualify single-label hostnames
+	Domain string
+	// Positive value enables polling
+	Poll    int
+	Verbose bool
+}
+
+type lease struct {
+	hostname string
+	ip       net.IP
+	expires  time.Time // zero for infinite leases
+	line     int
+}
+
+func (l *lease) expired(now time.Time) bool {
+	return !l.expires.IsZero() && !now.Before(l.expires)
+}
+
+// Leasefile represents a DHCP lease file
+type Leasefile struct {
+	config *Config
+	leases []*lease
+	file   struct {
+		size  int64
+		path  string
+		mtime time.Time
+	}
+	leaseMutex sync.RWMutex
+}
+
+// NewLeasefile returns a new Leasefile object
+func NewLeasefile(path string, config *Config) (*Leasefile, error) {
+	l := Leasefile{config: config}
+	l.file.path = path
+	// polling reloads the file once it changed after this
+	mtime, size, err := leasefileMetadata(path)
+	if err != nil {
+		return nil, err
+	}
+	l.file.mtime, l.file.size = mtime, size
+	if err := l.loadLeases(); err != nil {
+		return nil, err
+	}
+
+	if l.config.Poll > 0 {
+		go l.monitorLeases(l.config.Poll)
+	}
+
+	log.Debugf("Found leases in %s:", l.file.path)
+	for _, le := range l.leases {
+		log.Debugf("%s -> %s expires=%v", le.hostname, le.ip.String(), le.expires)
+	}
+
+	return &l, nil
+}
+
+func (l *Leasefile) FindHosts(name string) (addrs []net.IP, err error) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	now := time.Now()
+
+	l.leaseMutex.RLock()
+	defer l.leaseMutex.RUnlock()
+	for _, le := range l.leases {
+		if le.hostname == name && !le.expired(now) {
+			addrs = append(addrs, le.ip)
+		}
+	}
+	return
+}
+
+// HasSubdomains reports whether there are leases below name
+func (l *Leasefile) HasSubdomains(name string) bool {
+	suffix := "." + strings.TrimSuffix(strings.ToLower(name), ".")
+	now := time.Now()
+
+	l.leaseMutex.RLock()
+	defer l.leaseMutex.RUnlock()
+	for _, le := range l.leases {
+		if strings.HasSuffix(le.hostname, suffix) && !le.expired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Leasefile) FindReverse(name string) (host string, err error) {
+	now := time.Now()
+
+	l.leaseMutex.RLock()
+	defer l.leaseMutex.RUnlock()
+	for _, le := range l.leases {
+		if le.expired(now) {
+			continue
+		}
+		if r, _ := dns.ReverseAddr(le.ip.String()); name == r {
+			host = dns.Fqdn(le.hostname)
+			// prefer the qualified name
+			if strings.Contains(le.hostname, ".") {
+				break
+			}
+		}
+	}
+	return
+}
+
+func (l *Leasefile) loadLeases() error {
+	data, err := os.ReadFile(l.file.path)
+	if err != nil {
+		return err
+	}
+
+	parsed, problems := parse(string(data))
+	for _, p := range problems {
+		log.Warnf("Bad formatted lease file line %s:%d: %s", l.file.path, p.Line, p.Message)
+	}
+
+	leases := make([]*lease, 0, len(parsed))
+	for _, le := range parsed {
+		qualified, err := qualify(le, l.config.Domain)
+		if err != nil {
+			log.Warnf("Bad formatted lease file line %s:%d: %s", l.file.path, le.line, err)
+			continue
+		}
+		leases = append(leases, qualified...)
+	}
+
+	l.leaseMutex.Lock()
+	l.leases = leases
+	l.leaseMutex.Unlock()
+
+	return nil
+}
+
+// qualify returns the lease for the bare hostname and, if a domain is
+// configured and the hostname has a single label, for the qualified name
+func qualify(le *lease, domain string) ([]*lease, error) {
+	hostname := strings.TrimSuffix(strings.ToLower(le.hostname), ".")
+	if _, ok := dns.IsDomainName(hostname); !ok || hostname == "" {
+		return nil, fmt.Errorf("Invalid hostname: %q", le.hostname)
+	}
+
+	leases := []*lease{{hostname, le.ip, le.expires, le.line}}
+	if domain != "" && !strings.Contains(hostname, ".") {
+		fqdn := strings.TrimSuffix(appendDomain(hostname, domain), ".")
+		leases = append(leases, &lease{fqdn, le.ip, le.expires, le.line})
+	}
+	return leases, nil
+}
+
+// Check parses the lease file at path and returns the problems found in it
+func Check(path string) ([]Problem, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, problems := parse(string(data))
+	for _, le := range parsed {
+		if _, err := qualify(le, ""); err != nil {
+			problems = append(problems, Problem{le.line, err.Error()})
+		}
+	}
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Line < problems[j].Line })
+	return problems, nil
+}
+
+func parse(data string) ([]*lease, []Problem) {
+	if isISC(data) {
+		return parseISC(data)
+	}
+	return parseDnsmasq(data)
+}
+
+func (l *Leasefile) monitorLeases(poll int) {
+	lf := l.file
+
+	t := time.Duration(poll) * time.Second
+	ticker := time.NewTicker(t)
+
+	for range ticker.C {
+		mtime, size, err := leasefileMetadata(lf.path)
+		if err != nil {
+			log.Warnf("Error stating lease file: %s", err)
+			continue
+		}
+
+		if lf.mtime.Equal(mtime) && lf.size == size {
+			continue // no updates
+		}
+
+		if err := l.loadLeases(); err != nil {
+			log.Warnf("Error parsing lease file: %s", err)
+		}
+
+		log.Debugf("Reloaded updated lease file %s", lf.path)
+
+		l.leaseMutex.Lock()
+		l.file.mtime = mtime
+		l.file.size = size
+		lf = l.file
+		l.leaseMutex.Unlock()
+	}
+}
+
+func appendDomain(s1, s2 string) string {
+	return dns.Fqdn(s1) + dns.Fqdn(strings.TrimLeft(s2, "."))
+}
+
+// leasefileMetadata returns metadata about the lease file.
+func leasefileMetadata(path string) (time.Time, int64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+
+	return fi.ModTime(), fi.Size(), nil
+}
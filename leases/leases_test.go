@@ -0,0 +1,174 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package leases
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseDnsmasq(t *testing.T) {
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	data := future + ` 52:54:00:12:34:56 192.168.1.10 laptop 01:52:54:00:12:34:56
+0 52:54:00:12:34:57 192.168.1.11 printer *
+1000 52:54:00:12:34:58 192.168.1.12 old-host *
+43 52:54:00:12:34:59 192.168.1.13 * *
+duid 00:01:00:01:2c:4f:2b:2a:52:54:00:12:34:56
+` + future + ` 1234 2001:db8::10 laptop 00:01:00:01:2c:4f
+garbage line
+`
+	leases, problems := parseDnsmasq(data)
+	if len(problems) != 1 || problems[0].Line != 7 {
+		t.Errorf("expected a problem on line 7, got %v", problems)
+	}
+	if len(leases) != 4 {
+		t.Fatalf("expected 4 leases, got %d", len(leases))
+	}
+	if leases[0].hostname != "laptop" || !leases[0].ip.Equal(net.ParseIP("192.168.1.10")) || leases[0].expires.IsZero() {
+		t.Errorf("unexpected first lease: %+v", leases[0])
+	}
+	if !leases[1].expires.IsZero() {
+		t.Errorf("expected infinite lease for printer, got %v", leases[1].expires)
+	}
+	if !leases[2].expired(time.Now()) {
+		t.Error("expected old-host lease to be expired")
+	}
+	if !leases[3].ip.Equal(net.ParseIP("2001:db8::10")) {
+		t.Errorf("expected IPv6 lease, got %+v", leases[3])
+	}
+}
+
+func TestParseISC(t *testing.T) {
+	data := `# The format of this file is documented in the dhcpd.leases(5) manual page.
+authoring-byte-order little-endian;
+
+lease 192.168.1.10 {
+  starts 4 2024/01/04 10:00:00;
+  ends 4 2024/01/04 22:00:00;
+  binding state active;
+  next binding state free;
+  hardware ethernet 52:54:00:12:34:56;
+  client-hostname "laptop";
+}
+lease 192.168.1.10 {
+  starts 4 2024/01/04 12:00:00;
+  ends never;
+  binding state active;
+  client-hostname "laptop";
+}
+lease 192.168.1.11 {
+  ends epoch 1700000000; # Tue Nov 14 22:13:20 2023
+  binding state free;
+  client-hostname "gone";
+}
+lease 192.168.1.12 {
+  ends 6 2030/01/05 22:00:00;
+  binding state active;
+  uid "\001RT\000\0224V";
+}
+lease 192.168.1.13 {
+  ends 6 2030/01/05 22:00:00;
+  binding state active;
+  set vendor-class-identifier = "MSFT 5.0";
+  client-hostname "desktop";
+}
+`
+	if !isISC(data) {
+		t.Fatal("expected ISC format to be detected")
+	}
+	leases, problems := parseISC(data)
+	if len(problems) != 0 {
+		t.Errorf("expected no problems, got %v", problems)
+	}
+	if len(leases) != 2 {
+		t.Fatalf("expected 2 leases, got %d: %+v", len(leases), leases)
+	}
+	if leases[0].hostname != "laptop" || !leases[0].expires.IsZero() {
+		t.Errorf("expected later infinite lease for laptop, got %+v", leases[0])
+	}
+	want := time.Date(2030, 1, 5, 22, 0, 0, 0, time.UTC)
+	if leases[1].hostname != "desktop" || !leases[1].expires.Equal(want) {
+		t.Errorf("unexpected lease for desktop: %+v", leases[1])
+	}
+}
+
+func TestLeasefile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	data := "0 52:54:00:12:34:56 192.168.1.10 Laptop *\n1000 52:54:00:12:34:57 192.168.1.11 old *\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := NewLeasefile(path, &Config{Domain: "lan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"laptop.", "laptop.lan.", "LAPTOP.lan"} {
+		if ips, _ := l.FindHosts(name); len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.168.1.10")) {
+			t.Errorf("expected 192.168.1.10 for %s, got %v", name, ips)
+		}
+	}
+	if ips, _ := l.FindHosts("old.lan."); len(ips) != 0 {
+		t.Errorf("expected no address for expired lease, got %v", ips)
+	}
+	if host, _ := l.FindReverse("10.1.168.192.in-addr.arpa."); host != "laptop.lan." {
+		t.Errorf("expected reverse lookup to return laptop.lan., got %q", host)
+	}
+	if host, _ := l.FindReverse("11.1.168.192.in-addr.arpa."); host != "" {
+		t.Errorf("expected no reverse name for expired lease, got %q", host)
+	}
+	if !l.HasSubdomains("LAN.") || l.HasSubdomains("laptop.lan.") {
+		t.Error("expected leases below lan. only")
+	}
+
+	// the first poll must not reload the unchanged file
+	mtime, size, _ := leasefileMetadata(path)
+	if !l.file.mtime.Equal(mtime) || l.file.size != size {
+		t.Errorf("expected the metadata of the loaded file, got %v and %d", l.file.mtime, l.file.size)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dhcpd.leases")
+	data := `# comment
+lease 192.168.1.10 {
+  ends 4 2024/13/04 22:00:00;
+  binding state active;
+  client-hostname "laptop";
+}
+lease 192.168.1.300 {
+  binding state active;
+}
+lease 192.168.1.11 {
+  ends never;
+  binding state active;
+  client-hostname "bad..name";
+}
+`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := Check(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := []int{3, 7, 10}
+	if len(problems) != len(lines) {
+		t.Fatalf("expected %d problems, got %v", len(lines), problems)
+	}
+	for i, p := range problems {
+		if p.Line != lines[i] {
+			t.Errorf("expected problem on line %d, got %+v", lines[i], p)
+		}
+	}
+}
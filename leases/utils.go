@@ -0,0 +1,234 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package leases
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Problem describes an issue found in a line of a lease file
+type Problem struct {
+	Line    int
+	Message string
+}
+
+// isISC reports whether data looks like an ISC dhcpd.leases file. The
+// dnsmasq format has no braces.
+func isISC(data string) bool {
+	return strings.Contains(data, "{")
+}
+
+// parseDnsmasq parses a dnsmasq lease file. Each line holds the expiry time
+// (seconds since epoch, '0' for infinite), the MAC address or IAID, the IP
+// address, the hostname ('*' if unknown) and the client id, e.g.
+//
+//	1700000000 52:54:00:12:34:56 192.168.1.10 laptop 01:52:54:00:12:34:56
+//
+// DHCPv6 leases follow a line starting with 'duid'.
+func parseDnsmasq(data string) ([]*lease, []Problem) {
+	var leases []*lease
+	var problems []Problem
+	for idx, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] == "duid" {
+			continue
+		}
+		if len(fields) < 4 {
+			problems = append(problems, Problem{idx + 1, "Too few fields"})
+			continue
+		}
+
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			problems = append(problems, Problem{idx + 1, fmt.Sprintf("Invalid expiry time: %s", fields[0])})
+			continue
+		}
+		ip := net.ParseIP(fields[2])
+		if ip == nil {
+			problems = append(problems, Problem{idx + 1, fmt.Sprintf("Invalid IP address: %s", fields[2])})
+			continue
+		}
+		if fields[3] == "*" {
+			continue
+		}
+
+		le := &lease{hostname: fields[3], ip: ip, line: idx + 1}
+		if expiry > 0 {
+			le.expires = time.Unix(expiry, 0)
+		}
+		leases = append(leases, le)
+	}
+	return leases, problems
+}
+
+// parseISC parses an ISC dhcpd.leases file, e.g.
+//
+//	lease 192.168.1.10 {
+//	  starts 4 2024/01/04 10:00:00;
+//	  ends 4 2024/01/04 22:00:00;
+//	  binding state active;
+//	  client-hostname "laptop";
+//	}
+//
+// The file is a journal, a later lease for an address supersedes earlier ones.
+// Only active leases with a client hostname are returned.
+func parseISC(data string) ([]*lease, []Problem) {
+	tokens, lines := tokenizeISC(data)
+	var problems []Problem
+
+	var order []string
+	byIP := make(map[string]*lease)
+	active := make(map[string]bool)
+
+	for i := 0; i < len(tokens); i++ {
+		if tokens[i] != "lease" || i+2 >= len(tokens) || tokens[i+2] != "{" {
+			continue
+		}
+		addr, line := tokens[i+1], lines[i]
+		ip := net.ParseIP(addr)
+		i += 3
+
+		le := &lease{ip: ip, line: line}
+		state := ""
+		depth := 1
+		var stmt []string
+		for ; i < len(tokens) && depth > 0; i++ {
+			switch tokens[i] {
+			case "{":
+				depth++
+			case "}":
+				depth--
+			case ";":
+				if depth == 1 {
+					if err := parseISCStatement(stmt, le, &state); err != nil {
+						problems = append(problems, Problem{lines[i], err.Error()})
+					}
+				}
+				stmt = stmt[:0]
+			default:
+				stmt = append(stmt, tokens[i])
+			}
+		}
+		i--
+
+		if ip == nil {
+			problems = append(problems, Problem{line, fmt.Sprintf("Invalid IP address: %s", addr)})
+			continue
+		}
+		key := ip.String()
+		if _, ok := byIP[key]; !ok {
+			order = append(order, key)
+		}
+		byIP[key] = le
+		active[key] = state == "active"
+	}
+
+	var leases []*lease
+	for _, key := range order {
+		if le := byIP[key]; active[key] && le.hostname != "" {
+			leases = append(leases, le)
+		}
+	}
+	return leases, problems
+}
+
+func parseISCStatement(stmt []string, le *lease, state *string) error {
+	if len(stmt) == 0 {
+		return nil
+	}
+	switch {
+	case stmt[0] == "client-hostname" && len(stmt) == 2:
+		le.hostname = stmt[1]
+	case stmt[0] == "binding" && len(stmt) == 3 && stmt[1] == "state":
+		*state = stmt[2]
+	case stmt[0] == "ends" && len(stmt) >= 2:
+		expires, err := parseISCTime(stmt[1:])
+		if err != nil {
+			// treat unparseable times as expired
+			expires = time.Unix(1, 0)
+		}
+		le.expires = expires
+		return err
+	}
+	return nil
+}
+
+// parseISCTime parses 'never', 'epoch <seconds>' and '<weekday> <yyyy/mm/dd> <hh:mm:ss>' (UTC).
+func parseISCTime(fields []string) (time.Time, error) {
+	switch {
+	case fields[0] == "never":
+		return time.Time{}, nil
+	case fields[0] == "epoch" && len(fields) >= 2:
+		if secs, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			return time.Unix(secs, 0), nil
+		}
+	case len(fields) >= 3:
+		if t, err := time.Parse("2006/01/02 15:04:05", fields[1]+" "+fields[2]); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Invalid lease time: %s", strings.Join(fields, " "))
+}
+
+// tokenizeISC splits an ISC lease file into words, quoted strings (without
+// quotes) and the punctuation '{', '}' and ';'. Comments are skipped. The
+// second slice holds the line number of each token.
+func tokenizeISC(data string) ([]string, []int) {
+	var tokens []string
+	var lines []int
+	var word strings.Builder
+	line := 1
+	emit := func(token string) {
+		tokens = append(tokens, token)
+		lines = append(lines, line)
+	}
+	flush := func() {
+		if word.Len() > 0 {
+			emit(word.String())
+			word.Reset()
+		}
+	}
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '#':
+			flush()
+			for i+1 < len(data) && data[i+1] != '\n' {
+				i++
+			}
+		case c == '"':
+			flush()
+			i++
+			for i < len(data) && data[i] != '"' {
+				if data[i] == '\\' && i+1 < len(data) {
+					i++
+				}
+				word.WriteByte(data[i])
+				i++
+			}
+			emit(word.String())
+			word.Reset()
+		case c == '{' || c == '}' || c == ';':
+			flush()
+			emit(string(c))
+		case c == '\n':
+			flush()
+			line++
+		case c == ' ' || c == '\t' || c == '\r':
+			flush()
+		default:
+			word.WriteByte(c)
+		}
+	}
+	flush()
+	return tokens, lines
+}
@@ -18,14 +18,18 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
 	logrus_syslog "github.com/sirupsen/logrus/hooks/syslog"
 	"github.com/urfave/cli"
 
+	"github.com/claranet/go-dnsmasq/blocklist"
 	"github.com/claranet/go-dnsmasq/control"
+	"github.com/claranet/go-dnsmasq/docker"
 	"github.com/claranet/go-dnsmasq/hostsfile"
+	"github.com/claranet/go-dnsmasq/leases"
+	"github.com/claranet/go-dnsmasq/records"
 	"github.com/claranet/go-dnsmasq/resolvconf"
+	"github.com/claranet/go-dnsmasq/rpz"
 	"github.com/claranet/go-dnsmasq/server"
 	"github.com/claranet/go-dnsmasq/stats"
 )
@@ -35,12 +39,6 @@ var Version = "dev"
 
 const controlPort = 8053
 
-var (
-	nameservers   = []string{}
-	searchDomains = []string{}
-	listen        = ""
-)
-
 var exitErr error
 
 func init() {
@@ -48,10 +46,18 @@ func init() {
 }
 
 func main() {
+	err := newApp().Run(os.Args)
+	if err != nil {
+		log.Error("Fail to start app")
+	}
+}
+
+// newApp returns the application with its options and commands
+func newApp() *cli.App {
 	app := cli.NewApp()
 	app.Name = "go-dnsmasq"
 	app.Usage = "Lightweight caching DNS server and forwarder\n   Website: http://github.com/janeczku/go-dnsmasq, http://github.com/claranet/go-dnsmasq"
-	app.UsageText = "go-dnsmasq [global options]"
+	app.UsageText = "go-dnsmasq [global options] [command]"
 	app.Version = Version
 	app.Author, app.Email = "", ""
 	app.Flags = []cli.Flag{
@@ -77,6 +83,269 @@ func main() {
 			Usage:  "Use different nameservers for given domains <domain[,domain]/host[:port][,host[:port]]>",
 			EnvVar: "DNSMASQ_STUB",
 		},
+		cli.StringFlag{
+			Name:   "views",
+			Usage:  "Path to a JSON `file` of views answering selected clients or listeners with their own nameservers, stub zones, hosts file, search domains and cache",
+			EnvVar: "DNSMASQ_VIEWS",
+		},
+		cli.StringSliceFlag{
+			Name:   "leasefile",
+			Usage:  "Path to a DHCP lease `file` written by dnsmasq or ISC dhcpd (e.g. /var/lib/misc/dnsmasq.leases)",
+			EnvVar: "DNSMASQ_LEASEFILE",
+		},
+		cli.StringFlag{
+			Name:   "leasefile-domain",
+			Value:  "",
+			Usage:  "Qualify hostnames from lease files with this `domain`",
+			EnvVar: "DNSMASQ_LEASEFILE_DOMAIN",
+		},
+		cli.IntFlag{
+			Name:   "leasefile-poll",
+			Value:  10,
+			Usage:  "How frequently to poll lease files (`seconds`, '0' to disable)",
+			EnvVar: "DNSMASQ_LEASEFILE_POLL",
+		},
+		cli.BoolFlag{
+			Name:   "docker",
+			Usage:  "Serve records for running Docker containers",
+			EnvVar: "DNSMASQ_DOCKER",
+		},
+		cli.StringFlag{
+			Name:   "docker-socket",
+			Value:  "/var/run/docker.sock",
+			Usage:  "Path to the Docker daemon unix `socket`",
+			EnvVar: "DNSMASQ_DOCKER_SOCKET",
+		},
+		cli.StringFlag{
+			Name:   "docker-domain",
+			Value:  "docker",
+			Usage:  "Serve containers as <container>.`domain` and <service>.<project>.`domain`",
+			EnvVar: "DNSMASQ_DOCKER_DOMAIN",
+		},
+		cli.StringSliceFlag{
+			Name:   "allow-client",
+			Usage:  "Only answer clients from these networks <cidr[,cidr]>",
+			EnvVar: "DNSMASQ_ALLOW_CLIENT",
+		},
+		cli.StringSliceFlag{
+			Name:   "deny-client",
+			Usage:  "Never answer clients from these networks <cidr[,cidr]>",
+			EnvVar: "DNSMASQ_DENY_CLIENT",
+		},
+		cli.StringSliceFlag{
+			Name:   "allow-recursion",
+			Usage:  "Only forward queries of clients from these networks <cidr[,cidr]>",
+			EnvVar: "DNSMASQ_ALLOW_RECURSION",
+		},
+		cli.StringSliceFlag{
+			Name:   "deny-recursion",
+			Usage:  "Answer clients from these networks from local data only <cidr[,cidr]>",
+			EnvVar: "DNSMASQ_DENY_RECURSION",
+		},
+		cli.StringFlag{
+			Name:   "deny-action",
+			Value:  "refused",
+			Usage:  "Answer denied queries with `refused` or 'drop' them silently",
+			EnvVar: "DNSMASQ_DENY_ACTION",
+		},
+		cli.StringSliceFlag{
+			Name:   "rewrite",
+			Usage:  "Resolve another name instead of the query name, the first matching rule applies <exact|suffix|regex from to>",
+			EnvVar: "DNSMASQ_REWRITE",
+		},
+		cli.StringFlag{
+			Name:   "rewrite-answer",
+			Value:  "cname",
+			Usage:  "Answer rewritten queries with a synthesized `cname` to the rewritten name or 'flatten' the answer to the query name",
+			EnvVar: "DNSMASQ_REWRITE_ANSWER",
+		},
+		cli.BoolFlag{
+			Name:   "stop-dns-rebind",
+			Usage:  "Remove private, loopback and link-local addresses from upstream answers",
+			EnvVar: "DNSMASQ_STOP_DNS_REBIND",
+		},
+		cli.StringSliceFlag{
+			Name:   "rebind-domain-ok",
+			Usage:  "Allow these domains and their subdomains to resolve to private addresses <domain[,domain]>",
+			EnvVar: "DNSMASQ_REBIND_DOMAIN_OK",
+		},
+		cli.StringFlag{
+			Name:   "rebind-action",
+			Value:  "strip",
+			Usage:  "Answer rebinding responses without the private addresses ('strip') or with 'refused'",
+			EnvVar: "DNSMASQ_REBIND_ACTION",
+		},
+		cli.StringSliceFlag{
+			Name:   "address",
+			Usage:  "Answer a domain and all its subdomains with an address, queries for the other address family get an empty answer. Can be passed multiple times </domain[/domain]/address>",
+			EnvVar: "DNSMASQ_ADDRESS",
+		},
+		cli.StringSliceFlag{
+			Name:   "alias",
+			Usage:  "Translate addresses in upstream answers, keeping the host part for networks <address[/prefix]=address>",
+			EnvVar: "DNSMASQ_ALIAS",
+		},
+		cli.StringSliceFlag{
+			Name:   "qtype-policy",
+			Usage:  "Answer queries of a type with forward, refuse, nxdomain, nodata or drop, the first matching rule applies <type[/udp|/tcp]=action>",
+			EnvVar: "DNSMASQ_QTYPE_POLICY",
+		},
+		cli.StringFlag{
+			Name:   "any-response",
+			Value:  "forward",
+			Usage:  "Answer ANY queries by `forward`ing them, with a 'minimal' single RRset, a synthesized 'hinfo' (RFC 8482) or 'refuse' them",
+			EnvVar: "DNSMASQ_ANY_RESPONSE",
+		},
+		cli.StringFlag{
+			Name:   "ecs",
+			Value:  "forward",
+			Usage:  "EDNS client subnet on forwarded queries: 'forward' the client's option as is, 'add' one if the client sent none, 'replace' it with the client's address or 'strip' it",
+			EnvVar: "DNSMASQ_ECS",
+		},
+		cli.IntFlag{
+			Name:   "ecs-ipv4-prefix",
+			Value:  24,
+			Usage:  "Maximum source prefix length of IPv4 client subnets sent upstream",
+			EnvVar: "DNSMASQ_ECS_IPV4_PREFIX",
+		},
+		cli.IntFlag{
+			Name:   "ecs-ipv6-prefix",
+			Value:  56,
+			Usage:  "Maximum source prefix length of IPv6 client subnets sent upstream",
+			EnvVar: "DNSMASQ_ECS_IPV6_PREFIX",
+		},
+		cli.IntFlag{
+			Name:   "edns-buffer-size",
+			Value:  1232,
+			Usage:  "UDP buffer size in `bytes` advertised to clients and upstreams",
+			EnvVar: "DNSMASQ_EDNS_BUFFER_SIZE",
+		},
+		cli.IntFlag{
+			Name:   "tcp-idle-timeout",
+			Value:  10,
+			Usage:  "Close TCP connections to upstreams after this many `seconds` without queries, or sooner if they ask for it (RFC 7828)",
+			EnvVar: "DNSMASQ_TCP_IDLE_TIMEOUT",
+		},
+		cli.BoolFlag{
+			Name:   "cookies",
+			Usage:  "Answer DNS cookies of clients and send cookies to upstreams (RFC 7873)",
+			EnvVar: "DNSMASQ_COOKIES",
+		},
+		cli.StringSliceFlag{
+			Name:   "cookie-secret",
+			Usage:  "Hex encoded 128 bit `secret` of server cookies, shared by servers behind one address. The first one issues cookies, others are still accepted (default: random, replaced hourly)",
+			EnvVar: "DNSMASQ_COOKIE_SECRET",
+		},
+		cli.BoolFlag{
+			Name:   "require-cookie",
+			Usage:  "Answer UDP queries without a valid server cookie with BADCOOKIE, or truncated if they have no cookie at all",
+			EnvVar: "DNSMASQ_REQUIRE_COOKIE",
+		},
+		cli.BoolFlag{
+			Name:   "randomize-case",
+			Usage:  "Send UDP queries upstream with the query name in random case and discard responses that do not echo it (DNS 0x20)",
+			EnvVar: "DNSMASQ_RANDOMIZE_CASE",
+		},
+		cli.BoolFlag{
+			Name:   "dnssec",
+			Usage:  "Validate upstream answers with DNSSEC: set the AD bit for secure answers and answer bogus ones with SERVFAIL",
+			EnvVar: "DNSMASQ_DNSSEC",
+		},
+		cli.StringFlag{
+			Name:   "trust-anchors",
+			Value:  "",
+			Usage:  "Keep the state of the root trust anchors in this `file` to follow key rollovers (RFC 5011) across restarts",
+			EnvVar: "DNSMASQ_TRUST_ANCHORS",
+		},
+		cli.BoolFlag{
+			Name:   "aggressive-nsec",
+			Usage:  "Answer names that cached validated NSEC and NSEC3 records prove not to exist without forwarding (RFC 8198)",
+			EnvVar: "DNSMASQ_AGGRESSIVE_NSEC",
+		},
+		cli.IntFlag{
+			Name:   "ratelimit",
+			Value:  0,
+			Usage:  "Limit UDP responses to each client network to this many `queries` per second ('0' to disable)",
+			EnvVar: "DNSMASQ_RATELIMIT",
+		},
+		cli.IntFlag{
+			Name:   "ratelimit-burst",
+			Value:  0,
+			Usage:  "Number of `queries` a client network may send in a burst above the rate (defaults to the rate)",
+			EnvVar: "DNSMASQ_RATELIMIT_BURST",
+		},
+		cli.IntFlag{
+			Name:   "ratelimit-slip",
+			Value:  2,
+			Usage:  "Send every `n`-th limited response truncated instead of dropping it ('0' drops all)",
+			EnvVar: "DNSMASQ_RATELIMIT_SLIP",
+		},
+		cli.IntFlag{
+			Name:   "ratelimit-ipv4-prefix",
+			Value:  24,
+			Usage:  "Prefix `length` grouping IPv4 clients into networks",
+			EnvVar: "DNSMASQ_RATELIMIT_IPV4_PREFIX",
+		},
+		cli.IntFlag{
+			Name:   "ratelimit-ipv6-prefix",
+			Value:  56,
+			Usage:  "Prefix `length` grouping IPv6 clients into networks",
+			EnvVar: "DNSMASQ_RATELIMIT_IPV6_PREFIX",
+		},
+		cli.BoolFlag{
+			Name:   "ratelimit-per-name",
+			Usage:  "Limit each query name and type of a client network separately",
+			EnvVar: "DNSMASQ_RATELIMIT_PER_NAME",
+		},
+		cli.StringSliceFlag{
+			Name:   "ratelimit-exempt",
+			Usage:  "Never rate limit clients from these networks <cidr[,cidr]>",
+			EnvVar: "DNSMASQ_RATELIMIT_EXEMPT",
+		},
+		cli.StringSliceFlag{
+			Name:   "blocklist",
+			Usage:  "Block the domains listed in this `file or URL` (hosts, domain list or adblock format)",
+			EnvVar: "DNSMASQ_BLOCKLIST",
+		},
+		cli.StringSliceFlag{
+			Name:   "blocklist-allow",
+			Usage:  "Never block these domains and their subdomains <domain[,domain]>",
+			EnvVar: "DNSMASQ_BLOCKLIST_ALLOW",
+		},
+		cli.IntFlag{
+			Name:   "blocklist-refresh",
+			Value:  86400,
+			Usage:  "How frequently to reload blocklists (`seconds`, '0' to disable)",
+			EnvVar: "DNSMASQ_BLOCKLIST_REFRESH",
+		},
+		cli.StringFlag{
+			Name:   "block-response",
+			Value:  "nxdomain",
+			Usage:  "Answer blocked names with `nxdomain`, 'nodata', 'null' (0.0.0.0 and ::) or IP addresses <ip[,ip]>",
+			EnvVar: "DNSMASQ_BLOCK_RESPONSE",
+		},
+		cli.StringSliceFlag{
+			Name:   "rpz",
+			Usage:  "Apply the response policy zone loaded from a file or transferred from a primary <zone=file|zone@host[:port]>",
+			EnvVar: "DNSMASQ_RPZ",
+		},
+		cli.IntFlag{
+			Name:   "rpz-refresh",
+			Value:  300,
+			Usage:  "How frequently to check response policy zones for updates (`seconds`, '0' to disable)",
+			EnvVar: "DNSMASQ_RPZ_REFRESH",
+		},
+		cli.StringFlag{
+			Name:   "records-file",
+			Value:  "",
+			Usage:  "Persist records managed through the control server to this `file`",
+			EnvVar: "DNSMASQ_RECORDS_FILE",
+		},
+		cli.StringSliceFlag{
+			Name:   "local-domain",
+			Usage:  "Answer names under these domains from local data only, never forward them <domain[,domain]>",
+			EnvVar: "DNSMASQ_LOCAL_DOMAIN",
+		},
 		cli.StringFlag{
 			Name:   "hostsfile, f",
 			Value:  "",
@@ -183,6 +452,13 @@ func main() {
 			EnvVar: "DNSMASQ_MULTITHREADING",
 		},
 	}
+	app.Commands = []cli.Command{
+		{
+			Name:   "check",
+			Usage:  "Validate the configuration and local data sources, print the effective configuration and exit",
+			Action: checkAction,
+		},
+	}
 	app.Action = func(c *cli.Context) error {
 		exitReason := make(chan error)
 		go func() {
@@ -193,14 +469,6 @@ func main() {
 			exitReason <- nil
 		}()
 
-		var enableSearch bool
-		if c.IsSet("append-search-domains") {
-			log.Info("The flag '--append-search-domains' is deprecated. Please use '--enable-search' or '-search' instead.")
-			enableSearch = c.Bool("append-search-domains")
-		} else {
-			enableSearch = c.Bool("enable-search")
-		}
-
 		if c.Bool("multithreading") {
 			runtime.GOMAXPROCS(runtime.NumCPU())
 		}
@@ -221,128 +489,118 @@ func main() {
 			log.SetFormatter(&log.TextFormatter{})
 		}
 
-		if ns := c.String("nameservers"); ns != "" {
-			for _, hostPort := range strings.Split(ns, ",") {
-				hostPort = strings.TrimSpace(hostPort)
-				if strings.HasSuffix(hostPort, "]") {
-					hostPort += ":53"
-				} else if !strings.Contains(hostPort, ":") {
-					hostPort += ":53"
-				}
-				if err := validateHostPort(hostPort); err != nil {
-					log.Fatalf("Nameserver is invalid: %s", err)
-				}
-
-				nameservers = append(nameservers, hostPort)
-			}
-		}
-
-		if sd := c.String("search-domains"); sd != "" {
-			for _, domain := range strings.Split(sd, ",") {
-				if dns.CountLabel(domain) < 2 {
-					log.Fatalf("Search domain must have at least one dot in name: %s", domain)
-				}
-				domain = strings.TrimSpace(domain)
-				domain = dns.Fqdn(strings.ToLower(domain))
-				searchDomains = append(searchDomains, domain)
+		resolvconf.Clean()
+		config, views, errs := newConfig(c)
+		if len(errs) > 0 {
+			for _, err := range errs {
+				log.Error(err)
 			}
+			log.Fatal("Invalid configuration, run 'go-dnsmasq [global options] check' for details")
 		}
 
-		listen = c.String("listen")
-		if strings.HasSuffix(listen, "]") {
-			listen += ":53"
-		} else if !strings.Contains(listen, ":") {
-			listen += ":53"
+		log.Infof("Starting go-dnsmasq server %s", Version)
+		log.Infof("Nameservers: %v", config.Nameservers)
+		if config.EnableSearch {
+			log.Infof("Search domains: %v", config.SearchDomains)
 		}
-
-		if err := validateHostPort(listen); err != nil {
-			log.Fatalf("Listen address is invalid: %s", err)
+		if len(config.LocalDomains) > 0 {
+			log.Infof("Local domains: %v", config.LocalDomains)
 		}
 
-		config := &server.Config{
-			DnsAddr:           listen,
-			DefaultResolver:   c.Bool("default-resolver"),
-			Nameservers:       nameservers,
-			Systemd:           c.Bool("systemd"),
-			SearchDomains:     searchDomains,
-			EnableSearch:      enableSearch,
-			Hostsfile:         c.String("hostsfile"),
-			PollInterval:      c.Int("hostsfile-poll"),
-			RoundRobin:        c.Bool("round-robin"),
-			NoRec:             c.Bool("no-rec"),
-			FwdNdots:          c.Int("fwd-ndots"),
-			Ndots:             c.Int("ndots"),
-			ReadTimeout:       2 * time.Second,
-			RCache:            c.Int("rcache"),
-			RCacheTtl:         c.Int("rcache-ttl"),
-			RCacheTtlFromResp: c.Bool("rcache-ttl-from-resp"),
-			RCacheTtlMax:      c.Int("rcache-ttl-max"),
-			RStaleTtl:         c.Int("rstale-ttl"),
-			RCacheNonNegative: c.Bool("rcache-non-negative"),
-			Verbose:           c.Bool("verbose"),
+		if sources := c.StringSlice("blocklist"); len(sources) > 0 {
+			var allow []string
+			for _, a := range c.StringSlice("blocklist-allow") {
+				allow = append(allow, strings.Split(a, ",")...)
+			}
+			bl, err := blocklist.New(&blocklist.Config{
+				Sources: sources,
+				Allow:   allow,
+				Refresh: time.Duration(c.Int("blocklist-refresh")) * time.Second,
+			})
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Infof("Blocklists: %d domains blocked", bl.Len())
+			config.Blocklist = bl
 		}
 
-		resolvconf.Clean()
-		if err := server.ResolvConf(config, c); err != nil {
-			if !os.IsNotExist(err) {
-				log.Warnf("Error parsing resolv.conf: %s", err.Error())
+		if zones, _ := rpzZones(c); len(zones) > 0 {
+			policy, err := rpz.New(&rpz.Config{
+				Zones:   zones,
+				Refresh: time.Duration(c.Int("rpz-refresh")) * time.Second,
+			})
+			if err != nil {
+				log.Fatal(err)
 			}
+			log.Infof("Response policy zones: %d rules", policy.Len())
+			config.RPZ = policy
 		}
 
-		if err := server.CheckConfig(config); err != nil {
-			log.Fatal(err.Error())
+		hf, err := hosts.NewHostsfile(config.Hostsfile, &hosts.Config{
+			Poll:    config.PollInterval,
+			Verbose: config.Verbose,
+		})
+		if err != nil {
+			log.Fatalf("Error loading hostsfile: %s", err)
 		}
 
-		if stubzones := c.StringSlice("stubzones"); len(stubzones) > 0 {
-			stubmap := make(map[string][]string)
-			for _, stubzone := range stubzones {
-				segments := strings.Split(stubzone, "/")
-				if len(segments) != 2 || len(segments[0]) == 0 || len(segments[1]) == 0 {
-					log.Fatalf("Invalid value for --stubzones")
-				}
-
-				hosts := strings.Split(segments[1], ",")
-				for _, hostPort := range hosts {
-					hostPort = strings.TrimSpace(hostPort)
-					if strings.HasSuffix(hostPort, "]") {
-						hostPort += ":53"
-					} else if !strings.Contains(hostPort, ":") {
-						hostPort += ":53"
-					}
-
-					if err := validateHostPort(hostPort); err != nil {
-						log.Fatalf("Stubzone server address is invalid: %s", err)
-					}
-
-					for _, sdomain := range strings.Split(segments[0], ",") {
-						if dns.CountLabel(sdomain) < 1 {
-							log.Fatalf("Stubzone domain is not a fully-qualified domain name: %s", sdomain)
-						}
-						sdomain = strings.TrimSpace(sdomain)
-						sdomain = dns.Fqdn(sdomain)
-						stubmap[sdomain] = append(stubmap[sdomain], hostPort)
-					}
-				}
+		sources := []server.Hostfile{hf}
+		for _, path := range c.StringSlice("leasefile") {
+			lf, err := leases.NewLeasefile(path, &leases.Config{
+				Domain:  c.String("leasefile-domain"),
+				Poll:    c.Int("leasefile-poll"),
+				Verbose: config.Verbose,
+			})
+			if err != nil {
+				log.Fatalf("Error loading lease file: %s", err)
 			}
-			config.Stub = &stubmap
+			sources = append(sources, lf)
 		}
 
-		log.Infof("Starting go-dnsmasq server %s", Version)
-		log.Infof("Nameservers: %v", config.Nameservers)
-		if config.EnableSearch {
-			log.Infof("Search domains: %v", config.SearchDomains)
+		if c.Bool("docker") {
+			dp, err := docker.New(&docker.Config{
+				Socket: c.String("docker-socket"),
+				Domain: c.String("docker-domain"),
+			})
+			if err != nil {
+				log.Fatalf("Error connecting to Docker: %s", err)
+			}
+			sources = append(sources, dp)
 		}
 
-		hf, err := hosts.NewHostsfile(config.Hostsfile, &hosts.Config{
-			Poll:    config.PollInterval,
-			Verbose: config.Verbose,
+		store, err := records.New(server.MultiHostfile(sources...), &records.Config{
+			Path: c.String("records-file"),
 		})
 		if err != nil {
-			log.Fatalf("Error loading hostsfile: %s", err)
+			log.Fatalf("Error loading records: %s", err)
 		}
 
-		s := server.New(hf, config, Version)
-		ctrl := control.New(controlPort, s.GetCacheRef())
+		s := server.New(store, config, Version)
+		for _, v := range views {
+			var hostfile server.Hostfile = store
+			if v.Hostsfile != "" {
+				vhf, err := hosts.NewHostsfile(v.Hostsfile, &hosts.Config{
+					Poll:    config.PollInterval,
+					Verbose: config.Verbose,
+				})
+				if err != nil {
+					log.Fatalf("Error loading hostsfile of view %s: %s", v.Name, err)
+				}
+				hostfile = server.MultiHostfile(vhf, store)
+			}
+			if err := s.AddView(v, hostfile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if len(views) > 0 {
+			log.Infof("Views: %d", len(views))
+		}
+		store.OnChange(func(names []string) {
+			for _, name := range names {
+				s.RemoveCachedName(name)
+			}
+		})
+		ctrl := control.New(controlPort, s.GetCacheRef(), store)
 
 		defer s.Stop()
 
@@ -380,11 +638,7 @@ func main() {
 
 		return nil
 	}
-
-	err := app.Run(os.Args)
-	if err != nil {
-		log.Error("Fail to start app")
-	}
+	return app
 }
 
 func validateHostPort(hostPort string) error {
@@ -0,0 +1,347 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+// Package records provides a runtime store of host records layered over
+// another record source such as the hosts file.
+package records
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/claranet/go-dnsmasq/server"
+)
+
+// Config stores options for the record store
+type Config struct {
+	// File the records are persisted to, empty disables persistence
+	Path string
+	// How often expired records are removed
+	ExpiryInterval time.Duration
+}
+
+// Record is a single name to address mapping
+type Record struct {
+	Name    string     `json:"name"`
+	IP      net.IP     `json:"ip"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+func (r *Record) expired(now time.Time) bool {
+	return r.Expires != nil && !now.Before(*r.Expires)
+}
+
+// Store holds records added at runtime. Records in the store take
+// precedence over the records of the underlying source.
+type Store struct {
+	config   *Config
+	base     server.Hostfile
+	records  []*Record
+	onChange func(names []string)
+	mutex    sync.RWMutex
+	saving   sync.Mutex // orders the snapshots written to config.Path
+}
+
+// New returns a new Store layered over base. Records persisted by a
+// previous run are loaded from config.Path.
+func New(base server.Hostfile, config *Config) (*Store, error) {
+	s := &Store{config: config, base: base}
+
+	if config.Path != "" {
+		if err := s.load(); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	interval := config.ExpiryInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	go s.expireRecords(interval)
+
+	return s, nil
+}
+
+// OnChange registers a function that is called with the owner and reverse
+// names of records that were added, removed or expired.
+func (s *Store) OnChange(fn func(names []string)) {
+	s.mutex.Lock()
+	s.onChange = fn
+	s.mutex.Unlock()
+}
+
+func (s *Store) FindHosts(name string) (addrs []net.IP, err error) {
+	fqdn := dns.Fqdn(strings.ToLower(name))
+	now := time.Now()
+
+	s.mutex.RLock()
+	for _, r := range s.records {
+		if r.Name == fqdn && !r.expired(now) {
+			addrs = append(addrs, r.IP)
+		}
+	}
+	s.mutex.RUnlock()
+
+	if len(addrs) > 0 || s.base == nil {
+		return addrs, nil
+	}
+	return s.base.FindHosts(name)
+}
+
+// HasSubdomains reports whether there are records below name, in the store
+// or in the base source.
+func (s *Store) HasSubdomains(name string) bool {
+	suffix := "." + dns.Fqdn(strings.ToLower(name))
+	now := time.Now()
+
+	s.mutex.RLock()
+	for _, r := range s.records {
+		if strings.HasSuffix(r.Name, suffix) && !r.expired(now) {
+			s.mutex.RUnlock()
+			return true
+		}
+	}
+	s.mutex.RUnlock()
+
+	f, ok := s.base.(server.SubdomainFinder)
+	return ok && f.HasSubdomains(name)
+}
+
+func (s *Store) FindReverse(name string) (host string, err error) {
+	now := time.Now()
+
+	s.mutex.RLock()
+	for _, r := range s.records {
+		if rev, _ := dns.ReverseAddr(r.IP.String()); rev == name && !r.expired(now) {
+			host = r.Name
+			break
+		}
+	}
+	s.mutex.RUnlock()
+
+	if host != "" || s.base == nil {
+		return host, nil
+	}
+	return s.base.FindReverse(name)
+}
+
+// List returns a copy of all records that have not expired.
+func (s *Store) List() []Record {
+	now := time.Now()
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	list := make([]Record, 0, len(s.records))
+	for _, r := range s.records {
+		if !r.expired(now) {
+			list = append(list, *r)
+		}
+	}
+	return list
+}
+
+// Add stores a record for name and ip. A ttl greater than zero makes the
+// record expire after that duration. Adding an existing record updates its
+// expiry.
+func (s *Store) Add(name string, ip net.IP, ttl time.Duration) (Record, error) {
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		return Record{}, fmt.Errorf("Invalid name: %q", name)
+	}
+	if ip == nil {
+		return Record{}, fmt.Errorf("Invalid IP address")
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	r := &Record{Name: dns.Fqdn(strings.ToLower(name)), IP: ip}
+	if ttl > 0 {
+		expires := time.Now().Add(ttl).UTC()
+		r.Expires = &expires
+	}
+
+	s.mutex.Lock()
+	replaced := false
+	for i, found := range s.records {
+		if found.Name == r.Name && found.IP.Equal(r.IP) {
+			s.records[i] = r
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		s.records = append(s.records, r)
+	}
+	s.mutex.Unlock()
+
+	log.Debugf("Added record %s -> %s", r.Name, r.IP)
+	s.changed([]*Record{r})
+	return *r, nil
+}
+
+// Remove deletes the records for name. If ip is not nil only the record
+// with that address is removed. It returns the number of removed records.
+func (s *Store) Remove(name string, ip net.IP) int {
+	fqdn := dns.Fqdn(strings.ToLower(name))
+
+	s.mutex.Lock()
+	var kept, removed []*Record
+	for _, r := range s.records {
+		if r.Name == fqdn && (ip == nil || r.IP.Equal(ip)) {
+			removed = append(removed, r)
+			continue
+		}
+		kept = append(kept, r)
+	}
+	s.records = kept
+	s.mutex.Unlock()
+
+	if len(removed) > 0 {
+		log.Debugf("Removed %d record(s) for %s", len(removed), fqdn)
+		s.changed(removed)
+	}
+	return len(removed)
+}
+
+func (s *Store) expireRecords(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	for now := range ticker.C {
+		s.mutex.Lock()
+		var kept, expired []*Record
+		for _, r := range s.records {
+			if r.expired(now) {
+				expired = append(expired, r)
+				continue
+			}
+			kept = append(kept, r)
+		}
+		s.records = kept
+		s.mutex.Unlock()
+
+		if len(expired) > 0 {
+			log.Debugf("Expired %d record(s)", len(expired))
+			s.changed(expired)
+		}
+	}
+}
+
+// changed persists the store and notifies about the affected names
+func (s *Store) changed(records []*Record) {
+	if s.config.Path != "" {
+		if err := s.save(); err != nil {
+			log.Errorf("Error persisting records to %s: %s", s.config.Path, err)
+		}
+	}
+
+	s.mutex.RLock()
+	fn := s.onChange
+	s.mutex.RUnlock()
+	if fn == nil {
+		return
+	}
+
+	var names []string
+	for _, r := range records {
+		names = append(names, r.Name)
+		if rev, err := dns.ReverseAddr(r.IP.String()); err == nil {
+			names = append(names, rev)
+		}
+	}
+	fn(names)
+}
+
+func (s *Store) load() error {
+	data, err := os.ReadFile(s.config.Path)
+	if err != nil {
+		return err
+	}
+
+	var list []*Record
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("Error parsing %s: %s", s.config.Path, err)
+	}
+
+	now := time.Now()
+	s.mutex.Lock()
+	for _, r := range list {
+		if r.IP == nil || r.expired(now) {
+			continue
+		}
+		r.Name = dns.Fqdn(strings.ToLower(r.Name))
+		s.records = append(s.records, r)
+	}
+	s.mutex.Unlock()
+
+	log.Debugf("Loaded %d record(s) from %s", len(s.records), s.config.Path)
+	return nil
+}
+
+// Check parses the records file at path and returns the problems found in it
+func Check(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*Record
+	if err := json.Unmarshal(data, &list); err != nil {
+		if serr, ok := err.(*json.SyntaxError); ok {
+			line := 1 + strings.Count(string(data[:serr.Offset]), "\n")
+			return []string{fmt.Sprintf("line %d: %s", line, err)}, nil
+		}
+		return []string{err.Error()}, nil
+	}
+
+	var problems []string
+	for i, r := range list {
+		if _, ok := dns.IsDomainName(r.Name); !ok || r.Name == "" {
+			problems = append(problems, fmt.Sprintf("record %d: Invalid name: %q", i+1, r.Name))
+		}
+		if r.IP == nil {
+			problems = append(problems, fmt.Sprintf("record %d: Missing IP address", i+1))
+		}
+	}
+	return problems, nil
+}
+
+// save writes the records to a temporary file which then replaces the
+// previous one, so readers never see a partially written file.
+func (s *Store) save() error {
+	s.saving.Lock()
+	defer s.saving.Unlock()
+
+	s.mutex.RLock()
+	data, err := json.MarshalIndent(s.records, "", "  ")
+	s.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.config.Path), ".records-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.config.Path)
+}
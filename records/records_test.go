@@ -0,0 +1,150 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package records
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type staticHosts map[string]net.IP
+
+func (h staticHosts) FindHosts(name string) ([]net.IP, error) {
+	if ip, ok := h[name]; ok {
+		return []net.IP{ip}, nil
+	}
+	return nil, nil
+}
+
+func (h staticHosts) FindReverse(name string) (string, error) {
+	return "", nil
+}
+
+func TestLayering(t *testing.T) {
+	base := staticHosts{"base.test.": net.ParseIP("10.0.0.1")}
+	s, err := New(base, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ips, _ := s.FindHosts("base.test."); len(ips) != 1 || !ips[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("expected base record, got %v", ips)
+	}
+
+	if _, err := s.Add("Base.Test", net.ParseIP("10.0.0.2"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if ips, _ := s.FindHosts("base.test."); len(ips) != 1 || !ips[0].Equal(net.ParseIP("10.0.0.2")) {
+		t.Fatalf("expected store record to take precedence, got %v", ips)
+	}
+	if host, _ := s.FindReverse("2.0.0.10.in-addr.arpa."); host != "base.test." {
+		t.Fatalf("expected reverse lookup to return base.test., got %q", host)
+	}
+
+	if removed := s.Remove("base.test.", nil); removed != 1 {
+		t.Fatalf("expected 1 removed record, got %d", removed)
+	}
+	if ips, _ := s.FindHosts("base.test."); len(ips) != 1 || !ips[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("expected base record after removal, got %v", ips)
+	}
+
+	if _, err := s.Add("bad name..", net.ParseIP("10.0.0.3"), 0); err == nil {
+		t.Fatal("expected error for invalid name")
+	}
+
+	if _, err := s.Add("a.b.test", net.ParseIP("10.0.0.4"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if !s.HasSubdomains("B.test.") || s.HasSubdomains("a.b.test.") {
+		t.Fatal("expected b.test. only to have records below it")
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	s, err := New(nil, &Config{ExpiryInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed := make(chan []string, 2)
+	s.OnChange(func(names []string) { changed <- names })
+
+	if _, err := s.Add("short.test.", net.ParseIP("2001:db8::1"), 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	<-changed
+
+	select {
+	case names := <-changed:
+		if len(names) != 2 || names[0] != "short.test." {
+			t.Fatalf("expected owner and reverse name, got %v", names)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("record did not expire")
+	}
+	if ips, _ := s.FindHosts("short.test."); len(ips) != 0 {
+		t.Fatalf("expected no records after expiry, got %v", ips)
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.json")
+
+	s, err := New(nil, &Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Add("kept.test.", net.ParseIP("10.0.0.4"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Add("gone.test.", net.ParseIP("10.0.0.5"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	s.Remove("gone.test.", net.ParseIP("10.0.0.5"))
+
+	s, err = New(nil, &Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := s.List()
+	if len(list) != 1 || list[0].Name != "kept.test." {
+		t.Fatalf("expected only kept.test. to be loaded, got %v", list)
+	}
+}
+
+func TestConcurrentPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.json")
+
+	s, err := New(nil, &Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := s.Add(fmt.Sprintf("host%d.test.", i), net.IPv4(10, 0, 1, byte(i)), 0); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// the last snapshot written has all records
+	s, err = New(nil, &Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := s.List(); len(list) != 20 {
+		t.Errorf("expected 20 records to be loaded, got %d", len(list))
+	}
+}
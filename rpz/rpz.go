@@ -0,0 +1,367 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+// Package rpz implements DNS Response Policy Zones. Policy zones are loaded
+// from zone files or transferred from a primary and decide how queries for
+// listed names, addresses, name servers and clients are answered.
+package rpz
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// Action is what a rule does with a query
+type Action int
+
+const (
+	// Passthru resolves the query normally and stops policy processing
+	Passthru Action = iota
+	NXDomain
+	NoData
+	// Drop sends no response at all
+	Drop
+	// TCPOnly truncates UDP responses to make the client retry over TCP
+	TCPOnly
+	// LocalData answers with the records of the rule, e.g. a CNAME rewrite
+	LocalData
+)
+
+func (a Action) String() string {
+	switch a {
+	case Passthru:
+		return "PASSTHRU"
+	case NXDomain:
+		return "NXDOMAIN"
+	case NoData:
+		return "NODATA"
+	case Drop:
+		return "DROP"
+	case TCPOnly:
+		return "TCP-ONLY"
+	}
+	return "LOCAL-DATA"
+}
+
+// Trigger is the part of a query or response a rule matches
+type Trigger int
+
+const (
+	ClientIP Trigger = iota
+	QName
+	ResponseIP
+	NSDName
+	NSIP
+)
+
+func (t Trigger) String() string {
+	switch t {
+	case ClientIP:
+		return "client-IP"
+	case QName:
+		return "QNAME"
+	case ResponseIP:
+		return "response-IP"
+	case NSDName:
+		return "NSDNAME"
+	}
+	return "NSIP"
+}
+
+// Rule is a policy of a zone
+type Rule struct {
+	// Policy zone the rule was loaded from
+	Zone    string
+	Trigger Trigger
+	Action  Action
+	// Records answered for LocalData, owned by the trigger
+	Records []dns.RR
+}
+
+// Answer returns the local data of the rule for the question, owned by the
+// query name. A CNAME is returned for any question type, a CNAME to a
+// wildcard (*.domain) rewrites the query name into that domain.
+func (r *Rule) Answer(q dns.Question) []dns.RR {
+	var answer []dns.RR
+	for _, rr := range r.Records {
+		rr = dns.Copy(rr)
+		rr.Header().Name = q.Name
+		if cname, ok := rr.(*dns.CNAME); ok {
+			if strings.HasPrefix(cname.Target, "*.") {
+				cname.Target = q.Name + cname.Target[2:]
+			}
+			return []dns.RR{cname}
+		}
+		if q.Qtype == dns.TypeANY || q.Qtype == rr.Header().Rrtype {
+			answer = append(answer, rr)
+		}
+	}
+	return answer
+}
+
+// Config stores options for policy zones
+type Config struct {
+	// Zones in order of precedence
+	Zones []ZoneConfig
+	// How often zones are checked for updates, zero disables reloading
+	Refresh time.Duration
+}
+
+// ZoneConfig is the source of a policy zone
+type ZoneConfig struct {
+	// Origin of the zone, e.g. rpz.example.com.
+	Name string
+	// Zone file to load
+	File string
+	// Primary <host:port> to transfer the zone from if no file is given
+	Primary string
+}
+
+func (zc ZoneConfig) String() string {
+	if zc.File != "" {
+		return fmt.Sprintf("%s (%s)", zc.Name, zc.File)
+	}
+	return fmt.Sprintf("%s (AXFR from %s)", zc.Name, zc.Primary)
+}
+
+// Policy holds the policy zones
+type Policy struct {
+	config *Config
+	zones  []*zone
+	mutex  sync.RWMutex
+}
+
+// New loads the zones and starts checking them for updates periodically if
+// configured. It fails if a zone cannot be loaded initially.
+func New(config *Config) (*Policy, error) {
+	p := &Policy{
+		config: config,
+		zones:  make([]*zone, len(config.Zones)),
+	}
+
+	for i, zc := range config.Zones {
+		z, err := load(zc, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading policy zone %s: %s", zc, err)
+		}
+		p.zones[i] = z
+	}
+
+	if config.Refresh > 0 {
+		go p.refreshZones(config.Refresh)
+	}
+
+	return p, nil
+}
+
+// Len returns the number of rules of all zones
+func (p *Policy) Len() int {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	n := 0
+	for _, z := range p.zones {
+		n += z.len()
+	}
+	return n
+}
+
+// QueryRule returns the rule triggered by the client address or the query
+// name, or nil if there is none. Zones are consulted in order and within a
+// zone client-IP triggers take precedence over QNAME triggers.
+func (p *Policy) QueryRule(name string, client net.IP) *Rule {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	for _, z := range p.zones {
+		if client != nil {
+			if r := matchIP(z.clientIPs, client); r != nil {
+				return r
+			}
+		}
+		if r := matchName(z.names, name); r != nil {
+			return r
+		}
+	}
+	return nil
+}
+
+// ResponseRule returns the rule triggered by the addresses in the answer
+// section or the name servers in the authority section of m, or nil if
+// there is none. Name server addresses are taken from the glue records in
+// the additional section, so NSDNAME and NSIP triggers only fire if the
+// upstream includes the delegation in its response.
+func (p *Policy) ResponseRule(m *dns.Msg) *Rule {
+	var ips, nsIPs []net.IP
+	var nsNames []string
+	for _, rr := range m.Answer {
+		if ip := address(rr); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	for _, rr := range m.Ns {
+		if ns, ok := rr.(*dns.NS); ok {
+			nsNames = append(nsNames, strings.ToLower(ns.Ns))
+		}
+	}
+	for _, rr := range m.Extra {
+		if ip := address(rr); ip != nil {
+			for _, ns := range nsNames {
+				if strings.EqualFold(rr.Header().Name, ns) {
+					nsIPs = append(nsIPs, ip)
+					break
+				}
+			}
+		}
+	}
+	if len(ips)+len(nsNames) == 0 {
+		return nil
+	}
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	for _, z := range p.zones {
+		for _, ip := range ips {
+			if r := matchIP(z.responseIPs, ip); r != nil {
+				return r
+			}
+		}
+		for _, ns := range nsNames {
+			if r := matchName(z.nsNames, ns); r != nil {
+				return r
+			}
+		}
+		for _, ip := range nsIPs {
+			if r := matchIP(z.nsIPs, ip); r != nil {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+func (p *Policy) refreshZones(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	for range ticker.C {
+		for i, zc := range p.config.Zones {
+			p.mutex.RLock()
+			prev := p.zones[i]
+			p.mutex.RUnlock()
+
+			z, err := load(zc, prev)
+			if err != nil {
+				// keep the previous version of the zone
+				log.Warnf("Error reloading policy zone %s: %s", zc, err)
+				continue
+			}
+			if z == prev {
+				continue
+			}
+			p.mutex.Lock()
+			p.zones[i] = z
+			p.mutex.Unlock()
+			log.Debugf("Reloaded policy zone %s, %d rules", zc.Name, z.len())
+		}
+	}
+}
+
+// load reads the zone from its file or primary. It returns prev if the
+// zone did not change since prev was loaded.
+func load(zc ZoneConfig, prev *zone) (*zone, error) {
+	origin := strings.ToLower(dns.Fqdn(zc.Name))
+
+	if zc.File != "" {
+		fi, err := os.Stat(zc.File)
+		if err != nil {
+			return nil, err
+		}
+		if prev != nil && fi.ModTime().Equal(prev.modTime) && fi.Size() == prev.size {
+			return prev, nil
+		}
+		f, err := os.Open(zc.File)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		var rrs []dns.RR
+		zp := dns.NewZoneParser(f, origin, zc.File)
+		for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+			rrs = append(rrs, rr)
+		}
+		if err := zp.Err(); err != nil {
+			return nil, err
+		}
+		z := parse(origin, rrs)
+		z.modTime, z.size = fi.ModTime(), fi.Size()
+		return z, nil
+	}
+
+	if prev != nil {
+		serial, err := querySerial(origin, zc.Primary)
+		if err != nil {
+			return nil, err
+		}
+		if serial == prev.serial {
+			return prev, nil
+		}
+	}
+	rrs, err := transfer(origin, zc.Primary)
+	if err != nil {
+		return nil, err
+	}
+	return parse(origin, rrs), nil
+}
+
+func querySerial(origin, primary string) (uint32, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(origin, dns.TypeSOA)
+	r, err := dns.Exchange(m, primary)
+	if err != nil {
+		return 0, err
+	}
+	for _, rr := range r.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, nil
+		}
+	}
+	return 0, fmt.Errorf("No SOA record for %s: %s", origin, dns.RcodeToString[r.Rcode])
+}
+
+func transfer(origin, primary string) ([]dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetAxfr(origin)
+	env, err := new(dns.Transfer).In(m, primary)
+	if err != nil {
+		return nil, err
+	}
+	var rrs []dns.RR
+	for e := range env {
+		if e.Error != nil {
+			return nil, e.Error
+		}
+		rrs = append(rrs, e.RR...)
+	}
+	return rrs, nil
+}
+
+func address(rr dns.RR) net.IP {
+	switch t := rr.(type) {
+	case *dns.A:
+		return t.A
+	case *dns.AAAA:
+		return t.AAAA
+	}
+	return nil
+}
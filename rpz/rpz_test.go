@@ -0,0 +1,275 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package rpz
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testZone = `$TTL 300
+@                         SOA   localhost. hostmaster.localhost. 7 3600 600 86400 60
+                          NS    localhost.
+bad.example               CNAME .
+*.bad.example             CNAME .
+good.bad.example          CNAME rpz-passthru.
+empty.example             CNAME *.
+drop.example              CNAME rpz-drop.
+tcp.example               CNAME rpz-tcp-only.
+legacy.example            CNAME legacy.example.
+garden.example            A     192.0.2.80
+garden.example            AAAA  2001:db8::80
+walled.example            CNAME garden.example.
+*.rewrite.example         CNAME *.walled.garden.
+24.0.2.0.198.rpz-ip       CNAME .
+32.7.2.0.198.rpz-ip       CNAME rpz-passthru.
+48.zz.db8.2001.rpz-ip     CNAME *.
+32.9.0.0.10.rpz-client-ip CNAME rpz-drop.
+ns.evil.rpz-nsdname       CNAME .
+32.53.2.0.203.rpz-nsip    CNAME *.
+bogus.rpz-ip              CNAME .
+`
+
+func loadTestZone(t *testing.T) *Policy {
+	path := filepath.Join(t.TempDir(), "rpz.zone")
+	if err := os.WriteFile(path, []byte(testZone), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(&Config{Zones: []ZoneConfig{{Name: "rpz.local", File: path}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLoad(t *testing.T) {
+	p := loadTestZone(t)
+
+	// the invalid IP trigger is skipped
+	if p.Len() != 16 {
+		t.Errorf("expected 16 rules, got %d", p.Len())
+	}
+	if p.zones[0].serial != 7 {
+		t.Errorf("expected serial 7, got %d", p.zones[0].serial)
+	}
+}
+
+func TestQueryRule(t *testing.T) {
+	p := loadTestZone(t)
+
+	tests := []struct {
+		name    string
+		client  string
+		action  Action
+		trigger Trigger
+	}{
+		{"bad.example.", "10.0.0.1", NXDomain, QName},
+		{"www.bad.example.", "10.0.0.1", NXDomain, QName},
+		{"good.bad.example.", "10.0.0.1", Passthru, QName},
+		{"EMPTY.example.", "10.0.0.1", NoData, QName},
+		{"drop.example.", "10.0.0.1", Drop, QName},
+		{"tcp.example.", "10.0.0.1", TCPOnly, QName},
+		{"legacy.example.", "10.0.0.1", Passthru, QName},
+		{"garden.example.", "10.0.0.1", LocalData, QName},
+		{"example.com.", "10.0.0.9", Drop, ClientIP},
+		{"bad.example.", "10.0.0.9", Drop, ClientIP},
+	}
+
+	for _, tc := range tests {
+		r := p.QueryRule(tc.name, net.ParseIP(tc.client))
+		if r == nil {
+			t.Errorf("%s from %s: expected %s, got no rule", tc.name, tc.client, tc.action)
+			continue
+		}
+		if r.Action != tc.action || r.Trigger != tc.trigger {
+			t.Errorf("%s from %s: expected %s %s, got %s %s", tc.name, tc.client,
+				tc.trigger, tc.action, r.Trigger, r.Action)
+		}
+	}
+
+	for _, name := range []string{"example.com.", "example.", "nothing.example.", "rewrite.example."} {
+		if r := p.QueryRule(name, net.ParseIP("10.0.0.1")); r != nil {
+			t.Errorf("%s: expected no rule, got %s", name, r.Action)
+		}
+	}
+}
+
+func TestResponseRule(t *testing.T) {
+	p := loadTestZone(t)
+
+	msg := func(answer ...string) *dns.Msg {
+		m := new(dns.Msg)
+		for _, s := range answer {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch rr.(type) {
+			case *dns.NS:
+				m.Ns = append(m.Ns, rr)
+			default:
+				if rr.Header().Name == "ns.evil." || rr.Header().Name == "ns.example." {
+					m.Extra = append(m.Extra, rr)
+				} else {
+					m.Answer = append(m.Answer, rr)
+				}
+			}
+		}
+		return m
+	}
+
+	tests := []struct {
+		msg     *dns.Msg
+		action  Action
+		trigger Trigger
+	}{
+		{msg("a.example. A 198.51.100.1", "a.example. A 198.0.2.1"), NXDomain, ResponseIP},
+		{msg("a.example. A 198.0.2.7"), Passthru, ResponseIP},
+		{msg("a.example. AAAA 2001:db8:0:1::1"), NoData, ResponseIP},
+		{msg("a.example. A 192.0.2.1", "example. NS ns.evil."), NXDomain, NSDName},
+		{msg("a.example. A 192.0.2.1", "example. NS ns.example.", "ns.example. A 203.0.2.53"), NoData, NSIP},
+	}
+
+	for i, tc := range tests {
+		r := p.ResponseRule(tc.msg)
+		if r == nil {
+			t.Errorf("%d: expected %s, got no rule", i, tc.action)
+			continue
+		}
+		if r.Action != tc.action || r.Trigger != tc.trigger {
+			t.Errorf("%d: expected %s %s, got %s %s", i, tc.trigger, tc.action, r.Trigger, r.Action)
+		}
+	}
+
+	if r := p.ResponseRule(msg("a.example. A 192.0.2.1", "a.example. AAAA 2001:db9::1")); r != nil {
+		t.Errorf("expected no rule, got %s", r.Action)
+	}
+}
+
+func TestAnswer(t *testing.T) {
+	p := loadTestZone(t)
+	client := net.ParseIP("10.0.0.1")
+
+	r := p.QueryRule("garden.example.", client)
+	answer := r.Answer(dns.Question{Name: "garden.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	if len(answer) != 1 || answer[0].(*dns.A).A.String() != "192.0.2.80" {
+		t.Errorf("expected A 192.0.2.80, got %v", answer)
+	}
+	answer = r.Answer(dns.Question{Name: "garden.example.", Qtype: dns.TypeMX, Qclass: dns.ClassINET})
+	if len(answer) != 0 {
+		t.Errorf("expected no answer, got %v", answer)
+	}
+
+	r = p.QueryRule("walled.example.", client)
+	answer = r.Answer(dns.Question{Name: "walled.example.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET})
+	if len(answer) != 1 || answer[0].(*dns.CNAME).Target != "garden.example." {
+		t.Errorf("expected CNAME garden.example., got %v", answer)
+	}
+
+	r = p.QueryRule("www.rewrite.example.", client)
+	answer = r.Answer(dns.Question{Name: "www.rewrite.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	if len(answer) != 1 || answer[0].(*dns.CNAME).Target != "www.rewrite.example.walled.garden." {
+		t.Errorf("expected CNAME www.rewrite.example.walled.garden., got %v", answer)
+	}
+	if answer[0].Header().Name != "www.rewrite.example." {
+		t.Errorf("expected owner www.rewrite.example., got %s", answer[0].Header().Name)
+	}
+}
+
+func TestParseIPTrigger(t *testing.T) {
+	tests := map[string]string{
+		"32.1.2.0.192":           "192.0.2.1/32",
+		"24.0.2.0.192":           "192.0.2.0/24",
+		"128.1.zz.2.db8.2001":    "2001:db8:2::1/128",
+		"128.1.zz":               "::1/128",
+		"80.zz.3.2.1.db8.2001":   "2001:db8:1:2:3::/80",
+		"128.8.7.6.5.4.3.2.1":    "1:2:3:4:5:6:7:8/128",
+		"16.0.2.0.192.extra":     "",
+		"33.1.2.0.192":           "",
+		"x.1.2.0.192":            "",
+		"129.1.zz.2.db8.2001":    "",
+		"48.zz.zz.db8.2001.more": "",
+	}
+
+	for s, expected := range tests {
+		ipnet, err := parseIPTrigger(s)
+		if expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected error, got %s", s, ipnet)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", s, err)
+			continue
+		}
+		if ipnet.String() != expected {
+			t.Errorf("%s: expected %s, got %s", s, expected, ipnet)
+		}
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	var rrs []dns.RR
+	zp := dns.NewZoneParser(strings.NewReader(testZone), "rpz.local.", "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Skip("cannot listen on tcp port of the udp listener")
+	}
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc("rpz.local.", func(w dns.ResponseWriter, req *dns.Msg) {
+		if req.Question[0].Qtype == dns.TypeAXFR {
+			ch := make(chan *dns.Envelope, 1)
+			ch <- &dns.Envelope{RR: append(append([]dns.RR{}, rrs...), rrs[0])}
+			close(ch)
+			new(dns.Transfer).Out(w, req, ch)
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = rrs[:1]
+		w.WriteMsg(m)
+	})
+	udp := &dns.Server{PacketConn: pc, Handler: mux}
+	tcp := &dns.Server{Listener: l, Handler: mux}
+	go udp.ActivateAndServe()
+	go tcp.ActivateAndServe()
+	defer udp.Shutdown()
+	defer tcp.Shutdown()
+
+	zc := ZoneConfig{Name: "rpz.local", Primary: pc.LocalAddr().String()}
+	z, err := load(zc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if z.len() != 16 || z.serial != 7 {
+		t.Errorf("expected 16 rules with serial 7, got %d with serial %d", z.len(), z.serial)
+	}
+
+	// unchanged serial
+	if z2, err := load(zc, z); err != nil || z2 != z {
+		t.Errorf("expected unchanged zone, got %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package rpz
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+type netRule struct {
+	net  *net.IPNet
+	rule *Rule
+}
+
+type zone struct {
+	name        string
+	serial      uint32
+	names       map[string]*Rule // QNAME triggers, wildcards keep their "*." label
+	nsNames     map[string]*Rule // NSDNAME triggers
+	clientIPs   []netRule
+	responseIPs []netRule
+	nsIPs       []netRule
+
+	// file zones are only reparsed after a change
+	modTime time.Time
+	size    int64
+}
+
+func (z *zone) len() int {
+	return len(z.names) + len(z.nsNames) + len(z.clientIPs) + len(z.responseIPs) + len(z.nsIPs)
+}
+
+// parse builds the rules of the zone from its records. Entries that are
+// not valid triggers are logged and skipped.
+func parse(origin string, rrs []dns.RR) *zone {
+	z := &zone{
+		name:    origin,
+		names:   make(map[string]*Rule),
+		nsNames: make(map[string]*Rule),
+	}
+
+	owners := make(map[string][]dns.RR)
+	var order []string
+	for _, rr := range rrs {
+		owner := strings.ToLower(rr.Header().Name)
+		if owner == origin {
+			if soa, ok := rr.(*dns.SOA); ok {
+				z.serial = soa.Serial
+			}
+			continue
+		}
+		if !dns.IsSubDomain(origin, owner) {
+			log.Warnf("Policy zone %s: ignoring record outside of the zone: %s", origin, owner)
+			continue
+		}
+		if _, ok := owners[owner]; !ok {
+			order = append(order, owner)
+		}
+		owners[owner] = append(owners[owner], rr)
+	}
+
+	for _, owner := range order {
+		if err := z.add(strings.TrimSuffix(owner, "."+origin), owners[owner]); err != nil {
+			log.Warnf("Policy zone %s: ignoring %s: %s", origin, owner, err)
+		}
+	}
+	return z
+}
+
+// add adds the rule for the owner name relative to the zone origin
+func (z *zone) add(owner string, rrs []dns.RR) error {
+	var trigger Trigger
+	var prefix string
+	switch {
+	case strings.HasSuffix(owner, ".rpz-client-ip"):
+		trigger, prefix = ClientIP, strings.TrimSuffix(owner, ".rpz-client-ip")
+	case strings.HasSuffix(owner, ".rpz-ip"):
+		trigger, prefix = ResponseIP, strings.TrimSuffix(owner, ".rpz-ip")
+	case strings.HasSuffix(owner, ".rpz-nsip"):
+		trigger, prefix = NSIP, strings.TrimSuffix(owner, ".rpz-nsip")
+	case strings.HasSuffix(owner, ".rpz-nsdname"):
+		trigger, prefix = NSDName, strings.TrimSuffix(owner, ".rpz-nsdname")+"."
+	default:
+		trigger, prefix = QName, owner+"."
+	}
+
+	r := &Rule{Zone: z.name, Trigger: trigger, Action: LocalData}
+	if len(rrs) == 1 {
+		if cname, ok := rrs[0].(*dns.CNAME); ok {
+			switch target := strings.ToLower(cname.Target); target {
+			case ".":
+				r.Action = NXDomain
+			case "*.":
+				r.Action = NoData
+			case "rpz-passthru.", prefix:
+				// a CNAME to the trigger itself is the legacy passthru
+				r.Action = Passthru
+			case "rpz-drop.":
+				r.Action = Drop
+			case "rpz-tcp-only.":
+				r.Action = TCPOnly
+			}
+		}
+	}
+	if r.Action == LocalData {
+		r.Records = rrs
+	}
+
+	switch trigger {
+	case QName:
+		z.names[prefix] = r
+	case NSDName:
+		z.nsNames[prefix] = r
+	default:
+		ipnet, err := parseIPTrigger(prefix)
+		if err != nil {
+			return err
+		}
+		nr := netRule{net: ipnet, rule: r}
+		switch trigger {
+		case ClientIP:
+			z.clientIPs = append(z.clientIPs, nr)
+		case ResponseIP:
+			z.responseIPs = append(z.responseIPs, nr)
+		case NSIP:
+			z.nsIPs = append(z.nsIPs, nr)
+		}
+	}
+	return nil
+}
+
+// parseIPTrigger parses the network of an IP trigger, given as prefix
+// length followed by the address labels in reverse order. IPv6 addresses
+// use one label per 16 bit group and "zz" for "::", e.g.
+// 24.0.2.0.192 is 192.0.2.0/24 and 48.zz.db8.2001 is 2001:db8::/48.
+func parseIPTrigger(s string) (*net.IPNet, error) {
+	labels := strings.Split(s, ".")
+	if len(labels) < 2 {
+		return nil, fmt.Errorf("Invalid IP trigger")
+	}
+	bits, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid prefix length: %s", labels[0])
+	}
+
+	addr := make([]string, 0, len(labels)-1)
+	for i := len(labels) - 1; i > 0; i-- {
+		addr = append(addr, labels[i])
+	}
+
+	var ip net.IP
+	size := 32
+	if len(addr) == 4 && !strings.Contains(s, "zz") {
+		ip = net.ParseIP(strings.Join(addr, ".")).To4()
+	} else {
+		size = 128
+		for i, label := range addr {
+			if label == "zz" {
+				addr[i] = ""
+			}
+		}
+		v6 := strings.Join(addr, ":")
+		if strings.HasPrefix(v6, ":") {
+			v6 = ":" + v6
+		}
+		if strings.HasSuffix(v6, ":") {
+			v6 += ":"
+		}
+		ip = net.ParseIP(v6)
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid address in IP trigger")
+	}
+	if bits < 1 || bits > size {
+		return nil, fmt.Errorf("Invalid prefix length: %d", bits)
+	}
+	mask := net.CIDRMask(bits, size)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
+
+// matchName returns the rule for name, an exact match before the most
+// specific wildcard
+func matchName(rules map[string]*Rule, name string) *Rule {
+	if r, ok := rules[name]; ok {
+		return r
+	}
+	for {
+		i := strings.IndexByte(name, '.')
+		if i < 0 || i == len(name)-1 {
+			return nil
+		}
+		name = name[i+1:]
+		if r, ok := rules["*."+name]; ok {
+			return r
+		}
+	}
+}
+
+// matchIP returns the rule of the longest prefix containing ip
+func matchIP(rules []netRule, ip net.IP) *Rule {
+	var match *Rule
+	longest := -1
+	for _, nr := range rules {
+		if !nr.net.Contains(ip) {
+			continue
+		}
+		if ones, _ := nr.net.Mask.Size(); ones > longest {
+			match, longest = nr.rule, ones
+		}
+	}
+	return match
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ACL decides which clients are allowed by the longest prefix that
+// matches their address, so allow and deny entries can carve exceptions
+// out of each other. Without allow entries all clients that are not
+// denied are allowed.
+type ACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewACL parses the allow and deny lists of addresses and CIDR networks
+func NewACL(allow, deny []string) (*ACL, error) {
+	a := new(ACL)
+	var err error
+	if a.allow, err = parseNets(allow); err != nil {
+		return nil, err
+	}
+	if a.deny, err = parseNets(deny); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Allowed returns true if the client with address ip is allowed. Clients
+// with an unknown address are only allowed if the lists are empty.
+func (a *ACL) Allowed(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	if ip == nil {
+		return len(a.allow) == 0 && len(a.deny) == 0
+	}
+	allow := longestMatch(a.allow, ip)
+	deny := longestMatch(a.deny, ip)
+	if allow < 0 && deny < 0 {
+		return len(a.allow) == 0
+	}
+	return allow > deny
+}
+
+// Deny answers a query of a denied client with REFUSED, or not at all if
+// denied queries are dropped.
+func (s *server) Deny(w dns.ResponseWriter, m *dns.Msg) {
+	StatsRefusedCount.Inc(1)
+	if s.config.DenyAction == "drop" {
+		return
+	}
+	m.Rcode = dns.RcodeRefused
+	setEDE(m, dns.ExtendedErrorCodeProhibited, "")
+	writeMsg(w, m)
+}
+
+func longestMatch(nets []*net.IPNet, ip net.IP) int {
+	longest := -1
+	for _, n := range nets {
+		if n.Contains(ip) {
+			if ones, _ := n.Mask.Size(); ones > longest {
+				longest = ones
+			}
+		}
+	}
+	return longest
+}
+
+func parseNets(values []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid address: %s", value)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid network: %s", value)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
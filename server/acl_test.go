@@ -0,0 +1,64 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestACL(t *testing.T) {
+	tests := []struct {
+		allow, deny []string
+		allowed     map[string]bool
+	}{
+		{nil, nil, map[string]bool{"192.0.2.1": true, "2001:db8::1": true}},
+		{[]string{"192.0.2.0/24", "2001:db8::/32"}, nil, map[string]bool{
+			"192.0.2.1":    true,
+			"198.51.100.1": false,
+			"2001:db8::1":  true,
+			"2001:db9::1":  false,
+		}},
+		{nil, []string{"192.0.2.0/24", "198.51.100.7"}, map[string]bool{
+			"192.0.2.1":    false,
+			"198.51.100.1": true,
+			"198.51.100.7": false,
+			"2001:db8::1":  true,
+		}},
+		{[]string{"10.0.0.0/8", "10.1.2.3"}, []string{"10.1.0.0/16"}, map[string]bool{
+			"10.2.0.1":        true,
+			"10.1.0.1":        false,
+			"10.1.2.3":        true,
+			"192.0.2.1":       false,
+			"::ffff:10.2.0.1": true,
+		}},
+		{[]string{"192.0.2.0/24"}, []string{"192.0.2.0/24"}, map[string]bool{"192.0.2.1": false}},
+	}
+
+	for i, tc := range tests {
+		acl, err := NewACL(tc.allow, tc.deny)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		for ip, expected := range tc.allowed {
+			if allowed := acl.Allowed(net.ParseIP(ip)); allowed != expected {
+				t.Errorf("%d: expected %s allowed %t, got %t", i, ip, expected, allowed)
+			}
+		}
+	}
+
+	var acl *ACL
+	if !acl.Allowed(net.ParseIP("192.0.2.1")) {
+		t.Errorf("expected nil ACL to allow all clients")
+	}
+
+	for _, invalid := range []string{"192.0.2.0/33", "example.com", ""} {
+		if _, err := NewACL([]string{invalid}, nil); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// parseAddress parses an address override given as /domain[/domain]/address
+// and adds the address to each of the domains.
+func parseAddress(value string, domains map[string][]net.IP) error {
+	parts := strings.Split(value, "/")
+	if len(parts) < 3 || parts[0] != "" {
+		return fmt.Errorf("Invalid address override, expected /domain[/domain]/address: %s", value)
+	}
+	ip := net.ParseIP(strings.TrimSpace(parts[len(parts)-1]))
+	if ip == nil {
+		return fmt.Errorf("Invalid address in address override: %s", value)
+	}
+	for _, domain := range parts[1 : len(parts)-1] {
+		domain = dns.Fqdn(strings.ToLower(strings.TrimSpace(domain)))
+		if _, ok := dns.IsDomainName(domain); !ok || domain == "." {
+			return fmt.Errorf("Invalid domain in address override: %s", value)
+		}
+		domains[domain] = append(domains[domain], ip)
+	}
+	return nil
+}
+
+// addressOverride returns the most specific domain with address overrides
+// that name belongs to and its addresses.
+func (s *server) addressOverride(name string) (string, []net.IP) {
+	if len(s.config.AddressDomains) == 0 {
+		return "", nil
+	}
+	for domain := name; domain != ""; {
+		if ips, ok := s.config.AddressDomains[domain]; ok {
+			return domain, ips
+		}
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+	return "", nil
+}
+
+// AddressResponse turns m into the answer for a name under a domain with
+// address overrides. A and AAAA queries get the addresses of their family,
+// queries of any other type get an empty answer, never NXDOMAIN.
+func (s *server) AddressResponse(m *dns.Msg, q dns.Question, domain string, ips []net.IP) {
+	m.Authoritative = true
+	m.Rcode = dns.RcodeSuccess
+	for _, ip := range ips {
+		switch {
+		case ip.To4() != nil && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY):
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: s.config.HostsTtl},
+				A:   ip.To4(),
+			})
+		case ip.To4() == nil && (q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY):
+			m.Answer = append(m.Answer, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: s.config.HostsTtl},
+				AAAA: ip.To16(),
+			})
+		}
+	}
+	if len(m.Answer) == 0 {
+		m.Ns = []dns.RR{s.localSOA(domain)}
+		StatsNoDataCount.Inc(1)
+	}
+}
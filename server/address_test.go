@@ -0,0 +1,83 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestAddressOverrides(t *testing.T) {
+	config := &Config{
+		HostsTtl:  10,
+		Addresses: []string{"/dev.test/127.0.0.1", "/dev.test/::1", "/v4.dev.test/Other.Test/10.0.0.1"},
+	}
+	config.AddressDomains = make(map[string][]net.IP)
+	for _, value := range config.Addresses {
+		if err := parseAddress(value, config.AddressDomains); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &server{config: config}
+
+	tests := []struct {
+		name   string
+		qtype  uint16
+		domain string
+		answer []string
+	}{
+		{"dev.test.", dns.TypeA, "dev.test.", []string{"127.0.0.1"}},
+		{"a.b.c.dev.test.", dns.TypeAAAA, "dev.test.", []string{"::1"}},
+		{"a.dev.test.", dns.TypeANY, "dev.test.", []string{"127.0.0.1", "::1"}},
+		{"a.dev.test.", dns.TypeMX, "dev.test.", nil},
+		{"x.v4.dev.test.", dns.TypeA, "v4.dev.test.", []string{"10.0.0.1"}},
+		{"x.v4.dev.test.", dns.TypeAAAA, "v4.dev.test.", nil},
+		{"other.test.", dns.TypeA, "other.test.", []string{"10.0.0.1"}},
+		{"mydev.test.", dns.TypeA, "", nil},
+		{"test.", dns.TypeA, "", nil},
+	}
+	for _, tc := range tests {
+		domain, ips := s.addressOverride(tc.name)
+		if domain != tc.domain {
+			t.Errorf("%s: expected domain %q, got %q", tc.name, tc.domain, domain)
+			continue
+		}
+		if domain == "" {
+			continue
+		}
+		m := new(dns.Msg)
+		m.SetQuestion(tc.name, tc.qtype)
+		s.AddressResponse(m, m.Question[0], domain, ips)
+		if m.Rcode != dns.RcodeSuccess || len(m.Answer) != len(tc.answer) {
+			t.Errorf("%s %s: unexpected answer %v", tc.name, dns.TypeToString[tc.qtype], m.Answer)
+			continue
+		}
+		for i, rr := range m.Answer {
+			var ip net.IP
+			switch r := rr.(type) {
+			case *dns.A:
+				ip = r.A
+			case *dns.AAAA:
+				ip = r.AAAA
+			}
+			if ip.String() != tc.answer[i] {
+				t.Errorf("%s %s: expected %s, got %s", tc.name, dns.TypeToString[tc.qtype], tc.answer[i], rr)
+			}
+		}
+		if len(tc.answer) == 0 && len(m.Ns) != 1 {
+			t.Errorf("%s %s: expected an SOA in the authority section", tc.name, dns.TypeToString[tc.qtype])
+		}
+	}
+
+	for _, invalid := range []string{"dev.test/127.0.0.1", "/dev.test/", "/dev.test/localhost", "//127.0.0.1", "/127.0.0.1"} {
+		if err := parseAddress(invalid, make(map[string][]net.IP)); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// Alias translates the addresses of a network in upstream answers to the
+// network of the same size starting at To, keeping the host part. A single
+// address is replaced by To.
+type Alias struct {
+	From *net.IPNet
+	To   net.IP
+}
+
+// parseAlias parses an alias given as <address[/prefix]>=<address>
+func parseAlias(value string) (Alias, error) {
+	var a Alias
+	i := strings.IndexByte(value, '=')
+	if i < 0 {
+		return a, fmt.Errorf("Invalid alias, expected <address[/prefix]>=<address>: %s", value)
+	}
+	from, to := strings.TrimSpace(value[:i]), strings.TrimSpace(value[i+1:])
+
+	if a.To = net.ParseIP(to); a.To == nil {
+		return a, fmt.Errorf("Invalid address in alias: %s", to)
+	}
+	nets, err := parseNets([]string{from})
+	if err != nil {
+		return a, fmt.Errorf("Invalid alias: %s", err)
+	}
+	a.From = nets[0]
+	if (a.From.IP.To4() == nil) != (a.To.To4() == nil) {
+		return a, fmt.Errorf("Alias maps addresses of different families: %s", value)
+	}
+	return a, nil
+}
+
+// translate returns the address ip is mapped to and whether it is part of
+// the aliased network
+func (a Alias) translate(ip net.IP) (net.IP, bool) {
+	if !a.From.Contains(ip) {
+		return nil, false
+	}
+	to := a.To
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, to = ip4, to.To4()
+	} else {
+		to = to.To16()
+	}
+	mask := a.From.Mask
+	translated := make(net.IP, len(ip))
+	for i := range ip {
+		translated[i] = to[i]&mask[i] | ip[i]&^mask[i]
+	}
+	return translated, true
+}
+
+// doctor translates the addresses of the A and AAAA records in the answer
+// and additional sections of an upstream response according to the first
+// matching alias.
+func (s *server) doctor(r *dns.Msg) {
+	translate := func(ip net.IP, v4 bool) net.IP {
+		for _, a := range s.config.AliasRules {
+			// IPv4-mapped addresses of AAAA records are left alone
+			if (a.From.IP.To4() != nil) != v4 {
+				continue
+			}
+			if translated, ok := a.translate(ip); ok {
+				log.Debugf("[%d] Translating aliased address %s to %s", r.Id, ip, translated)
+				r.AuthenticatedData = false
+				return translated
+			}
+		}
+		return ip
+	}
+
+	for _, section := range [][]dns.RR{r.Answer, r.Extra} {
+		for _, rr := range section {
+			switch t := rr.(type) {
+			case *dns.A:
+				t.A = translate(t.A, true)
+			case *dns.AAAA:
+				t.AAAA = translate(t.AAAA, false)
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestAlias(t *testing.T) {
+	config := &Config{Aliases: []string{"203.0.113.7=10.0.0.7", "203.0.113.0/24=10.1.2.0", "2001:db8:1::/48=fd00:1::"}}
+	for _, value := range config.Aliases {
+		alias, err := parseAlias(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.AliasRules = append(config.AliasRules, alias)
+	}
+	s := &server{config: config}
+
+	r := new(dns.Msg)
+	for _, rr := range []string{
+		"a.example. 60 IN A 203.0.113.7",
+		"b.example. 60 IN A 203.0.113.42",
+		"c.example. 60 IN A 198.51.100.1",
+		"d.example. 60 IN AAAA 2001:db8:1:2::5",
+		"e.example. 60 IN AAAA 2001:db8:2::5",
+		"f.example. 60 IN AAAA ::ffff:203.0.113.7",
+	} {
+		a, err := dns.NewRR(rr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Answer = append(r.Answer, a)
+	}
+	glue, _ := dns.NewRR("ns.example. 60 IN A 203.0.113.53")
+	r.Extra = append(r.Extra, glue)
+
+	s.doctor(r)
+
+	expected := []string{"10.0.0.7", "10.1.2.42", "198.51.100.1", "fd00:1:0:2::5", "2001:db8:2::5", "203.0.113.7"}
+	for i, e := range expected {
+		var got string
+		switch t := r.Answer[i].(type) {
+		case *dns.A:
+			got = t.A.String()
+		case *dns.AAAA:
+			got = t.AAAA.String()
+		}
+		if got != e {
+			t.Errorf("%s: expected %s, got %s", r.Answer[i].Header().Name, e, got)
+		}
+	}
+	if ip := r.Extra[0].(*dns.A).A.String(); ip != "10.1.2.53" {
+		t.Errorf("expected glue 10.1.2.53, got %s", ip)
+	}
+	if _, err := r.Pack(); err != nil {
+		t.Errorf("expected the doctored response to pack, got %v", err)
+	}
+
+	for _, invalid := range []string{"203.0.113.7", "203.0.113.0/24=fd00::", "x=10.0.0.1", "10.0.0.1=y"} {
+		if _, err := parseAlias(invalid); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
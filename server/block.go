@@ -0,0 +1,33 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"github.com/miekg/dns"
+)
+
+// BlockedResponse turns m into the configured answer for a blocked name.
+// With addresses configured, A and AAAA queries are answered with the
+// addresses of their family and all other queries get an empty answer.
+func (s *server) BlockedResponse(m *dns.Msg, q dns.Question) {
+	setEDE(m, dns.ExtendedErrorCodeBlocked, "")
+	if s.config.BlockResponse == "" || s.config.BlockResponse == "nxdomain" {
+		m.Rcode = dns.RcodeNameError
+		return
+	}
+
+	m.Rcode = dns.RcodeSuccess
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: s.config.HostsTtl}
+	for _, ip := range s.config.BlockIPs {
+		switch {
+		case q.Qtype == dns.TypeA && ip.To4() != nil:
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip.To4()})
+		case q.Qtype == dns.TypeAAAA && ip.To4() == nil:
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip.To16()})
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/claranet/go-dnsmasq/blocklist"
+	"github.com/miekg/dns"
+)
+
+func newTestBlocklist(t *testing.T) *blocklist.Blocklist {
+	path := filepath.Join(t.TempDir(), "blocklist")
+	if err := os.WriteFile(path, []byte("0.0.0.0 ads.example.com\n@@||ok.ads.example.com^\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := blocklist.New(&blocklist.Config{Sources: []string{path}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestBlockedResponses(t *testing.T) {
+	b := newTestBlocklist(t)
+	tests := []struct {
+		response string
+		rcode    int
+		a, aaaa  string // answers, empty for none
+	}{
+		{"", dns.RcodeNameError, "", ""},
+		{"nxdomain", dns.RcodeNameError, "", ""},
+		{"nodata", dns.RcodeSuccess, "", ""},
+		{"null", dns.RcodeSuccess, "0.0.0.0", "::"},
+		{"192.0.2.7,2001:db8::7", dns.RcodeSuccess, "192.0.2.7", "2001:db8::7"},
+		{"192.0.2.7", dns.RcodeSuccess, "192.0.2.7", ""},
+	}
+	for _, tc := range tests {
+		upstream := newTestUpstream(t, nil)
+		config := &Config{Nameservers: []string{upstream.addr}, RCache: 100, BlockResponse: tc.response}
+		s := newTestServer(t, testHosts{}, config)
+		config.Blocklist = b
+
+		for _, name := range []string{"ads.example.com.", "Sub.Ads.Example.com."} {
+			for _, q := range []struct {
+				qtype  uint16
+				answer string
+			}{{dns.TypeA, tc.a}, {dns.TypeAAAA, tc.aaaa}, {dns.TypeMX, ""}} {
+				r := ask(s, name, q.qtype, false)
+				if r == nil || r.Rcode != tc.rcode {
+					t.Errorf("%q %s %s: expected %s, got %v", tc.response, name, dns.TypeToString[q.qtype], dns.RcodeToString[tc.rcode], r)
+					continue
+				}
+				var answer string
+				if len(r.Answer) == 1 {
+					switch rr := r.Answer[0].(type) {
+					case *dns.A:
+						answer = rr.A.String()
+					case *dns.AAAA:
+						answer = rr.AAAA.String()
+					}
+				}
+				if answer != q.answer || len(r.Answer) > 1 {
+					t.Errorf("%q %s %s: expected answer %q, got %v", tc.response, name, dns.TypeToString[q.qtype], q.answer, r.Answer)
+				}
+				if codes := extendedErrors(r); !slices.Equal(codes, []uint16{dns.ExtendedErrorCodeBlocked}) {
+					t.Errorf("%q %s %s: expected the Blocked extended error, got %v", tc.response, name, dns.TypeToString[q.qtype], codes)
+				}
+			}
+		}
+		if names := upstream.names(); len(names) > 0 {
+			t.Errorf("%q: expected no blocked queries upstream, got %v", tc.response, names)
+		}
+
+		// allowed subdomains and other names are resolved
+		for _, name := range []string{"ok.ads.example.com.", "notads.example.com.", "example.com."} {
+			if r := ask(s, name, dns.TypeA, false); r == nil || len(r.Answer) != 1 || len(extendedErrors(r)) > 0 {
+				t.Errorf("%q %s: expected the upstream answer, got %v", tc.response, name, r)
+			}
+		}
+	}
+}
+
+func TestBlockedCache(t *testing.T) {
+	upstream := newTestUpstream(t, nil)
+	config := &Config{Nameservers: []string{upstream.addr}, RCache: 100}
+	s := newTestServer(t, testHosts{}, config)
+
+	// answers cached before the name was blocked are not served
+	if r := ask(s, "ads.example.com.", dns.TypeA, false); r == nil || len(r.Answer) != 1 {
+		t.Fatalf("expected the upstream answer, got %v", r)
+	}
+	config.Blocklist = newTestBlocklist(t)
+	if r := ask(s, "ads.example.com.", dns.TypeA, false); r == nil || r.Rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN for the blocked name, got %v", r)
+	}
+
+	// and blocked responses are not cached
+	config.Blocklist = nil
+	if r := ask(s, "ads.example.com.", dns.TypeA, false); r == nil || len(r.Answer) != 1 {
+		t.Errorf("expected the cached answer once the name is no longer blocked, got %v", r)
+	}
+	if names := upstream.names(); len(names) != 1 {
+		t.Errorf("expected one query upstream, got %v", names)
+	}
+}
@@ -7,11 +7,14 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"strings"
 	"time"
 
+	"github.com/claranet/go-dnsmasq/dnssec"
+	"github.com/claranet/go-dnsmasq/rpz"
 	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
@@ -29,6 +32,8 @@ type Config struct {
 	SearchDomains []string `json:"search_domains,omitempty"`
 	// Replicates GNU libc's use of /etc/resolv.conf search domains
 	EnableSearch bool `json:"append_domain,omitempty"`
+	// Domains answered from local data only, never forwarded
+	LocalDomains []string `json:"local_domains,omitempty"`
 	// Path to the hostfile
 	Hostsfile string `json:"hostfile,omitempty"`
 	// Hostfile Polling
@@ -61,8 +66,118 @@ type Config struct {
 	// How many dots a name must have before we do an initial absolute query. Defaults to 1.
 	Ndots int `json:"ndots,omitempty"`
 
+	// Clients allowed to query, as addresses or CIDR networks. Empty allows all clients.
+	AllowClients []string `json:"allow_clients,omitempty"`
+	// Clients denied to query
+	DenyClients []string `json:"deny_clients,omitempty"`
+	// Clients allowed to have their queries forwarded. Empty allows all clients.
+	AllowRecursion []string `json:"allow_recursion,omitempty"`
+	// Clients only answered from local data
+	DenyRecursion []string `json:"deny_recursion,omitempty"`
+	// Answer to denied queries: refused or drop
+	DenyAction string `json:"deny_action,omitempty"`
+
+	// Remove private, loopback and link-local addresses from upstream answers
+	StopRebind bool `json:"stop_rebind,omitempty"`
+	// Domains allowed to resolve to private addresses
+	RebindDomainsOK []string `json:"rebind_domains_ok,omitempty"`
+	// Answer to rebinding responses: strip the addresses or refused
+	RebindAction string `json:"rebind_action,omitempty"`
+
+	// Rules resolving other names instead of the query name, as
+	// <exact|suffix|regex> <from> <to>. The first match applies.
+	Rewrites []string `json:"rewrites,omitempty"`
+	// Answer to rewritten queries: cname or flatten
+	RewriteAnswer string `json:"rewrite_answer,omitempty"`
+
+	// Addresses returned for whole domains and all their subdomains, as
+	// /domain[/domain]/address
+	Addresses []string `json:"addresses,omitempty"`
+
+	// Address translations for upstream answers as <address[/prefix]>=<address>
+	Aliases []string `json:"aliases,omitempty"`
+
+	// Rules for query types as <type>[/udp|/tcp]=<action>, the first match applies
+	QtypePolicy []string `json:"qtype_policy,omitempty"`
+	// Answer to ANY queries: forward, minimal, hinfo or refuse
+	AnyResponse string `json:"any_response,omitempty"`
+
+	// UDP responses per second to a client network, 0 disables rate limiting
+	RateLimit int `json:"rate_limit,omitempty"`
+	// Responses a client network may get in a burst above the rate
+	RateLimitBurst int `json:"rate_limit_burst,omitempty"`
+	// Every n-th limited response is sent truncated instead of dropped, 0 drops all
+	RateLimitSlip int `json:"rate_limit_slip,omitempty"`
+	// Prefix lengths grouping clients into networks
+	RateLimitIPv4Prefix int `json:"rate_limit_ipv4_prefix,omitempty"`
+	RateLimitIPv6Prefix int `json:"rate_limit_ipv6_prefix,omitempty"`
+	// Limit each query name and type of a client network separately
+	RateLimitPerName bool `json:"rate_limit_per_name,omitempty"`
+	// Clients that are never rate limited, as addresses or CIDR networks
+	RateLimitExempt []string `json:"rate_limit_exempt,omitempty"`
+
+	// EDNS client subnet on forwarded queries: forward, add, replace or strip
+	ECS string `json:"ecs,omitempty"`
+	// Source prefix lengths of client subnets sent upstream
+	ECSIPv4Prefix int `json:"ecs_ipv4_prefix,omitempty"`
+	ECSIPv6Prefix int `json:"ecs_ipv6_prefix,omitempty"`
+
+	// UDP buffer size advertised to clients and upstreams
+	EDNSBufferSize int `json:"edns_buffer_size,omitempty"`
+	// Seconds a TCP connection to an upstream is kept open without queries
+	TCPIdleTimeout int `json:"tcp_idle_timeout,omitempty"`
+
+	// Answer DNS cookies of clients and send cookies to upstreams (RFC 7873)
+	Cookies bool `json:"cookies,omitempty"`
+	// Hex encoded secrets of server cookies, the first issues them. Random
+	// secrets replaced hourly if empty.
+	CookieSecrets []string `json:"cookie_secrets,omitempty"`
+	// Answer UDP queries without a valid server cookie with BADCOOKIE, or
+	// truncated if they have no cookie at all
+	RequireCookie bool `json:"require_cookie,omitempty"`
+	// Send UDP queries upstream with the query name in random case and
+	// require responses to echo it (DNS 0x20)
+	RandomizeCase bool `json:"randomize_case,omitempty"`
+
+	// Validate upstream answers with DNSSEC
+	DNSSEC bool `json:"dnssec,omitempty"`
+	// File keeping the state of the root trust anchors across key rollovers
+	TrustAnchorFile string `json:"trust_anchor_file,omitempty"`
+	// Answer names that cached validated NSEC and NSEC3 records prove not to
+	// exist without forwarding (RFC 8198)
+	AggressiveNsec bool `json:"aggressive_nsec,omitempty"`
+
+	// Response to blocked names: nxdomain, nodata, null or comma separated IP addresses
+	BlockResponse string `json:"block_response,omitempty"`
+
 	Verbose bool `json:"-"`
 
+	// Access control lists, derived from the allow and deny lists
+	ClientACL    *ACL `json:"-"`
+	RecursionACL *ACL `json:"-"`
+
+	// Rewrite rules, derived from Rewrites
+	RewriteRules []*RewriteRule `json:"-"`
+	// Address overrides by domain, derived from Addresses
+	AddressDomains map[string][]net.IP `json:"-"`
+	// Address translations, derived from Aliases
+	AliasRules []Alias `json:"-"`
+	// Query type rules, derived from QtypePolicy
+	QtypeRules []QtypeRule `json:"-"`
+	// Networks never rate limited, derived from RateLimitExempt
+	RateLimitExemptNets []*net.IPNet `json:"-"`
+
+	// Names answered with BlockResponse instead of being resolved
+	Blocklist Blocklist `json:"-"`
+	// Addresses returned for blocked names, derived from BlockResponse
+	BlockIPs []net.IP `json:"-"`
+	// Response policy zones applied to queries and upstream responses
+	RPZ *rpz.Policy `json:"-"`
+	// Root trust anchors, loaded from TrustAnchorFile
+	TrustAnchors *dnssec.Anchors `json:"-"`
+	// Server cookie secrets, derived from CookieSecrets
+	CookieSecretKeys [][]byte `json:"-"`
+
 	// Stub zones support. Map contains domainname -> nameserver:port
 	Stub *map[string][]string
 }
@@ -95,34 +210,187 @@ func ResolvConf(config *Config, ctx *cli.Context) error {
 	return nil
 }
 
+// CheckConfig validates config and sets the fields derived from it. All
+// problems found are returned, joined into one error.
 func CheckConfig(config *Config) error {
+	var errs []error
 	if config.DnsAddr == "" {
-		return fmt.Errorf("'listen' cannot be empty")
+		errs = append(errs, fmt.Errorf("'listen' cannot be empty"))
 	}
 	if !config.NoRec && len(config.Nameservers) == 0 {
-		return fmt.Errorf("Recursion is enabled but no nameservers are configured")
+		errs = append(errs, fmt.Errorf("Recursion is enabled but no nameservers are configured"))
 	}
 	if config.EnableSearch && len(config.SearchDomains) == 0 {
 		config.EnableSearch = false
 		log.Warnf("No search domains configured, disabling search.")
 	}
 	if config.RCache < 0 {
-		return fmt.Errorf("'rcache' must be equal or greater than 0")
+		errs = append(errs, fmt.Errorf("'rcache' must be equal or greater than 0"))
 	}
 	if config.RCacheTtl <= 0 {
-		return fmt.Errorf("'rcache-ttl' must be greater than 0")
+		errs = append(errs, fmt.Errorf("'rcache-ttl' must be greater than 0"))
 	}
 	if config.RStaleTtl < 0 {
-		return fmt.Errorf("'rstale-ttl' must be equal or greater than 0")
+		errs = append(errs, fmt.Errorf("'rstale-ttl' must be equal or greater than 0"))
 	}
 	if config.RCacheTtlMax < 0 {
-		return fmt.Errorf("'rcache-ttl-max' must be equal or greater than 0")
+		errs = append(errs, fmt.Errorf("'rcache-ttl-max' must be equal or greater than 0"))
 	}
 	if config.Ndots <= 0 {
-		return fmt.Errorf("'ndots' must be greater than 0")
+		errs = append(errs, fmt.Errorf("'ndots' must be greater than 0"))
 	}
 	if config.FwdNdots < 0 {
-		return fmt.Errorf("'fwd-ndots' must be equal or greater than 0")
+		errs = append(errs, fmt.Errorf("'fwd-ndots' must be equal or greater than 0"))
+	}
+
+	var err error
+	if config.ClientACL, err = NewACL(config.AllowClients, config.DenyClients); err != nil {
+		errs = append(errs, fmt.Errorf("Invalid client access list: %s", err))
+	}
+	if config.RecursionACL, err = NewACL(config.AllowRecursion, config.DenyRecursion); err != nil {
+		errs = append(errs, fmt.Errorf("Invalid recursion access list: %s", err))
+	}
+	switch config.DenyAction {
+	case "", "refused", "drop":
+	default:
+		errs = append(errs, fmt.Errorf("'deny-action' must be refused or drop: %s", config.DenyAction))
+	}
+
+	switch config.RebindAction {
+	case "", "strip", "refused":
+	default:
+		errs = append(errs, fmt.Errorf("'rebind-action' must be strip or refused: %s", config.RebindAction))
+	}
+
+	config.RewriteRules = nil
+	for _, value := range config.Rewrites {
+		rule, err := parseRewriteRule(value)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		config.RewriteRules = append(config.RewriteRules, rule)
+	}
+	switch config.RewriteAnswer {
+	case "", "cname", "flatten":
+	default:
+		errs = append(errs, fmt.Errorf("'rewrite-answer' must be cname or flatten: %s", config.RewriteAnswer))
+	}
+
+	config.AddressDomains = make(map[string][]net.IP)
+	for _, value := range config.Addresses {
+		if err := parseAddress(value, config.AddressDomains); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	config.AliasRules = nil
+	for _, value := range config.Aliases {
+		alias, err := parseAlias(value)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		config.AliasRules = append(config.AliasRules, alias)
+	}
+
+	config.QtypeRules = nil
+	for _, value := range config.QtypePolicy {
+		rule, err := parseQtypeRule(value)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		config.QtypeRules = append(config.QtypeRules, rule)
+	}
+	switch config.AnyResponse {
+	case "", "forward", "minimal", "hinfo", "refuse":
+	default:
+		errs = append(errs, fmt.Errorf("'any-response' must be forward, minimal, hinfo or refuse: %s", config.AnyResponse))
+	}
+
+	if config.RateLimit < 0 {
+		errs = append(errs, fmt.Errorf("'ratelimit' must be equal or greater than 0"))
+	}
+	if config.RateLimit > 0 {
+		if config.RateLimitBurst < 0 {
+			errs = append(errs, fmt.Errorf("'ratelimit-burst' must be equal or greater than 0"))
+		}
+		if config.RateLimitBurst == 0 {
+			config.RateLimitBurst = config.RateLimit
+		}
+		if config.RateLimitSlip < 0 {
+			errs = append(errs, fmt.Errorf("'ratelimit-slip' must be equal or greater than 0"))
+		}
+		if config.RateLimitIPv4Prefix < 0 || config.RateLimitIPv4Prefix > 32 {
+			errs = append(errs, fmt.Errorf("'ratelimit-ipv4-prefix' must be between 0 and 32"))
+		}
+		if config.RateLimitIPv6Prefix < 0 || config.RateLimitIPv6Prefix > 128 {
+			errs = append(errs, fmt.Errorf("'ratelimit-ipv6-prefix' must be between 0 and 128"))
+		}
+		if config.RateLimitExemptNets, err = parseNets(config.RateLimitExempt); err != nil {
+			errs = append(errs, fmt.Errorf("Invalid rate limit exemption: %s", err))
+		}
+	}
+
+	switch config.ECS {
+	case "", "forward", "add", "replace", "strip":
+	default:
+		errs = append(errs, fmt.Errorf("'ecs' must be forward, add, replace or strip: %s", config.ECS))
+	}
+	if config.ECSIPv4Prefix < 0 || config.ECSIPv4Prefix > 32 {
+		errs = append(errs, fmt.Errorf("'ecs-ipv4-prefix' must be between 0 and 32"))
+	}
+	if config.ECSIPv6Prefix < 0 || config.ECSIPv6Prefix > 128 {
+		errs = append(errs, fmt.Errorf("'ecs-ipv6-prefix' must be between 0 and 128"))
+	}
+
+	if config.EDNSBufferSize == 0 {
+		config.EDNSBufferSize = defaultEDNSBufferSize
+	}
+	if config.EDNSBufferSize < 512 || config.EDNSBufferSize > dns.MaxMsgSize {
+		errs = append(errs, fmt.Errorf("'edns-buffer-size' must be between 512 and 65535"))
+	}
+	if config.TCPIdleTimeout == 0 {
+		config.TCPIdleTimeout = defaultTCPIdleTimeout
+	}
+	if config.TCPIdleTimeout < 0 {
+		errs = append(errs, fmt.Errorf("'tcp-idle-timeout' must be greater than 0"))
+	}
+
+	config.CookieSecretKeys = nil
+	for _, value := range config.CookieSecrets {
+		secret, err := parseCookieSecret(value)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		config.CookieSecretKeys = append(config.CookieSecretKeys, secret)
+	}
+	if config.RequireCookie && !config.Cookies {
+		errs = append(errs, fmt.Errorf("'require-cookie' needs 'cookies'"))
+	}
+
+	if config.DNSSEC {
+		if config.TrustAnchors, err = dnssec.LoadAnchors(config.TrustAnchorFile); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	switch config.BlockResponse {
+	case "", "nxdomain", "nodata":
+	case "null":
+		config.BlockIPs = []net.IP{net.IPv4zero, net.IPv6zero}
+	default:
+		config.BlockIPs = nil
+		for _, addr := range strings.Split(config.BlockResponse, ",") {
+			ip := net.ParseIP(strings.TrimSpace(addr))
+			if ip == nil {
+				errs = append(errs, fmt.Errorf("'block-response' must be nxdomain, nodata, null or IP addresses: %s", config.BlockResponse))
+				break
+			}
+			config.BlockIPs = append(config.BlockIPs, ip)
+		}
 	}
 
 	// Set defaults
@@ -131,7 +399,7 @@ func CheckConfig(config *Config) error {
 
 	stubmap := make(map[string][]string)
 	config.Stub = &stubmap
-	return nil
+	return errors.Join(errs...)
 }
 
 func appendDomain(s1, s2 string) string {
@@ -0,0 +1,211 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNS cookies (RFC 7873) let servers recognize queries from clients they
+// answered before, and clients responses from servers they queried, so
+// that spoofed source addresses do not get far.
+
+const (
+	clientCookieLen = 8
+	// Server cookies have the layout of RFC 9018: version, three reserved
+	// bytes, a timestamp and a hash, here an HMAC-SHA256 of the client cookie,
+	// these fields and the client address truncated to 8 bytes
+	serverCookieLen = 16
+	cookieSecretLen = 16
+
+	cookieRotation = time.Hour        // random secrets are replaced this often
+	cookieLifetime = time.Hour        // older server cookies are invalid
+	cookieRenewal  = 30 * time.Minute // older server cookies are replaced
+	cookieSkew     = 5 * time.Minute  // tolerated clock skew of other instances
+)
+
+type cookieState int
+
+const (
+	cookieNone      cookieState = iota // no cookie option
+	cookieMalformed                    // to be answered with FORMERR
+	cookieMissing                      // client cookie only, or invalid server cookie
+	cookieValid
+)
+
+type cookies struct {
+	sync.Mutex
+	secrets [][]byte  // the first issues server cookies, all are accepted
+	rotated time.Time // zero if the secrets are configured
+	client  []byte    // secret our client cookies are derived from
+	// Server cookies of upstreams by address
+	upstreams map[string][]byte
+}
+
+func newCookies(config *Config) *cookies {
+	c := &cookies{
+		secrets:   config.CookieSecretKeys,
+		client:    randomSecret(),
+		upstreams: make(map[string][]byte),
+	}
+	if len(c.secrets) == 0 {
+		c.secrets = [][]byte{randomSecret()}
+		c.rotated = time.Now()
+	}
+	return c
+}
+
+func randomSecret() []byte {
+	secret := make([]byte, cookieSecretLen)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+// parseCookieSecret decodes a hex encoded secret
+func parseCookieSecret(s string) ([]byte, error) {
+	secret, err := hex.DecodeString(s)
+	if err != nil || len(secret) != cookieSecretLen {
+		return nil, fmt.Errorf("Cookie secret must be %d hex encoded bytes: %s", cookieSecretLen, s)
+	}
+	return secret, nil
+}
+
+// keys returns the server secrets, replacing random ones when they are due.
+// The previous secret is accepted as long as its cookies are valid.
+func (c *cookies) keys(now time.Time) [][]byte {
+	c.Lock()
+	defer c.Unlock()
+	if !c.rotated.IsZero() && now.Sub(c.rotated) >= cookieRotation {
+		c.secrets = [][]byte{randomSecret(), c.secrets[0]}
+		c.rotated = now
+	}
+	return c.secrets
+}
+
+// cookieOption returns the cookie option of a message, nil if there is none
+func cookieOption(m *dns.Msg) *dns.EDNS0_COOKIE {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, e := range opt.Option {
+		if cookie, ok := e.(*dns.EDNS0_COOKIE); ok {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// check validates the cookie of a request from ip and returns the cookie to
+// answer with, the client cookie and a new or the still fresh server cookie
+func (c *cookies) check(req *dns.Msg, ip net.IP) (string, cookieState) {
+	option := cookieOption(req)
+	if option == nil {
+		return "", cookieNone
+	}
+	cookie, err := hex.DecodeString(option.Cookie)
+	// Server cookies have 8 to 32 bytes (RFC 7873 section 5.2.2)
+	if err != nil || len(cookie) != clientCookieLen && (len(cookie) < clientCookieLen+8 || len(cookie) > clientCookieLen+32) {
+		return "", cookieMalformed
+	}
+	clientCookie := cookie[:clientCookieLen]
+	now := time.Now()
+	keys := c.keys(now)
+
+	if len(cookie) == clientCookieLen+serverCookieLen && cookie[clientCookieLen] == 1 {
+		stamp := time.Unix(int64(binary.BigEndian.Uint32(cookie[clientCookieLen+4:])), 0)
+		age := now.Sub(stamp)
+		if age < cookieLifetime && age > -cookieSkew {
+			for _, key := range keys {
+				if hmac.Equal(cookie[clientCookieLen:], serverCookie(key, clientCookie, stamp, ip)) {
+					if age > cookieRenewal {
+						cookie = append(clientCookie, serverCookie(keys[0], clientCookie, now, ip)...)
+					}
+					return hex.EncodeToString(cookie), cookieValid
+				}
+			}
+		}
+	}
+	cookie = append(clientCookie, serverCookie(keys[0], clientCookie, now, ip)...)
+	return hex.EncodeToString(cookie), cookieMissing
+}
+
+// serverCookie returns the server cookie of a client issued at stamp
+func serverCookie(key, clientCookie []byte, stamp time.Time, ip net.IP) []byte {
+	cookie := make([]byte, 8, serverCookieLen)
+	cookie[0] = 1 // version
+	binary.BigEndian.PutUint32(cookie[4:], uint32(stamp.Unix()))
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(clientCookie)
+	mac.Write(cookie)
+	mac.Write(ip)
+	return mac.Sum(cookie)[:serverCookieLen]
+}
+
+// clientCookie returns our client cookie for an upstream
+func (c *cookies) clientCookie(ns string) []byte {
+	mac := hmac.New(sha256.New, c.client)
+	mac.Write([]byte(ns))
+	return mac.Sum(nil)[:clientCookieLen]
+}
+
+// request returns a copy of req to send to the upstream ns with our client
+// cookie and the last server cookie it sent us
+func (c *cookies) request(req *dns.Msg, ns string) *dns.Msg {
+	cookie := c.clientCookie(ns)
+	c.Lock()
+	cookie = append(cookie, c.upstreams[ns]...)
+	c.Unlock()
+
+	o := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	if opt := req.IsEdns0(); opt != nil {
+		o = dns.Copy(opt).(*dns.OPT)
+	}
+	o.Option = append(o.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: hex.EncodeToString(cookie)})
+
+	// shallow copy, only the OPT record differs
+	r := *req
+	r.Extra = append(withoutOPT(req.Extra), o)
+	return &r
+}
+
+// response remembers the server cookie of a response from the upstream ns.
+// Responses that do not echo our client cookie are rejected as spoofed,
+// upstreams that do not support cookies send none.
+func (c *cookies) response(r *dns.Msg, ns string) error {
+	option := cookieOption(r)
+	if option == nil {
+		return nil
+	}
+	cookie, err := hex.DecodeString(option.Cookie)
+	if err != nil || len(cookie) < clientCookieLen || !bytes.Equal(cookie[:clientCookieLen], c.clientCookie(ns)) {
+		return fmt.Errorf("response from %s without our client cookie", ns)
+	}
+	if len(cookie) > clientCookieLen {
+		c.Lock()
+		c.upstreams[ns] = cookie[clientCookieLen:]
+		c.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func cookieQuery(cookie string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.SetEdns0(1232, false)
+	if cookie != "" {
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	}
+	return m
+}
+
+func TestServerCookie(t *testing.T) {
+	c := newCookies(&Config{})
+	ip := net.ParseIP("192.0.2.1")
+	clientCookie := "0102030405060708"
+
+	if _, state := c.check(cookieQuery(""), ip); state != cookieNone {
+		t.Errorf("expected no cookie, got %d", state)
+	}
+	for _, cookie := range []string{"01020304", clientCookie + "0102", clientCookie + hex.EncodeToString(make([]byte, 33))} {
+		if _, state := c.check(cookieQuery(cookie), ip); state != cookieMalformed {
+			t.Errorf("%s: expected malformed cookie, got %d", cookie, state)
+		}
+	}
+
+	cookie, state := c.check(cookieQuery(clientCookie), ip)
+	if state != cookieMissing || len(cookie) != 2*(clientCookieLen+serverCookieLen) || cookie[:16] != clientCookie {
+		t.Fatalf("expected a new server cookie, got %s %d", cookie, state)
+	}
+	if again, state := c.check(cookieQuery(cookie), ip); state != cookieValid || again != cookie {
+		t.Errorf("expected the server cookie to be valid, got %s %d", again, state)
+	}
+	if _, state := c.check(cookieQuery(cookie), net.ParseIP("192.0.2.2")); state != cookieMissing {
+		t.Errorf("expected the server cookie of another client to be invalid, got %d", state)
+	}
+	if _, state := c.check(cookieQuery("ff"+cookie[2:]), ip); state != cookieMissing {
+		t.Errorf("expected the server cookie of another client cookie to be invalid, got %d", state)
+	}
+
+	// old cookies are renewed, expired ones invalid
+	raw, _ := hex.DecodeString(clientCookie)
+	for _, tc := range []struct {
+		age   time.Duration
+		state cookieState
+		same  bool
+	}{
+		{10 * time.Minute, cookieValid, true},
+		{40 * time.Minute, cookieValid, false},
+		{2 * time.Hour, cookieMissing, false},
+		{-time.Hour, cookieMissing, false},
+	} {
+		old := hex.EncodeToString(append(raw, serverCookie(c.secrets[0], raw, time.Now().Add(-tc.age), ip)...))
+		cookie, state := c.check(cookieQuery(old), ip)
+		if state != tc.state || (cookie == old) != tc.same {
+			t.Errorf("%s old cookie: expected state %d and same cookie %t, got %d %t", tc.age, tc.state, tc.same, state, cookie == old)
+		}
+	}
+
+	// cookies of the previous secret are accepted after a rotation
+	c.rotated = c.rotated.Add(-cookieRotation)
+	if _, state := c.check(cookieQuery(cookie), ip); state != cookieValid {
+		t.Errorf("expected the server cookie to be valid after a rotation, got %d", state)
+	}
+	if len(c.secrets) != 2 {
+		t.Errorf("expected a new secret, got %d secrets", len(c.secrets))
+	}
+	c.rotated = c.rotated.Add(-cookieRotation)
+	if _, state := c.check(cookieQuery(cookie), ip); state != cookieMissing {
+		t.Errorf("expected the server cookie to be invalid after two rotations, got %d", state)
+	}
+}
+
+func TestConfiguredCookieSecrets(t *testing.T) {
+	config := &Config{DnsAddr: "127.0.0.1:53", NoRec: true, RCacheTtl: 60, Ndots: 1, Cookies: true,
+		CookieSecrets: []string{"000102030405060708090a0b0c0d0e0f", "0f0e0d0c0b0a09080706050403020100"}}
+	if err := CheckConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	ip := net.ParseIP("2001:db8::1")
+	raw, _ := hex.DecodeString("0102030405060708")
+
+	// instances sharing the secrets accept each other's cookies
+	for _, key := range config.CookieSecretKeys {
+		cookie := hex.EncodeToString(append(raw, serverCookie(key, raw, time.Now(), ip)...))
+		if _, state := newCookies(config).check(cookieQuery(cookie), ip); state != cookieValid {
+			t.Errorf("expected a cookie of secret %x to be valid, got %d", key, state)
+		}
+	}
+	// and the first secret issues them
+	cookie, _ := newCookies(config).check(cookieQuery("0102030405060708"), ip)
+	server, _ := hex.DecodeString(cookie[16:])
+	stamp := time.Unix(int64(binary.BigEndian.Uint32(server[4:])), 0)
+	if cookie[16:] != hex.EncodeToString(serverCookie(config.CookieSecretKeys[0], raw, stamp, ip)) {
+		t.Errorf("expected a cookie of the first secret, got %s", cookie)
+	}
+
+	config.CookieSecrets = []string{"0102"}
+	if err := CheckConfig(config); err == nil {
+		t.Error("expected a short secret to be rejected")
+	}
+}
+
+func TestUpstreamCookie(t *testing.T) {
+	c := newCookies(&Config{})
+	ns := "192.0.2.53:53"
+	req := cookieQuery("")
+
+	first := c.request(req, ns)
+	option := cookieOption(first)
+	if option == nil || len(option.Cookie) != 2*clientCookieLen {
+		t.Fatalf("expected a client cookie, got %v", first.Extra)
+	}
+	if cookieOption(req) != nil {
+		t.Error("the request was changed")
+	}
+	if other := cookieOption(c.request(req, "192.0.2.54:53")); other.Cookie == option.Cookie {
+		t.Error("expected another client cookie for another upstream")
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(first)
+	if err := c.response(resp, ns); err != nil {
+		t.Errorf("expected responses without cookies to be accepted, got %v", err)
+	}
+	resp.Extra = cookieQuery(option.Cookie + "a1a2a3a4a5a6a7a8").Extra
+	if err := c.response(resp, ns); err != nil {
+		t.Errorf("expected our client cookie to be accepted, got %v", err)
+	}
+	if cookie := cookieOption(c.request(req, ns)).Cookie; cookie != option.Cookie+"a1a2a3a4a5a6a7a8" {
+		t.Errorf("expected the server cookie to be sent back, got %s", cookie)
+	}
+
+	resp.Extra = cookieQuery("0102030405060708a1a2a3a4a5a6a7a8").Extra
+	if err := c.response(resp, ns); err == nil {
+		t.Error("expected a response without our client cookie to be rejected")
+	}
+}
+
+func TestEDNSWriterCookie(t *testing.T) {
+	resp := new(dns.Msg)
+	resp.SetQuestion("example.com.", dns.TypeA)
+	resp.Response = true
+	// the upstream's cookie is not for the client
+	resp.Extra = cookieQuery("1111111111111111a1a2a3a4a5a6a7a8").Extra
+
+	req := cookieQuery("0102030405060708")
+	rw := &recordingWriter{addr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+	cookie := "0102030405060708" + "01000000b1b2b3b4b1b2b3b4b5b6b7b8"
+	(&ednsWriter{ResponseWriter: rw, req: req, size: 1232, bufsize: 1232, cookie: cookie}).WriteMsg(resp)
+
+	if option := cookieOption(rw.msg); option == nil || option.Cookie != cookie {
+		t.Errorf("expected our cookie, got %v", rw.msg.Extra)
+	}
+}
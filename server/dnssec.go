@@ -0,0 +1,154 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/claranet/go-dnsmasq/cache"
+	"github.com/claranet/go-dnsmasq/dnssec"
+)
+
+// validate checks an upstream response to a request sent with the DO bit.
+// Secure responses get the AD bit, bogus ones are answered with SERVFAIL.
+// Clients that disabled checking get the response as is.
+func (s *server) validate(req, r *dns.Msg) *dns.Msg {
+	if req.CheckingDisabled {
+		return r
+	}
+	// Truncated responses are validated when the client retries over TCP
+	if r.Truncated {
+		r.AuthenticatedData = false
+		return r
+	}
+
+	switch result := s.validator.Validate(r); result {
+	case dnssec.Secure:
+		StatsDnssecSecure.Inc(1)
+		r.AuthenticatedData = true
+	case dnssec.Insecure:
+		r.AuthenticatedData = false
+	default:
+		q := req.Question[0]
+		log.Infof("[%d] DNSSEC validation of '%s %s' failed: %s", req.Id, q.Name, dns.TypeToString[q.Qtype], result)
+		StatsDnssecBogus.Inc(1)
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeServerFailure)
+		m.RecursionAvailable = true
+		if result == dnssec.Indeterminate {
+			setEDE(m, dns.ExtendedErrorCodeDNSSECIndeterminate, "")
+		} else {
+			setEDE(m, dns.ExtendedErrorCodeDNSBogus, "")
+		}
+		return m
+	}
+	return r
+}
+
+// dnssecExchange resolves the DNSKEY and DS records the validator needs
+// through the upstreams of the name.
+func (s *server) dnssecExchange(name string, qtype uint16) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.SetEdns0(uint16(s.config.EDNSBufferSize), true)
+	req.CheckingDisabled = true
+
+	nservers, _ := s.upstreams(name)
+	err := fmt.Errorf("no nameservers configured")
+	for _, ns := range nservers {
+		var r *dns.Msg
+		r, err = s.exchange(req, ns, false)
+		if err == nil && r.Truncated {
+			r, err = s.exchange(req, ns, true)
+		}
+		if err == nil {
+			return r, nil
+		}
+		log.Debugf("Failed to query upstream %s for '%s %s': %v", ns, name, dns.TypeToString[qtype], err)
+	}
+	return nil, err
+}
+
+// validation returns the validation state a response to req is cached with.
+// Responses to clients that disabled checking are not validated, SERVFAIL
+// responses to the others may stem from failed validations.
+func (s *server) validation(req, resp *dns.Msg) cache.Validation {
+	switch {
+	case s.validator == nil || req.CheckingDisabled:
+		return cache.Unvalidated
+	case resp.AuthenticatedData:
+		return cache.Secure
+	case resp.Rcode == dns.RcodeServerFailure:
+		return cache.Bogus
+	}
+	return cache.Insecure
+}
+
+// usable returns true if a cached response with the validation state may be
+// returned to the client of req: validated responses for checking clients,
+// anything but failed validations for the others.
+func (s *server) usable(req *dns.Msg, v cache.Validation) bool {
+	switch {
+	case s.validator == nil:
+		return true
+	case req.CheckingDisabled:
+		return v != cache.Bogus
+	}
+	return v != cache.Unvalidated
+}
+
+// trusted returns true if the AD bit of a forwarded response can be relied
+// on: set by our own validation, or by the upstream if we do not validate.
+func (s *server) trusted(req, resp *dns.Msg) bool {
+	if !resp.AuthenticatedData {
+		return false
+	}
+	return s.validator == nil || !req.CheckingDisabled
+}
+
+// dnssecWriter answers clients that did not set the DO bit without DNSSEC
+// records they did not ask for, and without the AD bit unless they set it
+// in the query (RFC 6840 section 5.7).
+type dnssecWriter struct {
+	dns.ResponseWriter
+	req *dns.Msg
+}
+
+func (dw *dnssecWriter) WriteMsg(m *dns.Msg) error {
+	opt := dw.req.IsEdns0()
+	if opt != nil && opt.Do() {
+		return dw.ResponseWriter.WriteMsg(m)
+	}
+
+	// the message may be cached as is
+	r := *m
+	r.AuthenticatedData = m.AuthenticatedData && dw.req.AuthenticatedData
+	qtype := dw.req.Question[0].Qtype
+	r.Answer = stripDnssec(m.Answer, qtype)
+	r.Ns = stripDnssec(m.Ns, 0)
+	r.Extra = stripDnssec(m.Extra, 0)
+	return dw.ResponseWriter.WriteMsg(&r)
+}
+
+// stripDnssec returns the records of a section without signatures and
+// denial of existence records other than of qtype
+func stripDnssec(section []dns.RR, qtype uint16) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range section {
+		switch t := rr.Header().Rrtype; t {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			if t != qtype {
+				continue
+			}
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
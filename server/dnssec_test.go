@@ -0,0 +1,111 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/claranet/go-dnsmasq/cache"
+	"github.com/claranet/go-dnsmasq/dnssec"
+)
+
+func TestDnssecWriter(t *testing.T) {
+	resp := new(dns.Msg)
+	resp.SetQuestion("example.com.", dns.TypeA)
+	resp.Response = true
+	resp.AuthenticatedData = true
+	for _, s := range []string{
+		"example.com. 300 IN A 192.0.2.1",
+		"example.com. 300 IN RRSIG A 13 2 300 20300101000000 20200101000000 12345 example.com. AAAA",
+	} {
+		rr, _ := dns.NewRR(s)
+		resp.Answer = append(resp.Answer, rr)
+	}
+	nsec, _ := dns.NewRR("example.com. 300 IN NSEC www.example.com. A RRSIG NSEC")
+	resp.Ns = []dns.RR{nsec}
+	resp.SetEdns0(1232, true)
+
+	tests := []struct {
+		name    string
+		edns    bool
+		do, ad  bool
+		answers int
+		authNs  int
+		adBit   bool
+	}{
+		{"DO client", true, true, false, 2, 1, true},
+		{"EDNS client", true, false, false, 1, 0, false},
+		{"AD client", true, false, true, 1, 0, true},
+		{"plain client", false, false, false, 1, 0, false},
+	}
+	for _, tc := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		req.AuthenticatedData = tc.ad
+		if tc.edns {
+			req.SetEdns0(1232, tc.do)
+		}
+		rw := &recordingWriter{}
+		(&dnssecWriter{ResponseWriter: rw, req: req}).WriteMsg(resp)
+
+		m := rw.msg
+		if len(m.Answer) != tc.answers || len(m.Ns) != tc.authNs {
+			t.Errorf("%s: expected %d answers and %d authority records, got %v %v", tc.name, tc.answers, tc.authNs, m.Answer, m.Ns)
+		}
+		if m.AuthenticatedData != tc.adBit {
+			t.Errorf("%s: expected AD bit %t", tc.name, tc.adBit)
+		}
+	}
+	if len(resp.Answer) != 2 || len(resp.Ns) != 1 || !resp.AuthenticatedData {
+		t.Error("the response was changed")
+	}
+}
+
+func TestCachedValidation(t *testing.T) {
+	s := &server{validator: dnssec.New(nil, nil)}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	cd := req.Copy()
+	cd.CheckingDisabled = true
+
+	secure := new(dns.Msg)
+	secure.SetRcode(req, dns.RcodeSuccess)
+	secure.AuthenticatedData = true
+	servfail := new(dns.Msg)
+	servfail.SetRcode(req, dns.RcodeServerFailure)
+	insecure := new(dns.Msg)
+	insecure.SetRcode(req, dns.RcodeSuccess)
+
+	tests := []struct {
+		req, resp  *dns.Msg
+		validation cache.Validation
+		checking   bool // usable for clients that did not disable checking
+		cd         bool // usable for clients that did
+	}{
+		{req, secure, cache.Secure, true, true},
+		{req, insecure, cache.Insecure, true, true},
+		{req, servfail, cache.Bogus, true, false},
+		{cd, insecure, cache.Unvalidated, false, true},
+	}
+	for i, tc := range tests {
+		v := s.validation(tc.req, tc.resp)
+		if v != tc.validation {
+			t.Errorf("%d: expected validation state %d, got %d", i, tc.validation, v)
+		}
+		if s.usable(req, v) != tc.checking || s.usable(cd, v) != tc.cd {
+			t.Errorf("%d: expected usable %t and %t with CD", i, tc.checking, tc.cd)
+		}
+	}
+
+	// without validation everything is usable
+	s.validator = nil
+	if v := s.validation(req, secure); v != cache.Unvalidated || !s.usable(req, v) {
+		t.Errorf("expected unvalidated responses without validation, got %d", v)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+
+	"github.com/claranet/go-dnsmasq/cache"
+)
+
+// clientSubnet returns the request to resolve with the EDNS client subnet
+// option (RFC 7871) added, replaced or removed according to the ECS mode.
+// The request is copied if it is changed.
+func (s *server) clientSubnet(req *dns.Msg, client net.IP) *dns.Msg {
+	ecs := cache.Subnet(req)
+	var subnet *dns.EDNS0_SUBNET
+	switch s.config.ECS {
+	case "", "forward":
+		return req
+	case "add":
+		if ecs != nil {
+			// Never reveal more of the client's address than configured
+			subnet = s.subnetOption(ecs.Address, ecs.SourceNetmask)
+		} else {
+			subnet = s.subnetOption(client, 128)
+		}
+	case "replace":
+		subnet = s.subnetOption(client, 128)
+	}
+	if ecs == nil && subnet == nil {
+		return req
+	}
+
+	req = req.Copy()
+	opt := req.IsEdns0()
+	if opt == nil {
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		opt = req.IsEdns0()
+	}
+	var options []dns.EDNS0
+	for _, o := range opt.Option {
+		if _, ok := o.(*dns.EDNS0_SUBNET); !ok {
+			options = append(options, o)
+		}
+	}
+	if subnet != nil {
+		options = append(options, subnet)
+	}
+	opt.Option = options
+	return req
+}
+
+// subnetOption returns a client subnet option for the network of ip with the
+// prefix length, truncated to the configured source prefix length.
+func (s *server) subnetOption(ip net.IP, prefix uint8) *dns.EDNS0_SUBNET {
+	if ip == nil {
+		return nil
+	}
+	e := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+	bits, max := 128, s.config.ECSIPv6Prefix
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits, max = ip4, 32, s.config.ECSIPv4Prefix
+		e.Family = 1
+	} else {
+		e.Family = 2
+	}
+	if int(prefix) > max {
+		prefix = uint8(max)
+	}
+	e.SourceNetmask = prefix
+	e.Address = ip.Mask(net.CIDRMask(int(prefix), bits))
+	return e
+}
+
+// ecsWriter answers clients with the client subnet option they sent and the
+// scope of the answer, and clients that sent none without the option.
+type ecsWriter struct {
+	dns.ResponseWriter
+	ecs *dns.EDNS0_SUBNET // option sent by the client
+}
+
+func (ew *ecsWriter) WriteMsg(m *dns.Msg) error {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return ew.ResponseWriter.WriteMsg(m)
+	}
+
+	// the message may be cached as is
+	r := *m
+	o := dns.Copy(opt).(*dns.OPT)
+	var scope uint8
+	var options []dns.EDNS0
+	for _, e := range o.Option {
+		if subnet, ok := e.(*dns.EDNS0_SUBNET); ok {
+			scope = subnet.SourceScope
+			continue
+		}
+		options = append(options, e)
+	}
+	if ew.ecs != nil {
+		echo := *ew.ecs
+		echo.SourceScope = scope
+		options = append(options, &echo)
+	}
+	o.Option = options
+
+	r.Extra = make([]dns.RR, 0, len(m.Extra))
+	for _, rr := range m.Extra {
+		if rr == opt {
+			rr = o
+		}
+		r.Extra = append(r.Extra, rr)
+	}
+	return ew.ResponseWriter.WriteMsg(&r)
+}
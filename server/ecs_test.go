@@ -0,0 +1,97 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/claranet/go-dnsmasq/cache"
+)
+
+func TestClientSubnet(t *testing.T) {
+	withSubnet := func(addr string, source uint8) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		m.SetEdns0(1232, false)
+		if addr != "" {
+			opt := m.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: source, Address: net.ParseIP(addr)})
+		}
+		return m
+	}
+	plain := new(dns.Msg)
+	plain.SetQuestion("example.com.", dns.TypeA)
+
+	tests := []struct {
+		mode   string
+		req    *dns.Msg
+		client string
+		subnet string // expected subnet sent upstream, empty for none
+	}{
+		{"forward", withSubnet("192.0.2.77", 32), "10.0.0.1", "192.0.2.77/32"},
+		{"forward", plain, "10.0.0.1", ""},
+		{"add", withSubnet("192.0.2.77", 32), "10.0.0.1", "192.0.2.0/24"},
+		{"add", withSubnet("192.0.2.77", 16), "10.0.0.1", "192.0.0.0/16"},
+		{"add", plain, "10.1.2.3", "10.1.2.0/24"},
+		{"add", plain, "2001:db8:1:2:3::1", "2001:db8:1::/56"},
+		{"replace", withSubnet("192.0.2.77", 32), "10.1.2.3", "10.1.2.0/24"},
+		{"strip", withSubnet("192.0.2.77", 32), "10.1.2.3", ""},
+	}
+	for _, tc := range tests {
+		s := &server{config: &Config{ECS: tc.mode, ECSIPv4Prefix: 24, ECSIPv6Prefix: 56}}
+		original := cache.Subnet(tc.req)
+		req := s.clientSubnet(tc.req, net.ParseIP(tc.client))
+		e := cache.Subnet(req)
+		var subnet string
+		if e != nil {
+			ip := e.Address
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			subnet = (&net.IPNet{IP: ip, Mask: net.CIDRMask(int(e.SourceNetmask), len(ip)*8)}).String()
+		}
+		if subnet != tc.subnet {
+			t.Errorf("%s from %s: expected %q upstream, got %q", tc.mode, tc.client, tc.subnet, subnet)
+		}
+		if cache.Subnet(tc.req) != original {
+			t.Errorf("%s from %s: the client's request was changed", tc.mode, tc.client)
+		}
+	}
+}
+
+func TestECSWriter(t *testing.T) {
+	r := new(dns.Msg)
+	r.SetQuestion("example.com.", dns.TypeA)
+	r.SetEdns0(1232, false)
+	opt := r.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, SourceScope: 20, Address: net.ParseIP("10.1.2.0").To4()})
+
+	rw := new(recordingWriter)
+	ew := &ecsWriter{ResponseWriter: rw}
+	if err := ew.WriteMsg(r); err != nil {
+		t.Fatal(err)
+	}
+	if cache.Subnet(rw.msg) != nil {
+		t.Errorf("expected no client subnet for a client that sent none")
+	}
+
+	client := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 32, Address: net.ParseIP("10.1.2.3").To4()}
+	ew = &ecsWriter{ResponseWriter: rw, ecs: client}
+	if err := ew.WriteMsg(r); err != nil {
+		t.Fatal(err)
+	}
+	e := cache.Subnet(rw.msg)
+	if e == nil || !e.Address.Equal(client.Address) || e.SourceNetmask != 32 || e.SourceScope != 20 {
+		t.Errorf("expected the client's subnet with scope 20, got %v", e)
+	}
+	if e := cache.Subnet(r); e == nil || e.SourceScope != 20 || e.SourceNetmask != 24 {
+		t.Errorf("expected the original message to be unchanged, got %v", e)
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"errors"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Extended DNS Errors (RFC 8914) tell clients why they got an error or an
+// unexpected answer. They are options of the OPT record of the response,
+// which the ednsWriter passes on to clients that sent one, along with those
+// of upstream responses.
+
+// setEDE adds an extended error to the response
+func setEDE(m *dns.Msg, code uint16, text string) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		opt = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		m.Extra = append(m.Extra, opt)
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: code, ExtraText: text})
+}
+
+// setStaleEDE marks a stale answer served because forwarding failed
+func setStaleEDE(m *dns.Msg) {
+	if m.Rcode == dns.RcodeNameError {
+		setEDE(m, dns.ExtendedErrorCodeStaleNXDOMAINAnswer, "")
+		return
+	}
+	setEDE(m, dns.ExtendedErrorCodeStaleAnswer, "")
+}
+
+// setForwardEDE explains a failure to get a response from upstreams
+func setForwardEDE(m *dns.Msg, err error) {
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		setEDE(m, dns.ExtendedErrorCodeNoReachableAuthority, "upstreams timed out")
+		return
+	}
+	setEDE(m, dns.ExtendedErrorCodeNetworkError, "")
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// extendedErrors returns the extended error codes of a message
+func extendedErrors(m *dns.Msg) []uint16 {
+	var codes []uint16
+	if opt := m.IsEdns0(); opt != nil {
+		for _, e := range opt.Option {
+			if ede, ok := e.(*dns.EDNS0_EDE); ok {
+				codes = append(codes, ede.InfoCode)
+			}
+		}
+	}
+	return codes
+}
+
+func TestExtendedErrors(t *testing.T) {
+	timeout := &net.OpError{Op: "read", Net: "udp", Err: os.ErrDeadlineExceeded}
+	refused := &net.OpError{Op: "read", Net: "udp", Err: errors.New("connection refused")}
+
+	tests := []struct {
+		name string
+		set  func(m *dns.Msg)
+		code uint16
+	}{
+		{"timeout", func(m *dns.Msg) { setForwardEDE(m, timeout) }, dns.ExtendedErrorCodeNoReachableAuthority},
+		{"network error", func(m *dns.Msg) { setForwardEDE(m, refused) }, dns.ExtendedErrorCodeNetworkError},
+		{"stale answer", setStaleEDE, dns.ExtendedErrorCodeStaleAnswer},
+		{"stale NXDOMAIN", func(m *dns.Msg) { m.Rcode = dns.RcodeNameError; setStaleEDE(m) }, dns.ExtendedErrorCodeStaleNXDOMAINAnswer},
+		{"blocked", func(m *dns.Msg) { (&server{config: &Config{}}).BlockedResponse(m, m.Question[0]) }, dns.ExtendedErrorCodeBlocked},
+		{"query type policy", func(m *dns.Msg) { (&server{}).QtypeResponse(m, "refuse") }, dns.ExtendedErrorCodeProhibited},
+	}
+	for _, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		tc.set(m)
+		if codes := extendedErrors(m); len(codes) != 1 || codes[0] != tc.code {
+			t.Errorf("%s: expected extended error %s, got %v", tc.name, dns.ExtendedErrorCodeToString[tc.code], codes)
+		}
+	}
+
+	// the extended error is added to the OPT record of upstream responses
+	m := new(dns.Msg)
+	m.SetEdns0(1232, true)
+	setStaleEDE(m)
+	if len(m.Extra) != 1 || len(extendedErrors(m)) != 1 {
+		t.Errorf("expected one OPT record with the extended error, got %v", m.Extra)
+	}
+}
+
+func TestEDNSWriterEDE(t *testing.T) {
+	resp := new(dns.Msg)
+	resp.SetQuestion("example.com.", dns.TypeA)
+	resp.Response = true
+	resp.Rcode = dns.RcodeServerFailure
+	resp.SetEdns0(4096, false)
+	// upstream errors are passed on
+	setEDE(resp, dns.ExtendedErrorCodeDNSBogus, "")
+	resp.IsEdns0().Option = append(resp.IsEdns0().Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: "6e73"})
+
+	for _, edns := range []bool{true, false} {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		if edns {
+			req.SetEdns0(1232, false)
+		}
+		rw := &recordingWriter{addr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+		(&ednsWriter{ResponseWriter: rw, req: req, size: 1232, bufsize: 1232}).WriteMsg(resp)
+
+		opt := rw.msg.IsEdns0()
+		switch {
+		case !edns && opt != nil:
+			t.Errorf("expected no OPT record for a client without EDNS, got %v", opt)
+		case edns && (opt == nil || len(opt.Option) != 1 || extendedErrors(rw.msg)[0] != dns.ExtendedErrorCodeDNSBogus):
+			t.Errorf("expected only the extended error, got %v", opt)
+		}
+	}
+}
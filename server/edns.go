@@ -0,0 +1,107 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"github.com/miekg/dns"
+)
+
+// EDNS0 (RFC 6891) is hop-by-hop: clients get our own OPT record in the
+// response and upstreams get a query with our own OPT record instead of the
+// client's.
+
+// defaultEDNSBufferSize avoids IP fragmentation (DNS flag day 2020)
+const defaultEDNSBufferSize = 1232
+
+// upstreamRequest returns a copy of the request to forward with our buffer
+// size, the DO bit if the client asked for signatures or we validate them,
+// and the client subnet option, the only end-to-end option we forward.
+// When validating the CD bit is set, so that upstreams return the data of
+// bogus answers for us to validate.
+func (s *server) upstreamRequest(req *dns.Msg) *dns.Msg {
+	r := req.Copy()
+	opt := r.IsEdns0()
+
+	o := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	o.SetUDPSize(uint16(s.config.EDNSBufferSize))
+	if opt != nil && opt.Do() || s.validator != nil {
+		o.SetDo()
+	}
+	if opt != nil {
+		for _, e := range opt.Option {
+			if _, ok := e.(*dns.EDNS0_SUBNET); ok {
+				o.Option = append(o.Option, e)
+			}
+		}
+	}
+	if s.validator != nil {
+		r.CheckingDisabled = true
+	}
+
+	r.Extra = withoutOPT(r.Extra)
+	r.Extra = append(r.Extra, o)
+	return r
+}
+
+// badVersion returns true if the client sent an EDNS version we do not
+// support, to be answered with BADVERS.
+func badVersion(req *dns.Msg) bool {
+	opt := req.IsEdns0()
+	return opt != nil && opt.Version() != 0
+}
+
+// ednsWriter answers clients that sent an OPT record with ours, others
+// without one, and truncates UDP responses to the client's buffer size.
+type ednsWriter struct {
+	dns.ResponseWriter
+	req     *dns.Msg
+	size    int    // maximum size of UDP responses
+	bufsize uint16 // our buffer size
+	cookie  string // the cookie to answer with, if the client sent one
+}
+
+func (ew *ednsWriter) WriteMsg(m *dns.Msg) error {
+	// the message may be cached as is
+	r := *m
+	r.Extra = withoutOPT(m.Extra)
+	if opt := ew.req.IsEdns0(); opt != nil {
+		o := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		o.SetUDPSize(ew.bufsize)
+		if opt.Do() {
+			o.SetDo()
+		}
+		// Options of the response meant for the client, the client subnet
+		// scope and extended errors, are kept
+		if ropt := m.IsEdns0(); ropt != nil {
+			for _, e := range ropt.Option {
+				switch e.(type) {
+				case *dns.EDNS0_SUBNET, *dns.EDNS0_EDE:
+					o.Option = append(o.Option, e)
+				}
+			}
+		}
+		if ew.cookie != "" {
+			o.Option = append(o.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: ew.cookie})
+		}
+		r.Extra = append(r.Extra, o)
+	}
+	if !isTCP(ew.ResponseWriter) {
+		Fit(&r, ew.size, false)
+	}
+	return ew.ResponseWriter.WriteMsg(&r)
+}
+
+// withoutOPT returns the records of the additional section but the OPT record
+func withoutOPT(extra []dns.RR) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestUpstreamRequest(t *testing.T) {
+	s := &server{config: &Config{EDNSBufferSize: 1232}}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(4096, true)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_NSID{Code: dns.EDNS0NSID},
+		&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.0.2.0").To4()})
+
+	r := s.upstreamRequest(req)
+	o := r.IsEdns0()
+	if o == nil || o.UDPSize() != 1232 || !o.Do() || len(o.Option) != 1 || o.Option[0].Option() != dns.EDNS0SUBNET {
+		t.Errorf("expected our buffer size, the DO bit and the client subnet upstream, got %v", o)
+	}
+	if r.CheckingDisabled {
+		t.Error("expected the CD bit of the client")
+	}
+	if req.IsEdns0().UDPSize() != 4096 || len(req.IsEdns0().Option) != 2 {
+		t.Error("the client's request was changed")
+	}
+
+	plain := new(dns.Msg)
+	plain.SetQuestion("example.com.", dns.TypeA)
+	if o := s.upstreamRequest(plain).IsEdns0(); o == nil || o.UDPSize() != 1232 || o.Do() {
+		t.Errorf("expected an OPT record without DO for clients without EDNS, got %v", o)
+	}
+}
+
+func TestEDNSWriter(t *testing.T) {
+	resp := new(dns.Msg)
+	resp.SetQuestion("example.com.", dns.TypeTXT)
+	resp.Response = true
+	for i := 0; i < 10; i++ {
+		rr, _ := dns.NewRR(fmt.Sprintf("example.com. 300 IN TXT \"%050d\"", i))
+		resp.Answer = append(resp.Answer, rr)
+	}
+	resp.SetEdns0(4096, true)
+	resp.IsEdns0().Option = append(resp.IsEdns0().Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: "7570"})
+
+	tests := []struct {
+		name      string
+		edns      bool
+		size      int
+		opt       bool
+		truncated bool
+	}{
+		{"EDNS client", true, 1232, true, false},
+		{"small buffer", true, 512, true, true},
+		{"plain client", false, 512, false, true},
+	}
+	for _, tc := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeTXT)
+		if tc.edns {
+			req.SetEdns0(uint16(tc.size), false)
+		}
+		rw := &recordingWriter{addr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}}
+		(&ednsWriter{ResponseWriter: rw, req: req, size: tc.size, bufsize: 1232}).WriteMsg(resp)
+
+		m := rw.msg
+		opt := m.IsEdns0()
+		if (opt != nil) != tc.opt {
+			t.Errorf("%s: expected OPT record %t, got %v", tc.name, tc.opt, m.Extra)
+		}
+		if opt != nil && (opt.UDPSize() != 1232 || opt.Do() || len(opt.Option) != 0) {
+			t.Errorf("%s: expected our own OPT record, got %v", tc.name, opt)
+		}
+		if m.Truncated != tc.truncated || m.Len() > tc.size {
+			t.Errorf("%s: expected truncated %t within %d bytes, got %d bytes", tc.name, tc.truncated, tc.size, m.Len())
+		}
+	}
+	if len(resp.Answer) != 10 || resp.IsEdns0().UDPSize() != 4096 {
+		t.Error("the response was changed")
+	}
+}
@@ -7,6 +7,8 @@
 package server
 
 import (
+	"fmt"
+	"net"
 	"strings"
 
 	"github.com/miekg/dns"
@@ -20,23 +22,37 @@ func (s *server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg, staleRes *d
 	name := req.Question[0].Name
 	nameDots := dns.CountLabel(name) - 1
 	refuse := false
+	denied := false
+	var ede uint16
 
 	switch {
+	case !s.config.RecursionACL.Allowed(clientIP(w)):
+		log.Debugf("[%d] Refusing query, recursion not allowed for %s", req.Id, w.RemoteAddr().String())
+		refuse = true
+		denied = true
+		ede = dns.ExtendedErrorCodeProhibited
 	case s.config.NoRec:
 		log.Debugf("[%d] Refusing query, recursion disabled", req.Id)
 		refuse = true
+		ede = dns.ExtendedErrorCodeNotAuthoritative
 	case len(s.config.Nameservers) == 0:
 		log.Debugf("[%d] Refusing query, no nameservers configured", req.Id)
 		refuse = true
+		ede = dns.ExtendedErrorCodeNotAuthoritative
 	case nameDots < s.config.FwdNdots && !s.config.EnableSearch:
 		log.Debugf("[%d] Refusing query, qname '%s' too short to forward", req.Id, name)
 		refuse = true
+		ede = dns.ExtendedErrorCodeProhibited
 	}
 
 	if refuse {
 		m := new(dns.Msg)
 		m.SetRcode(req, dns.RcodeRefused)
-		writeMsg(w, m)
+		setEDE(m, ede, "")
+		StatsRefusedCount.Inc(1)
+		if !denied || s.config.DenyAction != "drop" {
+			writeMsg(w, m)
+		}
 		return m, false
 	}
 
@@ -131,6 +147,7 @@ func (s *server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg, staleRes *d
 		absoluteRes.Id = req.Id
 		if staleRes != nil { // If stale response available, use it
 			absoluteRes = staleRes
+			setStaleEDE(absoluteRes)
 			log.Debugf("[%d] Stale cache record available, serving it instead", req.Id)
 			StatsStaleCacheHit.Inc(1)
 		} else {
@@ -147,6 +164,7 @@ func (s *server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg, staleRes *d
 		m.SetRcode(req, searchRes.Rcode)
 		if staleRes != nil { // If stale response available, use it
 			m = staleRes
+			setStaleEDE(m)
 			log.Debugf("[%d] Stale cache record available, serving it instead", req.Id)
 			StatsStaleCacheHit.Inc(1)
 		} else {
@@ -162,8 +180,16 @@ func (s *server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg, staleRes *d
 	log.Debugf("[%d] Error forwarding query. Returning SRVFAIL.", req.Id)
 	m := new(dns.Msg)
 	m.SetRcode(req, dns.RcodeServerFailure)
+	err := absoluteErr
+	if err == nil {
+		err = searchErr
+	}
+	if err != nil {
+		setForwardEDE(m, err)
+	}
 	if staleRes != nil { // If stale response available, use it
 		m = staleRes
+		setStaleEDE(m)
 		log.Infof("[%d] Stale cache record available, serving it instead", req.Id)
 		StatsStaleCacheHit.Inc(1)
 	} else {
@@ -173,6 +199,14 @@ func (s *server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg, staleRes *d
 	return m, staleRes != nil
 }
 
+// forwardable returns true if a name the server resolves on its own behalf,
+// like the target of a rewrite, may be forwarded for the client: the client
+// is allowed recursion, recursion is enabled and the name is not local.
+func (s *server) forwardable(name string, client net.IP) bool {
+	return s.config.RecursionACL.Allowed(client) && !s.config.NoRec &&
+		len(s.config.Nameservers) > 0 && s.localZone(strings.ToLower(name)) == ""
+}
+
 // forwardSearch resolves a query by suffixing with search paths
 func (s *server) forwardSearch(req *dns.Msg, tcp bool) (*dns.Msg, error) {
 	var r *dns.Msg
@@ -189,6 +223,10 @@ func (s *server) forwardSearch(req *dns.Msg, tcp bool) (*dns.Msg, error) {
 		}
 
 		searchName = strings.ToLower(appendDomain(name, domain))
+		if zone := s.localZone(searchName); zone != "" {
+			log.Debugf("[%d] Not searching '%s' under local domain '%s'", req.Id, searchName, zone)
+			continue
+		}
 		reqCopy.Question[0] = dns.Question{Name: searchName, Qtype: reqCopy.Question[0].Qtype, Qclass: reqCopy.Question[0].Qclass}
 		didSearch = true
 		r, err = s.forwardQuery(reqCopy, tcp)
@@ -236,6 +274,8 @@ func (s *server) forwardSearch(req *dns.Msg, tcp bool) (*dns.Msg, error) {
 				// }
 				answers = append(answers, r.Answer...)
 				r.Answer = answers
+				// The CNAME to the search name is not signed
+				r.AuthenticatedData = false
 			}
 			// If we ever got a NODATA, return this instead of a negative result
 		} else if nodata != nil {
@@ -254,32 +294,33 @@ func (s *server) forwardSearch(req *dns.Msg, tcp bool) (*dns.Msg, error) {
 	return r, err
 }
 
+// upstreams returns the nameservers to forward queries for name to, and
+// whether these are the nameservers of a stub zone
+func (s *server) upstreams(name string) ([]string, bool) {
+	for zone, srv := range *s.config.Stub {
+		if strings.HasSuffix(name, zone) {
+			return srv, true
+		}
+	}
+	return s.config.Nameservers, false
+}
+
 // forwardQuery sends the query to nameservers retrying once on error
 func (s *server) forwardQuery(req *dns.Msg, tcp bool) (*dns.Msg, error) {
-	var nservers []string // Nameservers to use for this query
 	var r *dns.Msg
 	var err error
 
-	nservers = s.config.Nameservers
-
-	// Check whether the name matches a stub zone
-	for zone, srv := range *s.config.Stub {
-		if strings.HasSuffix(req.Question[0].Name, zone) {
-			nservers = srv
-			StatsStubForwardCount.Inc(1)
-			break
-		}
+	nservers, stub := s.upstreams(req.Question[0].Name)
+	if stub {
+		StatsStubForwardCount.Inc(1)
 	}
+	req = s.upstreamRequest(req)
 
 	for nsIdx := 0; nsIdx < len(nservers); nsIdx++ {
 		log.Debugf("[%d] Querying upstream %s for qname '%s'",
 			req.Id, nservers[nsIdx], req.Question[0].Name)
 
-		if tcp {
-			r, _, err = s.dnsTCPclient.Exchange(req, nservers[nsIdx])
-		} else {
-			r, _, err = s.dnsUDPclient.Exchange(req, nservers[nsIdx])
-		}
+		r, err = s.exchange(req, nservers[nsIdx], tcp)
 
 		if err == nil {
 			// Message response codes: https://github.com/miekg/dns/blob/master/types.go#L127
@@ -291,6 +332,15 @@ func (s *server) forwardQuery(req *dns.Msg, tcp bool) (*dns.Msg, error) {
 				log.Debugf("[%d] Trying another server if available", req.Id)
 				continue
 			}
+			if s.validator != nil {
+				r = s.validate(req, r)
+			}
+			if s.config.StopRebind {
+				r = s.stopRebind(req, r, nservers[nsIdx])
+			}
+			if len(s.config.AliasRules) > 0 {
+				s.doctor(r)
+			}
 			return r, err
 		}
 
@@ -303,6 +353,72 @@ func (s *server) forwardQuery(req *dns.Msg, tcp bool) (*dns.Msg, error) {
 	return r, err
 }
 
+// exchange sends a query to the upstream ns with a random ID, and the query
+// name in random case over UDP if configured (DNS 0x20). Responses that do
+// not match the query are rejected as spoofed, the others are returned with
+// the ID and query name of req.
+func (s *server) exchange(req *dns.Msg, ns string, tcp bool) (*dns.Msg, error) {
+	q := *req
+	q.Id = dns.Id()
+	q.Question = []dns.Question{req.Question[0]}
+	randomized := s.config.RandomizeCase && !tcp
+	if randomized {
+		q.Question[0].Name = randomizeCase(q.Question[0].Name)
+	}
+
+	r, err := s.send(&q, ns, tcp)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(&q, r, randomized); err != nil {
+		return nil, fmt.Errorf("response from %s %v", ns, err)
+	}
+	r.Id = req.Id
+	if randomized {
+		restoreCase(r, q.Question[0].Name, req.Question[0].Name)
+	}
+	return r, nil
+}
+
+// send sends a query to the upstream ns. With cookies a BADCOOKIE response
+// is retried once with the new server cookie, then over TCP (RFC 7873
+// section 5.3).
+func (s *server) send(req *dns.Msg, ns string, tcp bool) (*dns.Msg, error) {
+	if s.cookies == nil {
+		return s.transport(req, ns, tcp)
+	}
+
+	for try := 0; ; try++ {
+		r, err := s.transport(s.cookies.request(req, ns), ns, tcp)
+		if err != nil {
+			return nil, err
+		}
+		if err = s.cookies.response(r, ns); err != nil {
+			return nil, err
+		}
+		if r.Rcode != dns.RcodeBadCookie {
+			return r, nil
+		}
+		if tcp {
+			return nil, fmt.Errorf("upstream %s keeps answering BADCOOKIE", ns)
+		}
+		log.Debugf("[%d] Bad cookie response from upstream %s, retrying", req.Id, ns)
+		if try > 0 {
+			tcp = true
+		}
+	}
+}
+
+// transport sends a query over UDP, or over the pooled TCP connection to
+// the upstream
+func (s *server) transport(req *dns.Msg, ns string, tcp bool) (*dns.Msg, error) {
+	if tcp {
+		return s.tcpPool.exchange(req, ns)
+	}
+	r, _, err := s.dnsUDPclient.Exchange(req, ns)
+	return r, err
+}
+
 // ServeDNSReverse is the handler for DNS requests for the reverse zone. If nothing is found
 // locally the request is forwarded to the forwarder for resolution.
 func (s *server) ServeDNSReverse(w dns.ResponseWriter, req *dns.Msg) (*dns.Msg, bool) {
@@ -316,6 +432,13 @@ func (s *server) ServeDNSReverse(w dns.ResponseWriter, req *dns.Msg) (*dns.Msg,
 		writeMsg(w, m)
 		return m, false
 	}
+	name := strings.ToLower(req.Question[0].Name)
+	if zone := s.localZone(name); zone != "" {
+		log.Debugf("[%d] Not forwarding query under local domain '%s'", req.Id, zone)
+		s.LocalNegative(m, name, zone)
+		writeMsg(w, m)
+		return m, false
+	}
 	// Always forward if not found locally.
 	return s.ServeDNSForward(w, req, nil)
 }
@@ -0,0 +1,68 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"github.com/miekg/dns"
+)
+
+// SubdomainFinder is implemented by the Hostfiles that can tell whether they
+// have names below name, making it an empty non-terminal.
+type SubdomainFinder interface {
+	HasSubdomains(name string) bool
+}
+
+// localZone returns the local-only domain that name belongs to, or an
+// empty string if the name may be forwarded.
+func (s *server) localZone(name string) string {
+	for _, zone := range s.config.LocalDomains {
+		if dns.IsSubDomain(zone, name) {
+			return zone
+		}
+	}
+	return ""
+}
+
+// LocalNegative turns m into the negative answer for a name under a
+// local-only domain: NODATA if the name is known locally with a different
+// type or has names below it (RFC 8020), NXDOMAIN otherwise. The authority
+// section carries a synthesized SOA.
+func (s *server) LocalNegative(m *dns.Msg, name, zone string) {
+	m.Authoritative = true
+	m.Ns = []dns.RR{s.localSOA(zone)}
+
+	exists := name == zone
+	if !exists {
+		if ips, err := s.hosts.FindHosts(name); err == nil && len(ips) > 0 {
+			exists = true
+		} else if f, ok := s.hosts.(SubdomainFinder); ok {
+			exists = f.HasSubdomains(name)
+		}
+	}
+
+	if exists {
+		m.Rcode = dns.RcodeSuccess
+		StatsNoDataCount.Inc(1)
+		return
+	}
+	m.Rcode = dns.RcodeNameError
+	StatsNameErrorCount.Inc(1)
+}
+
+func (s *server) localSOA(zone string) *dns.SOA {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA,
+			Class: dns.ClassINET, Ttl: s.config.HostsTtl},
+		Ns:      appendDomain("localhost", zone),
+		Mbox:    appendDomain("hostmaster", zone),
+		Serial:  1,
+		Refresh: 1200,
+		Retry:   180,
+		Expire:  1209600,
+		Minttl:  s.config.HostsTtl,
+	}
+}
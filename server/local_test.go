@@ -0,0 +1,198 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// testHosts maps host names to addresses
+type testHosts map[string]string
+
+func (h testHosts) FindHosts(name string) ([]net.IP, error) {
+	if ip, ok := h[name]; ok {
+		return []net.IP{net.ParseIP(ip)}, nil
+	}
+	return nil, nil
+}
+
+func (h testHosts) HasSubdomains(name string) bool {
+	for host := range h {
+		if strings.HasSuffix(host, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h testHosts) FindReverse(name string) (string, error) {
+	for host, ip := range h {
+		if addr, _ := dns.ReverseAddr(ip); addr == name {
+			return host, nil
+		}
+	}
+	return "", nil
+}
+
+// testUpstream is a nameserver on a local UDP and TCP port recording the
+// names it is asked for. Unless handler answers itself A queries get 192.0.2.1 and
+// other queries an empty answer.
+type testUpstream struct {
+	sync.Mutex
+	addr    string
+	queries []string
+}
+
+func newTestUpstream(t *testing.T, handler func(m *dns.Msg)) *testUpstream {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &testUpstream{addr: pc.LocalAddr().String()}
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		q := req.Question[0]
+		u.Lock()
+		u.queries = append(u.queries, strings.ToLower(q.Name))
+		u.Unlock()
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if handler != nil {
+			handler(m)
+		} else if q.Qtype == dns.TypeA {
+			rr, _ := dns.NewRR(q.Name + " 60 IN A 192.0.2.1")
+			m.Answer = []dns.RR{rr}
+		}
+		w.WriteMsg(m)
+	})
+	l, err := net.Listen("tcp", u.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp := &dns.Server{PacketConn: pc, Handler: mux}
+	tcp := &dns.Server{Listener: l, Handler: mux}
+	go udp.ActivateAndServe()
+	go tcp.ActivateAndServe()
+	t.Cleanup(func() {
+		udp.Shutdown()
+		tcp.Shutdown()
+	})
+	return u
+}
+
+func (u *testUpstream) names() []string {
+	u.Lock()
+	defer u.Unlock()
+	return append([]string{}, u.queries...)
+}
+
+// newTestServer returns a server with the checked config
+func newTestServer(t *testing.T, hosts Hostfile, config *Config) *server {
+	if config.DnsAddr == "" {
+		config.DnsAddr = "127.0.0.1:53"
+	}
+	if config.RCacheTtl == 0 {
+		config.RCacheTtl = 60
+	}
+	if config.Ndots == 0 {
+		config.Ndots = 1
+	}
+	if err := CheckConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	return New(hosts, config, "test")
+}
+
+// recordingWriter records the response to a query received on the main
+// listener from the client at addr
+type recordingWriter struct {
+	dns.ResponseWriter
+	addr net.Addr
+	msg  *dns.Msg
+}
+
+func (rw *recordingWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (rw *recordingWriter) RemoteAddr() net.Addr { return rw.addr }
+
+func (rw *recordingWriter) WriteMsg(m *dns.Msg) error {
+	rw.msg = m
+	return nil
+}
+
+// ask passes a query with an OPT record from a local UDP or TCP client to s
+// and returns the response, nil if there was none
+func ask(s *server, name string, qtype uint16, tcp bool) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.SetEdns0(1232, false)
+	w := &recordingWriter{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}}
+	if tcp {
+		w.addr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+	}
+	s.ServeDNS(w, req)
+	return w.msg
+}
+
+func TestLocalDomains(t *testing.T) {
+	upstream := newTestUpstream(t, nil)
+	s := newTestServer(t, testHosts{"host.lan.": "192.168.1.10", "a.b.lan.": "192.168.1.11"}, &Config{
+		Nameservers:   []string{upstream.addr},
+		LocalDomains:  []string{"lan.", "168.192.in-addr.arpa."},
+		SearchDomains: []string{"lan.", "example.com."},
+		EnableSearch:  true,
+	})
+
+	tests := []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer bool
+		zone   string // of the SOA of a negative answer
+	}{
+		{"host.lan.", dns.TypeA, dns.RcodeSuccess, true, ""},
+		{"host.lan.", dns.TypeMX, dns.RcodeSuccess, false, "lan."},
+		{"lan.", dns.TypeA, dns.RcodeSuccess, false, "lan."},
+		{"missing.lan.", dns.TypeA, dns.RcodeNameError, false, "lan."},
+		{"a.b.lan.", dns.TypeAAAA, dns.RcodeSuccess, false, "lan."},
+		{"b.lan.", dns.TypeA, dns.RcodeSuccess, false, "lan."},
+		{"c.b.lan.", dns.TypeA, dns.RcodeNameError, false, "lan."},
+		{"10.1.168.192.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, true, ""},
+		{"20.1.168.192.in-addr.arpa.", dns.TypePTR, dns.RcodeNameError, false, "168.192.in-addr.arpa."},
+	}
+	for _, tc := range tests {
+		r := ask(s, tc.name, tc.qtype, false)
+		if r == nil || r.Rcode != tc.rcode || (len(r.Answer) > 0) != tc.answer {
+			t.Errorf("%s %s: expected %s with answer %t, got %v", tc.name, dns.TypeToString[tc.qtype], dns.RcodeToString[tc.rcode], tc.answer, r)
+			continue
+		}
+		if tc.zone == "" {
+			continue
+		}
+		if len(r.Ns) != 1 || r.Ns[0].Header().Rrtype != dns.TypeSOA || r.Ns[0].Header().Name != tc.zone || !r.Authoritative {
+			t.Errorf("%s %s: expected an authoritative answer with the SOA of %s, got %v", tc.name, dns.TypeToString[tc.qtype], tc.zone, r)
+		}
+	}
+	if names := upstream.names(); len(names) > 0 {
+		t.Errorf("expected no queries under local domains upstream, got %v", names)
+	}
+
+	// the search skips the local domain
+	if r := ask(s, "www.", dns.TypeA, false); r == nil || r.Rcode != dns.RcodeSuccess || len(r.Answer) != 2 || r.Answer[1].Header().Name != "www.example.com." {
+		t.Errorf("expected the answer for the search name, got %v", r)
+	}
+	if names := upstream.names(); len(names) != 1 || names[0] != "www.example.com." {
+		t.Errorf("expected only www.example.com. upstream, got %v", names)
+	}
+}
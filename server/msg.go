@@ -4,51 +4,113 @@
 
 package server
 
-import "github.com/miekg/dns"
+import (
+	"sort"
+	"strings"
 
-// Fit will make m fit the size. If a message is larger than size then entire
-// additional section is dropped. If it is still to large and the transport
-// is udp we return a truncated message.
-// If the transport is tcp we are going to drop RR from the answer section
-// until it fits. When this is case the returned bool is true.
+	"github.com/miekg/dns"
+)
+
+// Fit will make m fit the size by dropping whole RRsets, signatures along
+// with the records they cover. The additional section goes first, then the
+// authority section and last the answer section. OPT and TSIG records are
+// always kept, and so are the CNAME and DNAME records of the answer as long
+// as anything of it fits.
+// Dropping the authority section of a positive answer loses nothing the
+// client needs. Otherwise the message is truncated and the returned bool is
+// true. With udp the TC bit is set then, with tcp it means nothing.
 func Fit(m *dns.Msg, size int, tcp bool) (*dns.Msg, bool) {
-	if m.Len() > size {
-		// Check for OPT Records at the end and keep those. TODO(miek)
-		m.Extra = nil
+	if m.Len() <= size {
+		return m, false
 	}
-	if m.Len() < size {
+
+	var extra, pseudo []dns.RR
+	for _, rr := range m.Extra {
+		switch rr.Header().Rrtype {
+		case dns.TypeOPT, dns.TypeTSIG:
+			pseudo = append(pseudo, rr)
+		default:
+			extra = append(extra, rr)
+		}
+	}
+	if fitSets(m, &m.Extra, nil, rrsets(extra), pseudo, size) {
 		return m, false
 	}
+	if fitSets(m, &m.Ns, nil, rrsets(m.Ns), nil, size) || m.Len() <= size && len(m.Answer) > 0 {
+		return m, false
+	}
+
+	if m.Len() > size {
+		var chain, others [][]dns.RR
+		for _, set := range rrsets(m.Answer) {
+			switch rrsetType(set[0]) {
+			case dns.TypeCNAME, dns.TypeDNAME:
+				chain = append(chain, set)
+			default:
+				others = append(others, set)
+			}
+		}
+		fitSets(m, &m.Answer, joinSets(chain), others, nil, size)
+		if m.Len() > size {
+			m.Answer = nil
+		}
+	}
 
 	// With TCP setting TC does not mean anything.
 	if !tcp {
 		m.Truncated = true
-		// fall through here, so we at least return a message that can
-		// fit the udp buffer.
 	}
+	return m, true
+}
 
-	// Additional section is gone, binary search until we have length that fits.
-	min, max := 0, len(m.Answer)
-	original := make([]dns.RR, len(m.Answer))
-	copy(original, m.Answer)
-	for {
-		if min == max {
-			break
-		}
-
-		mid := (min + max) / 2
-		m.Answer = original[:mid]
+// fitSets fills section with head, as many leading sets as m fits into size
+// with, and tail. It returns false if any set was left out.
+func fitSets(m *dns.Msg, section *[]dns.RR, head []dns.RR, sets [][]dns.RR, tail []dns.RR, size int) bool {
+	fits := func(n int) bool {
+		rrs := append([]dns.RR{}, head...)
+		*section = append(append(rrs, joinSets(sets[:n])...), tail...)
+		return m.Len() <= size
+	}
+	if fits(len(sets)) {
+		return true
+	}
+	// the first number of sets that does not fit, at most all of them
+	n := sort.Search(len(sets), func(n int) bool { return !fits(n) })
+	fits(max(n-1, 0))
+	return false
+}
 
-		if m.Len() < size {
-			min++
+// rrsets groups the records of a section by name, class and type in the
+// order they first appear. Signatures belong to the type they cover.
+func rrsets(section []dns.RR) [][]dns.RR {
+	var sets [][]dns.RR
+	index := make(map[string]int)
+	for _, rr := range section {
+		hdr := rr.Header()
+		key := strings.ToLower(hdr.Name) + "/" + dns.Class(hdr.Class).String() + "/" + dns.Type(rrsetType(rr)).String()
+		if i, ok := index[key]; ok {
+			sets[i] = append(sets[i], rr)
 			continue
 		}
-		max = mid
+		index[key] = len(sets)
+		sets = append(sets, []dns.RR{rr})
+	}
+	return sets
+}
 
+// rrsetType returns the type of the RRset a record belongs to
+func rrsetType(rr dns.RR) uint16 {
+	if sig, ok := rr.(*dns.RRSIG); ok {
+		return sig.TypeCovered
 	}
-	if max > 1 {
-		max--
+	return rr.Header().Rrtype
+}
+
+// joinSets returns the records of the sets in order
+func joinSets(sets [][]dns.RR) []dns.RR {
+	var rrs []dns.RR
+	for _, set := range sets {
+		rrs = append(rrs, set...)
 	}
-	m.Answer = m.Answer[:max]
-	return m, true
+	return rrs
 }
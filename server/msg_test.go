@@ -0,0 +1,93 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestFit(t *testing.T) {
+	rrs := func(ss ...string) []dns.RR {
+		var section []dns.RR
+		for _, s := range ss {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			section = append(section, rr)
+		}
+		return section
+	}
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT, Class: 1232}}
+	tsig := &dns.TSIG{Hdr: dns.RR_Header{Name: "key.", Rrtype: dns.TypeTSIG, Class: dns.ClassANY}, Algorithm: dns.HmacSHA256, Fudge: 300}
+	long := strings.Repeat("x", 200)
+
+	a := rrs("www.example.com. 300 IN A 192.0.2.1", "www.example.com. 300 IN A 192.0.2.2")
+	sig := rrs("www.example.com. 300 IN RRSIG A 13 3 300 20300101000000 20200101000000 12345 example.com. AAAA")
+	txt := rrs(`www.example.com. 300 IN TXT "`+long+`"`, `www.example.com. 300 IN TXT "`+long+`"`)
+	cname := rrs("alias.example.com. 300 IN CNAME www.example.com.")
+	ns := rrs("example.com. 300 IN NS ns1.example.com.", "example.com. 300 IN NS ns2.example.com.")
+	soa := rrs("example.com. 300 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300")
+	glue1 := rrs("ns1.example.com. 300 IN A 192.0.2.53")
+	glue2 := rrs("ns2.example.com. 300 IN A 192.0.2.54", "ns1.example.com. 300 IN AAAA 2001:db8::53")
+	cat := func(sections ...[]dns.RR) []dns.RR {
+		var section []dns.RR
+		for _, s := range sections {
+			section = append(section, s...)
+		}
+		return section
+	}
+
+	type sections struct{ answer, ns, extra []dns.RR }
+	tests := []struct {
+		name      string
+		in, out   sections
+		tcp       bool
+		truncated bool
+	}{
+		{"fits", sections{a, ns, glue1}, sections{a, ns, glue1}, false, false},
+		{"additional RRsets, OPT and TSIG kept",
+			sections{a, ns, cat(glue1, glue2, []dns.RR{opt, tsig})},
+			sections{a, ns, cat(glue1, []dns.RR{opt, tsig})}, false, false},
+		{"authority of a positive answer",
+			sections{a, ns, cat(glue1, []dns.RR{opt})},
+			sections{a, nil, []dns.RR{opt}}, false, false},
+		{"answer RRsets with their signatures",
+			sections{[]dns.RR{a[0], txt[0], a[1], sig[0], txt[1]}, ns, []dns.RR{opt}},
+			sections{cat(a, sig), nil, []dns.RR{opt}}, false, true},
+		{"answer over TCP",
+			sections{cat(a, txt), nil, nil},
+			sections{a, nil, nil}, true, true},
+		{"CNAME chain",
+			sections{cat(txt, cname), nil, nil},
+			sections{cname, nil, nil}, false, true},
+		{"negative answer",
+			sections{nil, soa, []dns.RR{opt}},
+			sections{nil, nil, []dns.RR{opt}}, false, true},
+	}
+	for _, tc := range tests {
+		expected := new(dns.Msg)
+		expected.SetQuestion("www.example.com.", dns.TypeA)
+		expected.Answer, expected.Ns, expected.Extra = tc.out.answer, tc.out.ns, tc.out.extra
+		m := expected.Copy()
+		m.Answer, m.Ns, m.Extra = tc.in.answer, tc.in.ns, tc.in.extra
+
+		_, truncated := Fit(m, expected.Len(), tc.tcp)
+		if truncated != tc.truncated || m.Truncated != (tc.truncated && !tc.tcp) {
+			t.Errorf("%s: expected truncated %t, got %t and TC bit %t", tc.name, tc.truncated, truncated, m.Truncated)
+		}
+		for i, section := range [][2][]dns.RR{{m.Answer, expected.Answer}, {m.Ns, expected.Ns}, {m.Extra, expected.Extra}} {
+			if fmt.Sprint(section[0]) != fmt.Sprint(section[1]) {
+				t.Errorf("%s: expected section %d %v, got %v", tc.name, i, section[1], section[0])
+			}
+		}
+	}
+}
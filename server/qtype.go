@@ -0,0 +1,138 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// QtypeRule is the action for queries of a type, over one transport or
+// both if Net is empty
+type QtypeRule struct {
+	Qtype  uint16
+	Net    string
+	Action string
+}
+
+// parseQtypeRule parses a rule given as <type>[/udp|/tcp]=<action>
+func parseQtypeRule(value string) (QtypeRule, error) {
+	var r QtypeRule
+	i := strings.IndexByte(value, '=')
+	if i < 0 {
+		return r, fmt.Errorf("Invalid query type rule, expected <type>[/udp|/tcp]=<action>: %s", value)
+	}
+	qtype, action := strings.ToUpper(strings.TrimSpace(value[:i])), strings.ToLower(strings.TrimSpace(value[i+1:]))
+	if j := strings.IndexByte(qtype, '/'); j >= 0 {
+		r.Net = strings.ToLower(qtype[j+1:])
+		qtype = qtype[:j]
+		if r.Net != "udp" && r.Net != "tcp" {
+			return r, fmt.Errorf("Invalid transport in query type rule: %s", value)
+		}
+	}
+
+	var ok bool
+	if r.Qtype, ok = dns.StringToType[qtype]; !ok {
+		n, err := strconv.ParseUint(strings.TrimPrefix(qtype, "TYPE"), 10, 16)
+		if !strings.HasPrefix(qtype, "TYPE") || err != nil {
+			return r, fmt.Errorf("Unknown query type: %s", qtype)
+		}
+		r.Qtype = uint16(n)
+	}
+
+	switch action {
+	case "forward", "refuse", "nxdomain", "nodata", "drop":
+		r.Action = action
+	default:
+		return r, fmt.Errorf("Invalid action in query type rule, expected forward, refuse, nxdomain, nodata or drop: %s", value)
+	}
+	return r, nil
+}
+
+// qtypeAction returns the action of the first rule matching the query type
+// and transport, or an empty string if no rule matches.
+func (s *server) qtypeAction(qtype uint16, tcp bool) string {
+	for _, r := range s.config.QtypeRules {
+		if r.Qtype == qtype && (r.Net == "" || (r.Net == "tcp") == tcp) {
+			return r.Action
+		}
+	}
+	return ""
+}
+
+// QtypeResponse turns m into the answer for a query type rule action other
+// than forward or drop.
+func (s *server) QtypeResponse(m *dns.Msg, action string) {
+	switch action {
+	case "refuse":
+		m.Rcode = dns.RcodeRefused
+		setEDE(m, dns.ExtendedErrorCodeProhibited, "query type policy")
+		StatsRefusedCount.Inc(1)
+	case "nxdomain":
+		m.Rcode = dns.RcodeNameError
+		setEDE(m, dns.ExtendedErrorCodeBlocked, "query type policy")
+		StatsNameErrorCount.Inc(1)
+	case "nodata":
+		setEDE(m, dns.ExtendedErrorCodeBlocked, "query type policy")
+		StatsNoDataCount.Inc(1)
+	}
+}
+
+// AnyHinfo returns the synthesized HINFO answer to ANY queries described in
+// RFC 8482.
+func (s *server) AnyHinfo(q dns.Question) dns.RR {
+	return &dns.HINFO{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: s.config.Ttl},
+		Cpu: "RFC8482",
+		Os:  "",
+	}
+}
+
+// minimalAnyWriter reduces the answers to ANY queries to a single RRset and
+// its signatures, as described in RFC 8482.
+type minimalAnyWriter struct {
+	dns.ResponseWriter
+}
+
+func (mw *minimalAnyWriter) WriteMsg(m *dns.Msg) error {
+	var first dns.RR
+	for _, rr := range m.Answer {
+		if rr.Header().Rrtype != dns.TypeRRSIG {
+			first = rr
+			break
+		}
+	}
+	if first == nil {
+		return mw.ResponseWriter.WriteMsg(m)
+	}
+
+	var answer []dns.RR
+	for _, rr := range m.Answer {
+		if !strings.EqualFold(rr.Header().Name, first.Header().Name) {
+			continue
+		}
+		rrtype := rr.Header().Rrtype
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			rrtype = sig.TypeCovered
+		}
+		if rrtype == first.Header().Rrtype {
+			answer = append(answer, rr)
+		}
+	}
+	if len(answer) < len(m.Answer) {
+		log.Debugf("[%d] Reduced ANY response to the %s RRset", m.Id, dns.TypeToString[first.Header().Rrtype])
+	}
+
+	// the message may be cached as is
+	minimal := *m
+	minimal.Answer = answer
+	return mw.ResponseWriter.WriteMsg(&minimal)
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestQtypeRules(t *testing.T) {
+	config := &Config{
+		QtypePolicy: []string{"axfr/udp=refuse", "NULL=drop", "TXT/tcp=forward", "txt=NXDOMAIN", "TYPE65=nodata"},
+	}
+	s := &server{config: config}
+	for _, value := range config.QtypePolicy {
+		rule, err := parseQtypeRule(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.QtypeRules = append(config.QtypeRules, rule)
+	}
+
+	tests := []struct {
+		qtype  uint16
+		tcp    bool
+		action string
+	}{
+		{dns.TypeAXFR, false, "refuse"},
+		{dns.TypeAXFR, true, ""},
+		{dns.TypeNULL, false, "drop"},
+		{dns.TypeNULL, true, "drop"},
+		{dns.TypeTXT, true, "forward"},
+		{dns.TypeTXT, false, "nxdomain"},
+		{dns.TypeHTTPS, false, "nodata"},
+		{dns.TypeA, false, ""},
+	}
+	for _, tc := range tests {
+		if action := s.qtypeAction(tc.qtype, tc.tcp); action != tc.action {
+			t.Errorf("%s tcp=%t: expected %q, got %q", dns.TypeToString[tc.qtype], tc.tcp, tc.action, action)
+		}
+	}
+
+	for _, invalid := range []string{"A", "A=allow", "FOO=refuse", "A/sctp=refuse", "TYPE70000=drop"} {
+		if _, err := parseQtypeRule(invalid); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestMinimalAny(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeANY)
+	for _, s := range []string{
+		"example.com. 60 IN RRSIG A 8 2 60 20300101000000 20200101000000 1 example.com. AAAA",
+		"example.com. 60 IN A 192.0.2.1",
+		"example.com. 60 IN A 192.0.2.2",
+		"example.com. 60 IN AAAA 2001:db8::1",
+		"example.com. 60 IN MX 10 mail.example.com.",
+		"example.com. 60 IN RRSIG MX 8 2 60 20300101000000 20200101000000 1 example.com. AAAA",
+	} {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Answer = append(m.Answer, rr)
+	}
+
+	rw := new(recordingWriter)
+	mw := &minimalAnyWriter{ResponseWriter: rw}
+	if err := mw.WriteMsg(m); err != nil {
+		t.Fatal(err)
+	}
+	if len(rw.msg.Answer) != 3 {
+		t.Fatalf("expected the A RRset and its signature, got %v", rw.msg.Answer)
+	}
+	for _, rr := range rw.msg.Answer {
+		if sig, ok := rr.(*dns.RRSIG); (ok && sig.TypeCovered != dns.TypeA) || (!ok && rr.Header().Rrtype != dns.TypeA) {
+			t.Errorf("unexpected record %s", rr)
+		}
+	}
+	if len(m.Answer) != 6 {
+		t.Errorf("expected the original message to be unchanged")
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// How often buckets of clients that stopped querying are removed
+const rateLimitCleanup = time.Minute
+
+// Number of buckets above which per-name limits fall back to the bucket of
+// the client network
+const rateLimitMaxBuckets = 100000
+
+type limitAction int
+
+const (
+	limitPass limitAction = iota
+	limitDrop
+	limitSlip
+)
+
+type bucket struct {
+	tokens  float64
+	last    time.Time
+	limited int // responses limited since the bucket was last full
+}
+
+// rateLimiter limits UDP responses with a token bucket per client network
+// and, optionally, per response in the style of BIND's response rate
+// limiting: answers are limited per query name and type, negative answers
+// per zone, so random names do not get a bucket each. Limited responses are
+// dropped except for every slip-th one, which is sent truncated so
+// legitimate clients retry over TCP.
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	slip    int
+	v4Mask  net.IPMask
+	v6Mask  net.IPMask
+	perName bool
+	exempt  []*net.IPNet
+
+	now        func() time.Time
+	buckets    map[string]*bucket
+	maxBuckets int
+	mutex      sync.Mutex
+}
+
+func newRateLimiter(config *Config) *rateLimiter {
+	l := &rateLimiter{
+		rate:    float64(config.RateLimit),
+		burst:   float64(config.RateLimitBurst),
+		slip:    config.RateLimitSlip,
+		v4Mask:  net.CIDRMask(config.RateLimitIPv4Prefix, 32),
+		v6Mask:  net.CIDRMask(config.RateLimitIPv6Prefix, 128),
+		perName: config.RateLimitPerName,
+		exempt:  config.RateLimitExemptNets,
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+
+		maxBuckets: rateLimitMaxBuckets,
+	}
+	return l
+}
+
+// limit takes a token from the bucket of the client network, or of the
+// response name of the client network if not empty, and returns what to do
+// with the response.
+func (l *rateLimiter) limit(ip net.IP, name string) limitAction {
+	if ip == nil || longestMatch(l.exempt, ip) >= 0 {
+		return limitPass
+	}
+
+	var network string
+	if ip4 := ip.To4(); ip4 != nil {
+		network = ip4.Mask(l.v4Mask).String()
+	} else {
+		network = ip.Mask(l.v6Mask).String()
+	}
+
+	now := l.now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	key := network
+	if name != "" {
+		key += "/" + name
+	}
+	b, ok := l.buckets[key]
+	if !ok && key != network && len(l.buckets) >= l.maxBuckets {
+		key = network
+		b, ok = l.buckets[key]
+	}
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens >= l.burst {
+		b.tokens = l.burst
+		b.limited = 0
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return limitPass
+	}
+	b.limited++
+	if l.slip > 0 && b.limited%l.slip == 0 {
+		return limitSlip
+	}
+	return limitDrop
+}
+
+// cleanup removes the buckets that have been refilled completely, which
+// behave exactly like new ones.
+func (l *rateLimiter) cleanup() {
+	now := l.now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// responseName returns the name the buckets of a response are kept by:
+// the query name and type of answers and the zone of negative answers, from
+// the SOA record of the authority section. Other responses are only limited
+// per client network.
+func responseName(m *dns.Msg) string {
+	if len(m.Question) == 0 {
+		return ""
+	}
+	switch {
+	case m.Rcode == dns.RcodeSuccess && len(m.Answer) > 0:
+		q := m.Question[0]
+		return strings.ToLower(q.Name) + "/" + strconv.Itoa(int(q.Qtype))
+	case m.Rcode == dns.RcodeSuccess || m.Rcode == dns.RcodeNameError:
+		for _, rr := range m.Ns {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				return dns.RcodeToString[m.Rcode] + "/" + strings.ToLower(rr.Header().Name)
+			}
+		}
+	}
+	return ""
+}
+
+// rateLimitWriter applies per-name limits to the response of a query
+type rateLimitWriter struct {
+	dns.ResponseWriter
+	l *rateLimiter
+}
+
+func (rw *rateLimitWriter) WriteMsg(m *dns.Msg) error {
+	switch rw.l.limit(clientIP(rw), responseName(m)) {
+	case limitDrop:
+		log.Debugf("[%d] Dropped rate limited response to %s", m.Id, rw.RemoteAddr().String())
+		StatsRateLimitedCount.Inc(1)
+		return nil
+	case limitSlip:
+		log.Debugf("[%d] Truncated rate limited response to %s", m.Id, rw.RemoteAddr().String())
+		StatsRateLimitedCount.Inc(1)
+		tc := &dns.Msg{MsgHdr: m.MsgHdr, Question: m.Question}
+		tc.Rcode = dns.RcodeSuccess
+		tc.Truncated = true
+		return rw.ResponseWriter.WriteMsg(tc)
+	}
+	return rw.ResponseWriter.WriteMsg(m)
+}
+
+func (l *rateLimiter) cleanupBuckets(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	for range ticker.C {
+		l.cleanup()
+	}
+}
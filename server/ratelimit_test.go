@@ -0,0 +1,167 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	newLimiter := func(config *Config) *rateLimiter {
+		config.RateLimitIPv4Prefix = 24
+		config.RateLimitIPv6Prefix = 56
+		if err := CheckConfig(config); err != nil {
+			t.Fatal(err)
+		}
+		l := newRateLimiter(config)
+		l.now = func() time.Time { return now }
+		return l
+	}
+	base := func() *Config {
+		return &Config{DnsAddr: "127.0.0.1:53", NoRec: true, RCacheTtl: 60, Ndots: 1}
+	}
+
+	client := net.ParseIP("192.0.2.1")
+
+	config := base()
+	config.RateLimit = 2
+	config.RateLimitBurst = 4
+	config.RateLimitSlip = 2
+	config.RateLimitExempt = []string{"198.51.100.0/24"}
+	l := newLimiter(config)
+
+	expected := []limitAction{limitPass, limitPass, limitPass, limitPass, limitDrop, limitSlip, limitDrop, limitSlip}
+	for i, e := range expected {
+		if a := l.limit(client, ""); a != e {
+			t.Errorf("query %d: expected %d, got %d", i, e, a)
+		}
+	}
+
+	// same /24 shares the bucket
+	if a := l.limit(net.ParseIP("192.0.2.200"), ""); a == limitPass {
+		t.Errorf("expected client in the same network to be limited")
+	}
+	if a := l.limit(net.ParseIP("192.0.3.1"), ""); a != limitPass {
+		t.Errorf("expected client in another network to pass, got %d", a)
+	}
+	for i := 0; i < 10; i++ {
+		if a := l.limit(net.ParseIP("198.51.100.1"), ""); a != limitPass {
+			t.Fatalf("expected exempt client to pass, got %d", a)
+		}
+	}
+
+	// the bucket refills at the rate
+	now = now.Add(time.Second)
+	for i := 0; i < 2; i++ {
+		if a := l.limit(client, ""); a != limitPass {
+			t.Errorf("expected pass after refill, got %d", a)
+		}
+	}
+	if a := l.limit(client, ""); a == limitPass {
+		t.Errorf("expected limit after using the refill")
+	}
+
+	// full buckets are removed
+	now = now.Add(time.Minute)
+	l.cleanup()
+	if len(l.buckets) != 0 {
+		t.Errorf("expected all buckets to be removed, got %d", len(l.buckets))
+	}
+
+	config = base()
+	config.RateLimit = 1
+	config.RateLimitPerName = true
+	l = newLimiter(config)
+	if a := l.limit(client, "example.com./1"); a != limitPass {
+		t.Errorf("expected pass, got %d", a)
+	}
+	if a := l.limit(client, "example.com./1"); a != limitDrop {
+		t.Errorf("expected drop without slip, got %d", a)
+	}
+	if a := l.limit(client, "example.org./1"); a != limitPass {
+		t.Errorf("expected other name to pass, got %d", a)
+	}
+
+	// with the table full new names share the bucket of the network
+	l.maxBuckets = 2
+	if a := l.limit(client, "example.net./1"); a != limitPass {
+		t.Errorf("expected the network bucket to pass, got %d", a)
+	}
+	if a := l.limit(client, "www.example.net./1"); a != limitDrop {
+		t.Errorf("expected the network bucket to drop, got %d", a)
+	}
+	if len(l.buckets) != 3 {
+		t.Errorf("expected 3 buckets, got %d", len(l.buckets))
+	}
+}
+
+func TestResponseName(t *testing.T) {
+	soa, _ := dns.NewRR("example.com. 300 IN SOA ns.example.com. hostmaster.example.com. 1 7200 3600 1209600 300")
+	a, _ := dns.NewRR("www.example.com. 300 IN A 192.0.2.1")
+	response := func(name string, rcode int, answer, ns []dns.RR) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		m.Rcode, m.Answer, m.Ns = rcode, answer, ns
+		return m
+	}
+
+	tests := []struct {
+		m    *dns.Msg
+		name string
+	}{
+		{response("WWW.example.com.", dns.RcodeSuccess, []dns.RR{a}, nil), "www.example.com./1"},
+		{response("x1.example.com.", dns.RcodeNameError, nil, []dns.RR{soa}), "NXDOMAIN/example.com."},
+		{response("x2.example.com.", dns.RcodeNameError, nil, []dns.RR{soa}), "NXDOMAIN/example.com."},
+		{response("x3.example.com.", dns.RcodeSuccess, nil, []dns.RR{soa}), "NOERROR/example.com."},
+		{response("x4.example.com.", dns.RcodeNameError, nil, nil), ""},
+		{response("x5.example.com.", dns.RcodeServerFailure, nil, nil), ""},
+	}
+	for _, tc := range tests {
+		if name := responseName(tc.m); name != tc.name {
+			t.Errorf("%s %s: expected %q, got %q", tc.m.Question[0].Name, dns.RcodeToString[tc.m.Rcode], tc.name, name)
+		}
+	}
+}
+
+func TestRateLimitRandomNames(t *testing.T) {
+	upstream := newTestUpstream(t, func(m *dns.Msg) {
+		soa, _ := dns.NewRR("example.com. 300 IN SOA ns.example.com. hostmaster.example.com. 1 7200 3600 1209600 300")
+		m.Rcode = dns.RcodeNameError
+		m.Ns = []dns.RR{soa}
+	})
+	s := newTestServer(t, testHosts{}, &Config{
+		Nameservers:      []string{upstream.addr},
+		RateLimit:        1,
+		RateLimitBurst:   5,
+		RateLimitSlip:    2,
+		RateLimitPerName: true,
+	})
+
+	var answered, truncated int
+	for i := 0; i < 20; i++ {
+		r := ask(s, fmt.Sprintf("random%d.example.com.", i), dns.TypeA, false)
+		switch {
+		case r == nil:
+		case r.Truncated:
+			truncated++
+		default:
+			answered++
+		}
+	}
+	if answered != 5 || truncated == 0 {
+		t.Errorf("expected 5 answers and truncated responses for random names, got %d and %d", answered, truncated)
+	}
+	if n := len(s.limiter.buckets); n != 1 {
+		t.Errorf("expected one bucket for the zone, got %d", n)
+	}
+}
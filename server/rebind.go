@@ -0,0 +1,77 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// rebindAllowed returns true if name may resolve to private addresses
+func (s *server) rebindAllowed(name string) bool {
+	for _, domain := range s.config.RebindDomainsOK {
+		if dns.IsSubDomain(domain, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// stopRebind removes private, loopback and link-local addresses from an
+// upstream response for a public name. It returns REFUSED instead if
+// configured and any address was removed.
+func (s *server) stopRebind(req, r *dns.Msg, upstream string) *dns.Msg {
+	name := req.Question[0].Name
+	if s.rebindAllowed(name) {
+		return r
+	}
+
+	var answer []dns.RR
+	for _, rr := range r.Answer {
+		var ip net.IP
+		switch t := rr.(type) {
+		case *dns.A:
+			ip = t.A
+		case *dns.AAAA:
+			ip = t.AAAA
+		}
+		if ip != nil && privateAddr(ip) {
+			log.Warnf("[%d] Possible DNS rebinding: upstream %s resolved '%s' to %s", req.Id, upstream, name, ip)
+			continue
+		}
+		answer = append(answer, rr)
+	}
+	if len(answer) == len(r.Answer) {
+		return r
+	}
+	StatsRebindCount.Inc(1)
+
+	if s.config.RebindAction == "refused" {
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeRefused)
+		setEDE(m, dns.ExtendedErrorCodeBlocked, "DNS rebinding protection")
+		return m
+	}
+	r.Answer = answer
+	r.AuthenticatedData = false
+	return r
+}
+
+// privateAddr returns true for addresses that must not be returned for
+// public names: RFC 1918 and unique local, loopback, link-local, carrier
+// grade NAT and "this network" addresses.
+func privateAddr(ip net.IP) bool {
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return true
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4[0] == 0 || ip4[0] == 100 && ip4[1]&0xc0 == 64
+	}
+	return false
+}
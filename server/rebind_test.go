@@ -0,0 +1,78 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestPrivateAddr(t *testing.T) {
+	tests := map[string]bool{
+		"10.1.2.3":        true,
+		"172.16.0.1":      true,
+		"172.32.0.1":      false,
+		"192.168.1.1":     true,
+		"127.0.0.1":       true,
+		"169.254.1.1":     true,
+		"0.0.0.0":         true,
+		"0.1.2.3":         true,
+		"100.64.0.1":      true,
+		"100.128.0.1":     false,
+		"192.0.2.1":       false,
+		"::1":             true,
+		"::":              true,
+		"fd00::1":         true,
+		"fe80::1":         true,
+		"2001:db8::1":     false,
+		"::ffff:10.0.0.1": true,
+	}
+	for addr, expected := range tests {
+		if private := privateAddr(net.ParseIP(addr)); private != expected {
+			t.Errorf("%s: expected private %t, got %t", addr, expected, private)
+		}
+	}
+}
+
+func TestStopRebind(t *testing.T) {
+	response := func(name string, records ...string) (*dns.Msg, *dns.Msg) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		r := new(dns.Msg)
+		r.SetReply(req)
+		for _, s := range records {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Answer = append(r.Answer, rr)
+		}
+		return req, r
+	}
+
+	s := &server{config: &Config{RebindDomainsOK: []string{"corp.example."}}}
+
+	req, r := response("www.example.com.", "www.example.com. 60 IN CNAME lb.example.com.",
+		"lb.example.com. 60 IN A 10.0.0.1", "lb.example.com. 60 IN A 192.0.2.1")
+	r = s.stopRebind(req, r, "192.0.2.53:53")
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 2 || r.Answer[1].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("expected the private address to be stripped, got %v", r.Answer)
+	}
+
+	req, r = response("db.corp.example.", "db.corp.example. 60 IN A 10.0.0.1")
+	if r = s.stopRebind(req, r, "192.0.2.53:53"); len(r.Answer) != 1 {
+		t.Errorf("expected allowed domain to keep private address, got %v", r.Answer)
+	}
+
+	s.config.RebindAction = "refused"
+	req, r = response("www.example.com.", "www.example.com. 60 IN A 127.0.0.1")
+	if r = s.stopRebind(req, r, "192.0.2.53:53"); r.Rcode != dns.RcodeRefused || len(r.Answer) != 0 {
+		t.Errorf("expected REFUSED, got %s %v", dns.RcodeToString[r.Rcode], r.Answer)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"github.com/miekg/dns"
+)
+
+// checkRequest returns the response code to answer requests we do not
+// resolve with, dns.RcodeSuccess for standard queries.
+func checkRequest(req *dns.Msg) int {
+	switch req.Opcode {
+	case dns.OpcodeQuery:
+	case dns.OpcodeNotify:
+		// we are secondary for no zone (RFC 1996 section 3.10)
+		return dns.RcodeRefused
+	default:
+		// IQUERY is obsolete (RFC 3425), dynamic updates go to primaries
+		return dns.RcodeNotImplemented
+	}
+
+	// Multiple questions are not defined (RFC 9619)
+	if len(req.Question) != 1 {
+		return dns.RcodeFormatError
+	}
+	switch req.Question[0].Qtype {
+	case dns.TypeOPT, dns.TypeTSIG:
+		// pseudo records cannot be asked for
+		return dns.RcodeFormatError
+	}
+
+	// At most one OPT record (RFC 6891 section 6.1.1)
+	opts := 0
+	for _, rr := range req.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			opts++
+		}
+	}
+	if opts > 1 {
+		return dns.RcodeFormatError
+	}
+	return dns.RcodeSuccess
+}
+
+// badRequest answers a request checkRequest did not accept with the reply m
+func badRequest(w dns.ResponseWriter, m *dns.Msg, rcode int) {
+	m.Rcode = rcode
+	StatsInvalidCount.Inc(1)
+	writeMsg(w, m)
+}
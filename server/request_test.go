@@ -0,0 +1,134 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCheckRequest(t *testing.T) {
+	query := func(opcode int, names ...string) *dns.Msg {
+		m := new(dns.Msg)
+		m.Opcode = opcode
+		for _, name := range names {
+			m.Question = append(m.Question, dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		}
+		return m
+	}
+	optQuestion := query(dns.OpcodeQuery, "example.com.")
+	optQuestion.Question[0].Qtype = dns.TypeOPT
+	twoOPT := query(dns.OpcodeQuery, "example.com.")
+	twoOPT.SetEdns0(1232, false)
+	twoOPT.SetEdns0(4096, true)
+	oneOPT := query(dns.OpcodeQuery, "example.com.")
+	oneOPT.SetEdns0(1232, false)
+
+	tests := []struct {
+		name  string
+		req   *dns.Msg
+		rcode int
+	}{
+		{"query", query(dns.OpcodeQuery, "example.com."), dns.RcodeSuccess},
+		{"EDNS query", oneOPT, dns.RcodeSuccess},
+		{"no question", query(dns.OpcodeQuery), dns.RcodeFormatError},
+		{"two questions", query(dns.OpcodeQuery, "example.com.", "example.net."), dns.RcodeFormatError},
+		{"OPT question", optQuestion, dns.RcodeFormatError},
+		{"two OPT records", twoOPT, dns.RcodeFormatError},
+		{"NOTIFY", query(dns.OpcodeNotify, "example.com."), dns.RcodeRefused},
+		{"UPDATE", query(dns.OpcodeUpdate, "example.com."), dns.RcodeNotImplemented},
+		{"IQUERY", query(dns.OpcodeIQuery), dns.RcodeNotImplemented},
+		{"STATUS", query(dns.OpcodeStatus, "example.com."), dns.RcodeNotImplemented},
+	}
+	for _, tc := range tests {
+		if rcode := checkRequest(tc.req); rcode != tc.rcode {
+			t.Errorf("%s: expected %s, got %s", tc.name, dns.RcodeToString[tc.rcode], dns.RcodeToString[rcode])
+		}
+	}
+}
+
+func TestDeniedNotify(t *testing.T) {
+	for _, action := range []string{"drop", "refused"} {
+		s := newTestServer(t, testHosts{}, &Config{NoRec: true, RCache: 100, AllowClients: []string{"10.0.0.0/8"}, DenyAction: action})
+
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeSOA)
+		req.Opcode = dns.OpcodeNotify
+		w := &recordingWriter{addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}}
+		s.ServeDNS(w, req)
+
+		switch {
+		case action == "drop" && w.msg != nil:
+			t.Errorf("%s: expected no response, got %s", action, dns.RcodeToString[w.msg.Rcode])
+		case action == "refused" && (w.msg == nil || w.msg.Rcode != dns.RcodeRefused):
+			t.Errorf("%s: expected REFUSED, got %v", action, w.msg)
+		}
+	}
+}
+
+func FuzzServeDNS(f *testing.F) {
+	seed := func(m *dns.Msg) {
+		buf, err := m.Pack()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf, false)
+		f.Add(buf, true)
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	seed(m)
+	m.SetEdns0(1232, true)
+	seed(m)
+	m = new(dns.Msg)
+	m.SetQuestion("1.0.0.127.in-addr.arpa.", dns.TypePTR)
+	seed(m)
+	m.Question = nil
+	seed(m)
+	m.SetQuestion("example.com.", dns.TypeSOA)
+	m.Opcode = dns.OpcodeNotify
+	seed(m)
+	m.SetReply(m)
+	seed(m)
+	m = new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeANY)
+	m.Question = append(m.Question, m.Question[0])
+	seed(m)
+
+	config := &Config{DnsAddr: "127.0.0.1:53", NoRec: true, RCache: 100, RCacheTtl: 60, Ndots: 1, Cookies: true}
+	if err := CheckConfig(config); err != nil {
+		f.Fatal(err)
+	}
+	s := New(testHosts{}, config, "test")
+
+	f.Fuzz(func(t *testing.T, buf []byte, tcp bool) {
+		req := new(dns.Msg)
+		if err := req.Unpack(buf); err != nil {
+			return
+		}
+		w := &recordingWriter{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}}
+		if tcp {
+			w.addr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+		}
+		s.ServeDNS(w, req)
+
+		if w.msg == nil {
+			return
+		}
+		if req.Response {
+			t.Fatal("answered a response")
+		}
+		if w.msg.Id != req.Id {
+			t.Fatalf("expected response ID %d, got %d", req.Id, w.msg.Id)
+		}
+		if _, err := w.msg.Pack(); err != nil {
+			t.Fatalf("failed to pack response: %v", err)
+		}
+	})
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// RewriteRule maps query names to the names that are resolved instead
+type RewriteRule struct {
+	// exact, suffix or regex
+	Type string
+	From string
+	To   string
+	re   *regexp.Regexp
+}
+
+// parseRewriteRule parses a rule given as <exact|suffix|regex> <from> <to>.
+// Regex rules match the lower case, fully qualified name and may refer to
+// groups as $1 in the replacement.
+func parseRewriteRule(value string) (*RewriteRule, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("Invalid rewrite rule, expected <exact|suffix|regex> <from> <to>: %s", value)
+	}
+	r := &RewriteRule{Type: strings.ToLower(fields[0]), From: fields[1], To: fields[2]}
+
+	switch r.Type {
+	case "exact", "suffix":
+		r.From = dns.Fqdn(strings.ToLower(r.From))
+		r.To = dns.Fqdn(strings.ToLower(r.To))
+		if _, ok := dns.IsDomainName(r.From); !ok {
+			return nil, fmt.Errorf("Invalid name in rewrite rule: %s", r.From)
+		}
+		if _, ok := dns.IsDomainName(r.To); !ok {
+			return nil, fmt.Errorf("Invalid name in rewrite rule: %s", r.To)
+		}
+	case "regex":
+		re, err := regexp.Compile(r.From)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid regular expression in rewrite rule: %s", err)
+		}
+		r.re = re
+	default:
+		return nil, fmt.Errorf("Invalid rewrite rule type, expected exact, suffix or regex: %s", value)
+	}
+	return r, nil
+}
+
+// rewrite returns the name to resolve instead of the lower case name, and
+// whether the rule matched.
+func (r *RewriteRule) rewrite(name string) (string, bool) {
+	switch r.Type {
+	case "exact":
+		return r.To, name == r.From
+	case "suffix":
+		if name == r.From {
+			return r.To, true
+		}
+		if strings.HasSuffix(name, "."+r.From) {
+			return strings.TrimSuffix(name, r.From) + r.To, true
+		}
+		return "", false
+	}
+
+	match := r.re.FindStringSubmatchIndex(name)
+	if match == nil {
+		return "", false
+	}
+	target := dns.Fqdn(strings.ToLower(string(r.re.ExpandString(nil, r.To, name, match))))
+	if _, ok := dns.IsDomainName(target); !ok {
+		return "", false
+	}
+	return target, true
+}
+
+// rewrite returns the name to resolve instead of name according to the
+// first matching rule.
+func (s *server) rewrite(name string) (string, bool) {
+	for _, r := range s.config.RewriteRules {
+		if target, ok := r.rewrite(name); ok && target != name {
+			return target, true
+		}
+	}
+	return "", false
+}
+
+// rewriteWriter restores the original query name in responses to a
+// rewritten query. The answer is either led by a CNAME from the original
+// to the rewritten name, or flattened to records owned by the original name.
+type rewriteWriter struct {
+	dns.ResponseWriter
+	s      *server
+	name   string // original query name
+	target string
+}
+
+func (rw *rewriteWriter) WriteMsg(m *dns.Msg) error {
+	// the message may be cached as is
+	r := *m
+	r.Question = make([]dns.Question, len(m.Question))
+	copy(r.Question, m.Question)
+	if len(r.Question) > 0 {
+		r.Question[0].Name = rw.name
+	}
+	// no upstream signed the answer for the original name
+	r.AuthenticatedData = false
+
+	if len(m.Answer) > 0 {
+		if rw.s.config.RewriteAnswer == "flatten" {
+			r.Answer = flatten(m.Answer, rw.name, r.Question[0].Qtype)
+		} else {
+			ttl := rw.s.config.Ttl
+			for _, rr := range m.Answer {
+				if rr.Header().Ttl < ttl {
+					ttl = rr.Header().Ttl
+				}
+			}
+			cname := &dns.CNAME{
+				Hdr:    dns.RR_Header{Name: rw.name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl},
+				Target: rw.target,
+			}
+			r.Answer = append([]dns.RR{cname}, m.Answer...)
+		}
+	}
+	return rw.ResponseWriter.WriteMsg(&r)
+}
+
+// flatten returns the answer records of the query type owned by name,
+// dropping the CNAME chain and signatures that no longer match.
+func flatten(answer []dns.RR, name string, qtype uint16) []dns.RR {
+	var flat []dns.RR
+	for _, rr := range answer {
+		rrtype := rr.Header().Rrtype
+		if rrtype == dns.TypeRRSIG || rrtype == dns.TypeCNAME && qtype != dns.TypeCNAME {
+			continue
+		}
+		if qtype != dns.TypeANY && rrtype != qtype {
+			continue
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Name = name
+		flat = append(flat, rr)
+	}
+	return flat
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRewrite(t *testing.T) {
+	config := &Config{Rewrites: []string{
+		"exact db.svc db-primary.prod.internal",
+		"suffix legacy.corp. corp.example.com.",
+		`regex ^([a-z0-9-]+)\.pod\.local\.$ $1.pods.internal.`,
+		"suffix loop.example. loop.example.",
+	}}
+	for _, value := range config.Rewrites {
+		rule, err := parseRewriteRule(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.RewriteRules = append(config.RewriteRules, rule)
+	}
+	s := &server{config: config}
+
+	tests := map[string]string{
+		"db.svc.":                "db-primary.prod.internal.",
+		"x.db.svc.":              "",
+		"legacy.corp.":           "corp.example.com.",
+		"www.legacy.corp.":       "www.corp.example.com.",
+		"a.b.legacy.corp.":       "a.b.corp.example.com.",
+		"notlegacy.corp.":        "",
+		"web-1.pod.local.":       "web-1.pods.internal.",
+		"a.web-1.pod.local.":     "",
+		"www.loop.example.":      "",
+		"unrelated.example.com.": "",
+	}
+	for name, expected := range tests {
+		target, ok := s.rewrite(name)
+		if expected == "" {
+			if ok {
+				t.Errorf("%s: expected no rewrite, got %s", name, target)
+			}
+			continue
+		}
+		if !ok || target != expected {
+			t.Errorf("%s: expected %s, got %s", name, expected, target)
+		}
+	}
+
+	for _, invalid := range []string{"exact db.svc", "prefix a. b.", "regex ([ x.", "exact a..b c."} {
+		if _, err := parseRewriteRule(invalid); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestRewriteWriter(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("db-primary.prod.internal.", dns.TypeA)
+	for _, s := range []string{
+		"db-primary.prod.internal. 300 IN CNAME db1.prod.internal.",
+		"db1.prod.internal. 60 IN A 10.0.0.1",
+	} {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Answer = append(m.Answer, rr)
+	}
+	m.AuthenticatedData = true
+
+	s := &server{config: &Config{Ttl: 360}}
+	rec := new(recordingWriter)
+	rw := &rewriteWriter{ResponseWriter: rec, s: s, name: "DB.svc.", target: "db-primary.prod.internal."}
+	if err := rw.WriteMsg(m); err != nil {
+		t.Fatal(err)
+	}
+	if rec.msg.Question[0].Name != "DB.svc." {
+		t.Errorf("expected original question, got %s", rec.msg.Question[0].Name)
+	}
+	if len(rec.msg.Answer) != 3 {
+		t.Fatalf("expected CNAME and the original answer, got %v", rec.msg.Answer)
+	}
+	if cname, ok := rec.msg.Answer[0].(*dns.CNAME); !ok || cname.Hdr.Name != "DB.svc." ||
+		cname.Target != "db-primary.prod.internal." || cname.Hdr.Ttl != 60 {
+		t.Errorf("unexpected CNAME %s", rec.msg.Answer[0])
+	}
+	if rec.msg.AuthenticatedData {
+		t.Error("expected the AD bit to be cleared for the synthesized CNAME")
+	}
+
+	s.config.RewriteAnswer = "flatten"
+	if err := rw.WriteMsg(m); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.msg.Answer) != 1 || rec.msg.Answer[0].Header().Name != "DB.svc." {
+		t.Fatalf("expected flattened A record, got %v", rec.msg.Answer)
+	}
+	if rec.msg.AuthenticatedData {
+		t.Error("expected the AD bit to be cleared for the flattened answer")
+	}
+
+	// the written message is not modified
+	if m.Question[0].Name != "db-primary.prod.internal." || len(m.Answer) != 2 || !m.AuthenticatedData ||
+		m.Answer[1].Header().Name != "db1.prod.internal." {
+		t.Errorf("expected the original message to be unchanged")
+	}
+}
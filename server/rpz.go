@@ -0,0 +1,77 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"net"
+
+	"github.com/claranet/go-dnsmasq/rpz"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// policyWriter applies the response triggers of the policy zones to the
+// responses written for a query that did not trigger a rule itself.
+type policyWriter struct {
+	dns.ResponseWriter
+	s   *server
+	req *dns.Msg
+}
+
+func (pw *policyWriter) WriteMsg(m *dns.Msg) error {
+	rule := pw.s.config.RPZ.ResponseRule(m)
+	if rule == nil || rule.Action == rpz.Passthru || rule.Action == rpz.TCPOnly && isTCP(pw) {
+		return pw.ResponseWriter.WriteMsg(m)
+	}
+	log.Debugf("[%d] Response triggered %s policy %s of zone %s", pw.req.Id, rule.Trigger, rule.Action, rule.Zone)
+	StatsPolicyCount.Inc(1)
+	if resp := pw.s.PolicyResponse(pw.req, rule, clientIP(pw), isTCP(pw)); resp != nil {
+		return pw.ResponseWriter.WriteMsg(resp)
+	}
+	return nil
+}
+
+// PolicyResponse returns the answer to req for the policy rule it
+// triggered, or nil if the query must be dropped. A CNAME rewrite is
+// followed by forwarding the query for the target name if the client may
+// have its queries forwarded, otherwise only the CNAME is returned.
+func (s *server) PolicyResponse(req *dns.Msg, rule *rpz.Rule, client net.IP, tcp bool) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.RecursionAvailable = true
+	m.Compress = true
+
+	q := req.Question[0]
+	switch rule.Action {
+	case rpz.Drop:
+		return nil
+	case rpz.NXDomain:
+		m.Rcode = dns.RcodeNameError
+		setEDE(m, dns.ExtendedErrorCodeBlocked, rule.Zone)
+	case rpz.NoData:
+		setEDE(m, dns.ExtendedErrorCodeBlocked, rule.Zone)
+	case rpz.TCPOnly:
+		m.Truncated = true
+	case rpz.LocalData:
+		m.Answer = rule.Answer(q)
+		setEDE(m, dns.ExtendedErrorCodeForgedAnswer, rule.Zone)
+		if len(m.Answer) == 1 && q.Qtype != dns.TypeCNAME {
+			if cname, ok := m.Answer[0].(*dns.CNAME); ok && s.forwardable(cname.Target, client) {
+				target := req.Copy()
+				target.Question[0].Name = cname.Target
+				r, err := s.forwardQuery(target, tcp)
+				if err != nil {
+					log.Errorf("[%d] Error resolving policy rewrite target '%s': %v", req.Id, cname.Target, err)
+					break
+				}
+				m.Answer = append(m.Answer, r.Answer...)
+				m.Rcode = r.Rcode
+			}
+		}
+	}
+	return m
+}
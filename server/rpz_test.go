@@ -0,0 +1,124 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/claranet/go-dnsmasq/rpz"
+	"github.com/miekg/dns"
+)
+
+const testPolicyZone = `$TTL 300
+@                         SOA   localhost. hostmaster.localhost. 1 3600 600 86400 60
+                          NS    localhost.
+nx.example                CNAME .
+nodata.example            CNAME *.
+drop.example              CNAME rpz-drop.
+tcp.example               CNAME rpz-tcp-only.
+portal.example            CNAME garden.example.
+printer.example           A     192.168.0.10
+32.66.100.51.198.rpz-ip   CNAME .
+`
+
+func newTestPolicy(t *testing.T) *rpz.Policy {
+	path := filepath.Join(t.TempDir(), "rpz.zone")
+	if err := os.WriteFile(path, []byte(testPolicyZone), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := rpz.New(&rpz.Config{Zones: []rpz.ZoneConfig{{Name: "rpz.local.", File: path}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestPolicyZones(t *testing.T) {
+	upstream := newTestUpstream(t, func(m *dns.Msg) {
+		q := m.Question[0]
+		addr := "192.0.2.1"
+		if q.Name == "evil.example." {
+			addr = "198.51.100.66"
+		}
+		if q.Qtype == dns.TypeA {
+			rr, _ := dns.NewRR(q.Name + " 60 IN A " + addr)
+			m.Answer = []dns.RR{rr}
+		}
+	})
+	config := &Config{Nameservers: []string{upstream.addr}}
+	s := newTestServer(t, testHosts{}, config)
+	config.RPZ = newTestPolicy(t)
+
+	tests := []struct {
+		name      string
+		tcp       bool
+		rcode     int
+		answer    []string // owner names of the answer
+		truncated bool
+		ede       []uint16
+	}{
+		{"nx.example.", false, dns.RcodeNameError, nil, false, []uint16{dns.ExtendedErrorCodeBlocked}},
+		{"nodata.example.", false, dns.RcodeSuccess, nil, false, []uint16{dns.ExtendedErrorCodeBlocked}},
+		{"tcp.example.", false, dns.RcodeSuccess, nil, true, nil},
+		{"tcp.example.", true, dns.RcodeSuccess, []string{"tcp.example."}, false, nil},
+		{"printer.example.", false, dns.RcodeSuccess, []string{"printer.example."}, false, []uint16{dns.ExtendedErrorCodeForgedAnswer}},
+		{"portal.example.", false, dns.RcodeSuccess, []string{"portal.example.", "garden.example."}, false, []uint16{dns.ExtendedErrorCodeForgedAnswer}},
+		{"evil.example.", false, dns.RcodeNameError, nil, false, []uint16{dns.ExtendedErrorCodeBlocked}},
+		{"good.example.", false, dns.RcodeSuccess, []string{"good.example."}, false, nil},
+	}
+	for _, tc := range tests {
+		r := ask(s, tc.name, dns.TypeA, tc.tcp)
+		if r == nil || r.Rcode != tc.rcode || r.Truncated != tc.truncated {
+			t.Errorf("%s tcp=%t: expected %s truncated %t, got %v", tc.name, tc.tcp, dns.RcodeToString[tc.rcode], tc.truncated, r)
+			continue
+		}
+		var owners []string
+		for _, rr := range r.Answer {
+			owners = append(owners, rr.Header().Name)
+		}
+		if !slices.Equal(owners, tc.answer) {
+			t.Errorf("%s tcp=%t: expected answers for %v, got %v", tc.name, tc.tcp, tc.answer, r.Answer)
+		}
+		if codes := extendedErrors(r); !slices.Equal(codes, tc.ede) {
+			t.Errorf("%s tcp=%t: expected extended errors %v, got %v", tc.name, tc.tcp, tc.ede, codes)
+		}
+	}
+	if r := ask(s, "drop.example.", dns.TypeA, false); r != nil {
+		t.Errorf("expected no response for drop.example., got %v", r)
+	}
+
+	expected := []string{"tcp.example.", "garden.example.", "evil.example.", "good.example."}
+	if names := upstream.names(); !slices.Equal(names, expected) {
+		t.Errorf("expected queries upstream for %v, got %v", expected, names)
+	}
+}
+
+func TestPolicyRewriteWithoutRecursion(t *testing.T) {
+	for _, config := range []*Config{
+		{AllowRecursion: []string{"10.0.0.0/8"}},
+		{NoRec: true},
+		{LocalDomains: []string{"example."}},
+	} {
+		upstream := newTestUpstream(t, nil)
+		if !config.NoRec {
+			config.Nameservers = []string{upstream.addr}
+		}
+		s := newTestServer(t, testHosts{}, config)
+		config.RPZ = newTestPolicy(t)
+
+		r := ask(s, "portal.example.", dns.TypeA, false)
+		if r == nil || len(r.Answer) != 1 || r.Answer[0].Header().Rrtype != dns.TypeCNAME {
+			t.Errorf("%+v: expected only the CNAME, got %v", config, r)
+		}
+		if names := upstream.names(); len(names) > 0 {
+			t.Errorf("%+v: expected no queries upstream, got %v", config, names)
+		}
+	}
+}
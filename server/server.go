@@ -15,6 +15,8 @@ import (
 	"time"
 
 	"github.com/claranet/go-dnsmasq/cache"
+	"github.com/claranet/go-dnsmasq/dnssec"
+	"github.com/claranet/go-dnsmasq/rpz"
 	"github.com/coreos/go-systemd/activation"
 	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
@@ -27,8 +29,12 @@ type server struct {
 
 	group        *sync.WaitGroup
 	dnsUDPclient *dns.Client // used for forwarding queries
-	dnsTCPclient *dns.Client // used for forwarding queries
+	tcpPool      *tcpPool    // used for forwarding queries over TCP
 	rcache       *cache.Cache
+	limiter      *rateLimiter
+	validator    *dnssec.Validator
+	cookies      *cookies
+	views        []*view
 }
 
 type Hostfile interface {
@@ -36,9 +42,57 @@ type Hostfile interface {
 	FindReverse(name string) (string, error)
 }
 
+// Blocklist decides whether a name must not be resolved
+type Blocklist interface {
+	Blocked(name string) bool
+}
+
+type hostfiles []Hostfile
+
+// MultiHostfile returns a Hostfile that asks each of the given sources in
+// order and returns the first match.
+func MultiHostfile(sources ...Hostfile) Hostfile {
+	return hostfiles(sources)
+}
+
+func (h hostfiles) FindHosts(name string) ([]net.IP, error) {
+	for _, hf := range h {
+		ips, err := hf.FindHosts(name)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) > 0 {
+			return ips, nil
+		}
+	}
+	return nil, nil
+}
+
+func (h hostfiles) HasSubdomains(name string) bool {
+	for _, hf := range h {
+		if f, ok := hf.(SubdomainFinder); ok && f.HasSubdomains(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h hostfiles) FindReverse(name string) (string, error) {
+	for _, hf := range h {
+		host, err := hf.FindReverse(name)
+		if err != nil {
+			return "", err
+		}
+		if host != "" {
+			return host, nil
+		}
+	}
+	return "", nil
+}
+
 // New returns a new server.
 func New(hostfile Hostfile, config *Config, v string) *server {
-	return &server{
+	s := &server{
 		hosts:   hostfile,
 		config:  config,
 		version: v,
@@ -46,8 +100,19 @@ func New(hostfile Hostfile, config *Config, v string) *server {
 		group:        new(sync.WaitGroup),
 		rcache:       cache.New(config.RCache, config.RCacheTtl, config.RStaleTtl, config.RCacheTtlFromResp, config.RCacheTtlMax),
 		dnsUDPclient: &dns.Client{Net: "udp", ReadTimeout: 2 * config.ReadTimeout, WriteTimeout: 2 * config.ReadTimeout, SingleInflight: true},
-		dnsTCPclient: &dns.Client{Net: "tcp", ReadTimeout: 2 * config.ReadTimeout, WriteTimeout: 2 * config.ReadTimeout, SingleInflight: true},
+		tcpPool:      newTCPPool(2*config.ReadTimeout, time.Duration(config.TCPIdleTimeout)*time.Second),
 	}
+	if config.RateLimit > 0 {
+		s.limiter = newRateLimiter(config)
+		go s.limiter.cleanupBuckets(rateLimitCleanup)
+	}
+	if config.DNSSEC {
+		s.validator = dnssec.New(config.TrustAnchors, s.dnssecExchange)
+	}
+	if config.Cookies {
+		s.cookies = newCookies(config)
+	}
+	return s
 }
 
 // Run is a blocking operation that starts the server listening on the DNS ports.
@@ -63,6 +128,19 @@ func (s *server) Run() error {
 		log.Infof("Ready for queries on %s://%s [cache: %s]", net, addr, rCacheState)
 	}
 
+	listenAndServe := func(addr string) {
+		for _, net := range []string{"tcp", "udp"} {
+			s.group.Add(1)
+			go func() {
+				defer s.group.Done()
+				if err := dns.ListenAndServe(addr, net, mux); err != nil {
+					log.Fatalf("%s", err)
+				}
+			}()
+			dnsReadyMsg(addr, net)
+		}
+	}
+
 	if s.config.Systemd {
 		packetConns, err := activation.PacketConns()
 		if err != nil {
@@ -75,8 +153,10 @@ func (s *server) Run() error {
 		if len(packetConns) == 0 && len(listeners) == 0 {
 			return fmt.Errorf("No UDP or TCP sockets supplied by systemd")
 		}
+		var activated []string
 		for _, p := range packetConns {
 			if u, ok := p.(*net.UDPConn); ok {
+				activated = append(activated, u.LocalAddr().String())
 				s.group.Add(1)
 				go func() {
 					defer s.group.Done()
@@ -89,6 +169,7 @@ func (s *server) Run() error {
 		}
 		for _, l := range listeners {
 			if t, ok := l.(*net.TCPListener); ok {
+				activated = append(activated, t.Addr().String())
 				s.group.Add(1)
 				go func() {
 					defer s.group.Done()
@@ -99,23 +180,14 @@ func (s *server) Run() error {
 				dnsReadyMsg(t.Addr().String(), "tcp")
 			}
 		}
+		// views may listen on addresses systemd does not supply
+		for _, addr := range s.viewListeners(activated) {
+			listenAndServe(addr)
+		}
 	} else {
-		s.group.Add(1)
-		go func() {
-			defer s.group.Done()
-			if err := dns.ListenAndServe(s.config.DnsAddr, "tcp", mux); err != nil {
-				log.Fatalf("%s", err)
-			}
-		}()
-		dnsReadyMsg(s.config.DnsAddr, "tcp")
-		s.group.Add(1)
-		go func() {
-			defer s.group.Done()
-			if err := dns.ListenAndServe(s.config.DnsAddr, "udp", mux); err != nil {
-				log.Fatalf("%s", err)
-			}
-		}()
-		dnsReadyMsg(s.config.DnsAddr, "udp")
+		for _, addr := range append([]string{s.config.DnsAddr}, s.viewListeners([]string{s.config.DnsAddr})...) {
+			listenAndServe(addr)
+		}
 	}
 
 	s.group.Wait()
@@ -131,6 +203,17 @@ func (s *server) Stop() {
 // ServeDNS is the handler for DNS requests, responsible for parsing DNS request, possibly forwarding
 // it to a real dns server and returning a response.
 func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	// Responses are never answered, they could be reflected back and forth
+	if req.Response {
+		log.Debugf("[%d] Dropped response from %s", req.Id, w.RemoteAddr().String())
+		StatsInvalidCount.Inc(1)
+		return
+	}
+	if v := s.selectView(clientIP(w), w.LocalAddr()); v != nil {
+		v.ServeDNS(w, req)
+		return
+	}
+
 	startTime := time.Now()
 	defer func() {
 		elapsed := time.Since(startTime)
@@ -146,23 +229,9 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	tcp := false
 	local := true
 
-	q := req.Question[0]
-	name := strings.ToLower(q.Name)
-
-	/*	if q.Qtype == dns.TypeANY {
-		m.Authoritative = false
-		m.Rcode = dns.RcodeRefused
-		m.RecursionAvailable = false
-		m.RecursionDesired = false
-		m.Compress = false
-		// if write fails don't care
-		w.WriteMsg(m)
-
-		return
-	}*/
-
 	if o := req.IsEdns0(); o != nil {
-		bufsize = o.UDPSize()
+		// UDP responses fit both buffers
+		bufsize = min(o.UDPSize(), uint16(s.config.EDNSBufferSize))
 		dnssec = o.Do()
 	}
 	if bufsize < 512 {
@@ -172,6 +241,11 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	if tcp = isTCP(w); tcp {
 		bufsize = dns.MaxMsgSize - 1
 	}
+	cookie, cookieState := "", cookieNone
+	if s.cookies != nil {
+		cookie, cookieState = s.cookies.check(req, clientIP(w))
+	}
+	w = &ednsWriter{ResponseWriter: w, req: req, size: int(bufsize), bufsize: uint16(s.config.EDNSBufferSize), cookie: cookie}
 
 	StatsRequestCount.Inc(1)
 
@@ -179,10 +253,165 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		StatsDnssecOkCount.Inc(1)
 	}
 
+	if !s.config.ClientACL.Allowed(clientIP(w)) {
+		log.Debugf("[%d] Denied query from %s", req.Id, w.RemoteAddr().String())
+		s.Deny(w, m)
+		return
+	}
+
+	if badVersion(req) {
+		log.Debugf("[%d] Unsupported EDNS version %d", req.Id, req.IsEdns0().Version())
+		m.Rcode = dns.RcodeBadVers
+		writeMsg(w, m)
+		return
+	}
+
+	switch {
+	case cookieState == cookieMalformed:
+		log.Debugf("[%d] Malformed cookie from %s", req.Id, w.RemoteAddr().String())
+		m.Rcode = dns.RcodeFormatError
+		StatsInvalidCount.Inc(1)
+		writeMsg(w, m)
+		return
+	case s.config.RequireCookie && !tcp && cookieState == cookieMissing:
+		log.Debugf("[%d] Answering query without valid server cookie from %s with BADCOOKIE", req.Id, w.RemoteAddr().String())
+		m.Rcode = dns.RcodeBadCookie
+		StatsBadCookieCount.Inc(1)
+		writeMsg(w, m)
+		return
+	case s.config.RequireCookie && !tcp && cookieState == cookieNone:
+		log.Debugf("[%d] Truncated response to query without cookie from %s", req.Id, w.RemoteAddr().String())
+		m.Truncated = true
+		StatsBadCookieCount.Inc(1)
+		writeMsg(w, m)
+		return
+	}
+
+	// Only UDP is limited, clients proved their address with TCP or a
+	// valid server cookie
+	switch {
+	case s.limiter == nil || tcp || cookieState == cookieValid:
+	case s.limiter.perName:
+		// the bucket depends on the response
+		w = &rateLimitWriter{ResponseWriter: w, l: s.limiter}
+	default:
+		switch s.limiter.limit(clientIP(w), "") {
+		case limitDrop:
+			log.Debugf("[%d] Dropped rate limited query from %s", req.Id, w.RemoteAddr().String())
+			StatsRateLimitedCount.Inc(1)
+			return
+		case limitSlip:
+			log.Debugf("[%d] Truncated rate limited response to %s", req.Id, w.RemoteAddr().String())
+			StatsRateLimitedCount.Inc(1)
+			m.Truncated = true
+			writeMsg(w, m)
+			return
+		}
+	}
+
+	// Requests we do not resolve are answered only now, they are as
+	// easily spoofed as queries
+	if rcode := checkRequest(req); rcode != dns.RcodeSuccess {
+		log.Debugf("[%d] Answering invalid request from %s with %s", req.Id, w.RemoteAddr().String(), dns.RcodeToString[rcode])
+		badRequest(w, m, rcode)
+		return
+	}
+
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+
 	log.Debugf("[%d] Got query for '%s %s' from %s", req.Id, dns.TypeToString[q.Qtype], q.Name, w.RemoteAddr().String())
 
+	switch action := s.qtypeAction(q.Qtype, tcp); action {
+	case "", "forward":
+	case "drop":
+		log.Debugf("[%d] Dropped %s query by query type policy", req.Id, dns.TypeToString[q.Qtype])
+		StatsRefusedCount.Inc(1)
+		return
+	default:
+		log.Debugf("[%d] Answering %s query with %s by query type policy", req.Id, dns.TypeToString[q.Qtype], action)
+		s.QtypeResponse(m, action)
+		writeMsg(w, m)
+		return
+	}
+
+	if q.Qtype == dns.TypeANY {
+		switch s.config.AnyResponse {
+		case "hinfo":
+			m.Answer = []dns.RR{s.AnyHinfo(q)}
+			writeMsg(w, m)
+			return
+		case "refuse":
+			m.Rcode = dns.RcodeRefused
+			setEDE(m, dns.ExtendedErrorCodeNotSupported, "ANY queries")
+			StatsRefusedCount.Inc(1)
+			writeMsg(w, m)
+			return
+		case "minimal":
+			w = &minimalAnyWriter{ResponseWriter: w}
+		}
+	}
+
+	if s.config.Blocklist != nil && s.config.Blocklist.Blocked(name) {
+		log.Debugf("[%d] Blocked query for '%s'", req.Id, name)
+		StatsBlockedCount.Inc(1)
+		s.BlockedResponse(m, q)
+		writeMsg(w, m)
+		return
+	}
+
+	if s.config.RPZ != nil {
+		rule := s.config.RPZ.QueryRule(name, clientIP(w))
+		switch {
+		case rule == nil:
+			// Check the response against the policy zones before writing it
+			w = &policyWriter{ResponseWriter: w, s: s, req: req}
+		case rule.Action == rpz.Passthru || rule.Action == rpz.TCPOnly && tcp:
+			log.Debugf("[%d] Query passed through policy zone %s", req.Id, rule.Zone)
+		default:
+			log.Debugf("[%d] Query triggered %s policy %s of zone %s", req.Id, rule.Trigger, rule.Action, rule.Zone)
+			StatsPolicyCount.Inc(1)
+			if resp := s.PolicyResponse(req, rule, clientIP(w), tcp); resp != nil {
+				writeMsg(w, resp)
+			}
+			return
+		}
+	}
+
+	if s.validator != nil {
+		w = &dnssecWriter{ResponseWriter: w, req: req}
+	}
+
+	// Resolve the rewritten name from here on, the writer restores the
+	// original name in the response
+	if target, ok := s.rewrite(name); ok {
+		log.Debugf("[%d] Rewriting '%s' to '%s'", req.Id, q.Name, target)
+		w = &rewriteWriter{ResponseWriter: w, s: s, name: q.Name, target: target}
+		req = req.Copy()
+		req.Question[0].Name = target
+		m.Question[0].Name = target
+		q = req.Question[0]
+		name = target
+	}
+
+	// The client subnet sent upstream also selects the cached answer
+	if s.config.ECS != "" && s.config.ECS != "forward" {
+		w = &ecsWriter{ResponseWriter: w, ecs: cache.Subnet(req)}
+		req = s.clientSubnet(req, clientIP(w))
+	}
+	ecs := cache.Subnet(req)
+
 	// Check cache first (`false`in the end means serve NO stale).
-	m1 := s.rcache.Hit(q, dnssec, tcp, m.Id, s.config.RStaleTtl > 0, false)
+	// Cached responses can come from upstream, so clients that are not
+	// allowed recursion only get local data.
+	var m1 *dns.Msg
+	if s.config.RecursionACL.Allowed(clientIP(w)) {
+		var validation cache.Validation
+		m1, validation = s.rcache.Lookup(q, ecs, dnssec, tcp, m.Id, s.config.RStaleTtl > 0, false)
+		if m1 != nil && !s.usable(req, validation) {
+			m1 = nil
+		}
+	}
 	if m1 != nil {
 		log.Debugf("[%d] Found cached response for this query", req.Id)
 		if tcp {
@@ -195,9 +424,6 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 				}
 				return
 			}
-		} else {
-			// Overflow with udp always results in TC.
-			Fit(m1, int(bufsize), tcp)
 		}
 		if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA {
 			s.RoundRobin(m1.Answer)
@@ -231,10 +457,9 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 					}
 					return
 				}
-			} else {
-				Fit(m, int(bufsize), tcp)
 			}
-			s.rcache.InsertMessage(cache.Key(q, dnssec, tcp), m)
+			// Local data is not signed and returned to all clients
+			s.rcache.InsertValidated(cache.Key(q, dnssec, tcp), m, cache.Insecure)
 
 			if err := w.WriteMsg(m); err != nil {
 				log.Errorf("Failed to return reply %q", err)
@@ -258,8 +483,8 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	if q.Qtype == dns.TypePTR && strings.HasSuffix(name, ".in-addr.arpa.") || strings.HasSuffix(name, ".ip6.arpa.") {
 		local = false
 		resp, staleRes := s.ServeDNSReverse(w, req)
-		if resp != nil && !staleRes {
-			s.rcache.InsertMessage(cache.Key(q, dnssec, tcp), resp)
+		if resp != nil && !staleRes && resp.Rcode != dns.RcodeRefused {
+			s.rcache.InsertValidated(cache.Key(q, dnssec, tcp), resp, s.validation(req, resp))
 		}
 		return
 	}
@@ -289,11 +514,40 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		return
 	}
 
+	if domain, ips := s.addressOverride(name); domain != "" {
+		log.Debugf("[%d] Answering query under '%s' with address overrides", req.Id, domain)
+		s.AddressResponse(m, q, domain, ips)
+		return
+	}
+
+	// Names under local-only domains are never forwarded
+	if zone := s.localZone(name); zone != "" {
+		log.Debugf("[%d] Not forwarding query under local domain '%s'", req.Id, zone)
+		s.LocalNegative(m, name, zone)
+		return
+	}
+
 	// Forward all other queries
 	local = false
+	if s.config.AggressiveNsec && s.config.RecursionACL.Allowed(clientIP(w)) {
+		if resp := s.rcache.Synthesize(q, dnssec, req.Id); resp != nil {
+			log.Debugf("[%d] Answering with %s proven by cached denial records", req.Id, dns.RcodeToString[resp.Rcode])
+			StatsSynthesizedCount.Inc(1)
+			resp.RecursionDesired = req.RecursionDesired
+			resp.RecursionAvailable = true
+			resp.CheckingDisabled = req.CheckingDisabled
+			resp.AuthenticatedData = dnssec || req.AuthenticatedData
+			setEDE(resp, dns.ExtendedErrorCodeSynthesized, "")
+			writeMsg(w, resp)
+			return
+		}
+	}
 	storeInCache := true
 	// Check cache for stale records (`false`in the end means serve stale).
-	mStale := s.rcache.Hit(q, dnssec, tcp, m.Id, s.config.RStaleTtl > 0, true)
+	mStale, validation := s.rcache.Lookup(q, ecs, dnssec, tcp, m.Id, s.config.RStaleTtl > 0, true)
+	if mStale != nil && !s.usable(req, validation) {
+		mStale = nil
+	}
 	resp, staleRes := s.ServeDNSForward(w, req, mStale)
 	// If flag `RCacheNonNegative` is set, only cache non negative responses
 	// A non negative response is a response that has status: NOERROR
@@ -301,9 +555,16 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		storeInCache = false
 		log.Debugf("Got negative response")
 	}
+	// Refusals depend on the client
+	if resp.Rcode == dns.RcodeRefused {
+		storeInCache = false
+	}
 
 	if resp != nil && storeInCache && !staleRes {
-		s.rcache.InsertMessage(cache.Key(q, dnssec, tcp), resp)
+		s.rcache.InsertValidated(cache.Key(q, dnssec, tcp), resp, s.validation(req, resp))
+		if s.config.AggressiveNsec && s.trusted(req, resp) {
+			s.rcache.InsertDenials(resp)
+		}
 	}
 
 }
@@ -396,3 +657,14 @@ func isTCP(w dns.ResponseWriter) bool {
 	_, ok := w.RemoteAddr().(*net.TCPAddr)
 	return ok
 }
+
+// clientIP returns the address of the client, nil if unknown.
+func clientIP(w dns.ResponseWriter) net.IP {
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
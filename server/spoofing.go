@@ -0,0 +1,90 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// An off-path attacker has to guess the ID of a query to get a spoofed
+// response accepted, and with DNS 0x20 (draft-vixie-dnsext-dns0x20) the
+// case of each letter of the query name as well.
+
+// randomizeCase returns name with the case of each letter chosen at random
+func randomizeCase(name string) string {
+	b := []byte(name)
+	var bits uint64
+	for i, c := range b {
+		if i%64 == 0 {
+			bits = rand.Uint64()
+		}
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' {
+			if bits&1 == 1 {
+				b[i] = c ^ 0x20
+			}
+		}
+		bits >>= 1
+	}
+	return string(b)
+}
+
+// checkResponse returns an error if r is not the response to req: the ID
+// and question must match, and with exact the case of the query name too.
+func checkResponse(req, r *dns.Msg, exact bool) error {
+	q := req.Question[0]
+	switch {
+	case r.Id != req.Id:
+		return fmt.Errorf("has ID %d instead of %d", r.Id, req.Id)
+	case !r.Response:
+		return fmt.Errorf("is no response")
+	case len(r.Question) != 1:
+		return fmt.Errorf("has %d questions", len(r.Question))
+	}
+	rq := r.Question[0]
+	switch {
+	case rq.Qtype != q.Qtype || rq.Qclass != q.Qclass:
+		return fmt.Errorf("is for type %s class %s", dns.Type(rq.Qtype), dns.Class(rq.Qclass))
+	case exact && rq.Name != q.Name:
+		return fmt.Errorf("is for '%s' instead of '%s'", rq.Name, q.Name)
+	case !strings.EqualFold(rq.Name, q.Name):
+		return fmt.Errorf("is for '%s'", rq.Name)
+	}
+	return nil
+}
+
+// restoreCase replaces the query name sent upstream by the original one in
+// the question and the owner names of a response. Owners above or below the
+// query name may be compressed into the sent name, so the labels they share
+// with it are restored as well.
+func restoreCase(r *dns.Msg, sent, original string) {
+	r.Question[0].Name = original
+	for _, section := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			hdr.Name = restoreSuffix(hdr.Name, sent, original)
+		}
+	}
+}
+
+// restoreSuffix returns name with the longest suffix of whole labels it
+// shares with sent taken from original instead.
+func restoreSuffix(name, sent, original string) string {
+	for _, i := range dns.Split(sent) {
+		suffix := sent[i:]
+		if !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		if n := len(name) - len(suffix); n == 0 || name[n-1] == '.' {
+			return name[:n] + original[i:]
+		}
+	}
+	return name
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRandomizeCase(t *testing.T) {
+	name := "www-1.example.com."
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		r := randomizeCase(name)
+		if !strings.EqualFold(r, name) || r[3:6] != "-1." {
+			t.Fatalf("expected only the case of letters to change, got %s", r)
+		}
+		seen[r] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("expected random case, got %v", seen)
+	}
+}
+
+func TestCheckResponse(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("wWw.ExamPle.com.", dns.TypeA)
+	reply := func(change func(r *dns.Msg)) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetReply(req)
+		change(r)
+		return r
+	}
+
+	tests := []struct {
+		name  string
+		r     *dns.Msg
+		exact bool
+		ok    bool
+	}{
+		{"response", reply(func(r *dns.Msg) {}), true, true},
+		{"ID", reply(func(r *dns.Msg) { r.Id++ }), false, false},
+		{"query", reply(func(r *dns.Msg) { r.Response = false }), false, false},
+		{"no question", reply(func(r *dns.Msg) { r.Question = nil }), false, false},
+		{"type", reply(func(r *dns.Msg) { r.Question[0].Qtype = dns.TypeAAAA }), false, false},
+		{"class", reply(func(r *dns.Msg) { r.Question[0].Qclass = dns.ClassCHAOS }), false, false},
+		{"name", reply(func(r *dns.Msg) { r.Question[0].Name = "example.com." }), false, false},
+		{"case", reply(func(r *dns.Msg) { r.Question[0].Name = "www.example.com." }), false, true},
+		{"exact case", reply(func(r *dns.Msg) { r.Question[0].Name = "www.example.com." }), true, false},
+	}
+	for _, tc := range tests {
+		if err := checkResponse(req, tc.r, tc.exact); (err == nil) != tc.ok {
+			t.Errorf("%s: expected ok %t, got %v", tc.name, tc.ok, err)
+		}
+	}
+}
+
+func TestExchangeRandomizedCase(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		// this upstream does not preserve the case
+		if strings.EqualFold(req.Question[0].Name, "lower.example.com.") {
+			m.Question[0].Name = strings.ToLower(m.Question[0].Name)
+		}
+		rr, _ := dns.NewRR(m.Question[0].Name + " 60 IN A 192.0.2.1")
+		m.Answer = []dns.RR{rr}
+		w.WriteMsg(m)
+	})
+	udp := &dns.Server{PacketConn: pc, Handler: mux}
+	go udp.ActivateAndServe()
+	defer udp.Shutdown()
+
+	s := &server{
+		config:       &Config{RandomizeCase: true},
+		dnsUDPclient: &dns.Client{Net: "udp", ReadTimeout: time.Second},
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("wWw.example.com.", dns.TypeA)
+	r, err := s.exchange(req, pc.LocalAddr().String(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Id != req.Id || r.Question[0].Name != "wWw.example.com." || r.Answer[0].Header().Name != "wWw.example.com." {
+		t.Errorf("expected the ID and name of the request, got %d %v", r.Id, r)
+	}
+
+	req.SetQuestion("lower.example.com.", dns.TypeA)
+	for i := 0; i < 5; i++ {
+		if _, err := s.exchange(req, pc.LocalAddr().String(), false); err != nil {
+			return
+		}
+	}
+	t.Error("expected responses in another case to be rejected")
+}
+
+func TestRestoreCase(t *testing.T) {
+	r := new(dns.Msg)
+	r.SetQuestion("wWw.ExAmple.COM.", dns.TypeA)
+	for _, s := range []string{
+		"wWw.ExAmple.COM. 60 IN CNAME cdn.example.net.",
+		"a.wWw.ExAmple.COM. 60 IN A 192.0.2.1",
+		"ExAmple.COM. 60 IN SOA ns.ExAmple.COM. hostmaster.example.com. 1 3600 600 86400 60",
+		"ExAmple.COM. 60 IN NS ns.example.com.",
+		"example.com. 60 IN NS ns.example.com.",
+		"other.COM. 60 IN A 192.0.2.2",
+		"www.example.org. 60 IN A 192.0.2.3",
+	} {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Ns = append(r.Ns, rr)
+	}
+
+	restoreCase(r, "wWw.ExAmple.COM.", "www.example.com.")
+	expected := []string{"www.example.com.", "a.www.example.com.", "example.com.", "example.com.", "example.com.", "other.com.", "www.example.org."}
+	if r.Question[0].Name != "www.example.com." {
+		t.Errorf("expected the original question, got %s", r.Question[0].Name)
+	}
+	for i, rr := range r.Ns {
+		if rr.Header().Name != expected[i] {
+			t.Errorf("expected owner %s, got %s", expected[i], rr.Header().Name)
+		}
+	}
+}
@@ -29,4 +29,13 @@ var (
 	StatsCacheHit         Counter = nopCounter{}
 	StatsStaleCacheHit    Counter = nopCounter{}
 	StatsRequestFail      Counter = nopCounter{}
+	StatsBlockedCount     Counter = nopCounter{}
+	StatsPolicyCount      Counter = nopCounter{}
+	StatsRateLimitedCount Counter = nopCounter{}
+	StatsRebindCount      Counter = nopCounter{}
+	StatsDnssecSecure     Counter = nopCounter{}
+	StatsDnssecBogus      Counter = nopCounter{}
+	StatsSynthesizedCount Counter = nopCounter{}
+	StatsInvalidCount     Counter = nopCounter{}
+	StatsBadCookieCount   Counter = nopCounter{}
 )
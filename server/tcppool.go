@@ -0,0 +1,273 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// Queries over TCP share one persistent connection per upstream (RFC 7766):
+// they are sent without waiting for the responses to earlier ones, which
+// may arrive in any order and are matched by ID. Connections idle for the
+// idle timeout, or the shorter one an upstream asks for with the EDNS TCP
+// keepalive option (RFC 7828), are closed and opened again when needed.
+
+// defaultTCPIdleTimeout in seconds, as recommended by RFC 7766 section 6.2.3
+const defaultTCPIdleTimeout = 10
+
+var errConnClosed = errors.New("connection closed")
+
+type tcpPool struct {
+	sync.Mutex
+	conns   map[string]*tcpConn
+	dialing map[string]chan struct{} // closed when the connection is open
+	timeout time.Duration            // to connect, and for each response
+	idle    time.Duration
+}
+
+type tcpConn struct {
+	pool    *tcpPool
+	ns      string
+	conn    *dns.Conn
+	writing sync.Mutex
+
+	sync.Mutex // guards the fields below
+	pending    map[uint16]chan *dns.Msg
+	idle       time.Duration
+	timer      *time.Timer // closes the idle connection
+	err        error       // why the connection was closed
+}
+
+func newTCPPool(timeout, idle time.Duration) *tcpPool {
+	if timeout == 0 {
+		// as dns.Client does
+		timeout = 2 * time.Second
+	}
+	return &tcpPool{
+		conns:   make(map[string]*tcpConn),
+		dialing: make(map[string]chan struct{}),
+		timeout: timeout,
+		idle:    idle,
+	}
+}
+
+// exchange sends a query to the upstream ns over its connection, reopening
+// it once if the upstream closed it meanwhile
+func (p *tcpPool) exchange(req *dns.Msg, ns string) (*dns.Msg, error) {
+	for try := 0; ; try++ {
+		c, reused, err := p.get(ns)
+		if err != nil {
+			return nil, err
+		}
+		r, err := c.exchange(req)
+		if errors.Is(err, errConnClosed) && reused && try == 0 {
+			log.Debugf("[%d] Connection to upstream %s closed, reconnecting", req.Id, ns)
+			continue
+		}
+		return r, err
+	}
+}
+
+// get returns the open connection to ns, or a new one, and whether it was
+// used before. Queries arriving while it connects wait for the connection.
+func (p *tcpPool) get(ns string) (*tcpConn, bool, error) {
+	p.Lock()
+	for {
+		if c, ok := p.conns[ns]; ok {
+			p.Unlock()
+			return c, true, nil
+		}
+		wait, ok := p.dialing[ns]
+		if !ok {
+			break
+		}
+		p.Unlock()
+		<-wait
+		p.Lock()
+	}
+	wait := make(chan struct{})
+	p.dialing[ns] = wait
+	p.Unlock()
+
+	conn, err := net.DialTimeout("tcp", ns, p.timeout)
+
+	p.Lock()
+	defer p.Unlock()
+	delete(p.dialing, ns)
+	close(wait)
+	if err != nil {
+		return nil, false, err
+	}
+	c := &tcpConn{
+		pool:    p,
+		ns:      ns,
+		conn:    &dns.Conn{Conn: conn},
+		pending: make(map[uint16]chan *dns.Msg),
+		idle:    p.idle,
+	}
+	c.timer = time.AfterFunc(c.idle, c.closeIdle)
+	p.conns[ns] = c
+	go c.read()
+	return c, false, nil
+}
+
+// remove forgets the connection if it still is the one to its upstream
+func (p *tcpPool) remove(c *tcpConn) {
+	p.Lock()
+	defer p.Unlock()
+	if p.conns[c.ns] == c {
+		delete(p.conns, c.ns)
+	}
+}
+
+func (c *tcpConn) exchange(req *dns.Msg) (*dns.Msg, error) {
+	// shallow copy: the ID must be unique on the connection and the OPT
+	// record asks the upstream for its idle timeout
+	m := *req
+	m.Extra = withoutOPT(req.Extra)
+	o := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	if opt := req.IsEdns0(); opt != nil {
+		o = dns.Copy(opt).(*dns.OPT)
+	}
+	o.Option = append(o.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+	m.Extra = append(m.Extra, o)
+
+	ch := make(chan *dns.Msg, 1)
+	c.Lock()
+	if c.err != nil {
+		c.Unlock()
+		return nil, c.err
+	}
+	for {
+		if _, ok := c.pending[m.Id]; !ok {
+			break
+		}
+		m.Id = dns.Id()
+	}
+	c.pending[m.Id] = ch
+	c.timer.Stop()
+	c.Unlock()
+
+	c.writing.Lock()
+	c.conn.SetWriteDeadline(time.Now().Add(c.pool.timeout))
+	err := c.conn.WriteMsg(&m)
+	c.writing.Unlock()
+	if err != nil {
+		c.close(fmt.Errorf("%w: %v", errConnClosed, err))
+		return nil, c.closedErr()
+	}
+
+	timeout := time.NewTimer(c.pool.timeout)
+	defer timeout.Stop()
+	select {
+	case r, ok := <-ch:
+		if !ok {
+			return nil, c.closedErr()
+		}
+		r.Id = req.Id
+		return r, nil
+	case <-timeout.C:
+		c.done(m.Id)
+		return nil, &net.OpError{Op: "read", Net: "tcp", Addr: c.conn.RemoteAddr(), Err: os.ErrDeadlineExceeded}
+	}
+}
+
+// read delivers responses to the pending queries until the connection is
+// closed
+func (c *tcpConn) read() {
+	for {
+		r, err := c.conn.ReadMsg()
+		if err != nil {
+			c.close(fmt.Errorf("%w: %v", errConnClosed, err))
+			return
+		}
+		c.keepalive(r)
+		c.deliver(r)
+	}
+}
+
+// deliver passes a response to its query, responses to queries that timed
+// out are dropped
+func (c *tcpConn) deliver(r *dns.Msg) {
+	c.Lock()
+	defer c.Unlock()
+	if ch, ok := c.pending[r.Id]; ok {
+		c.forget(r.Id)
+		ch <- r
+	}
+}
+
+// keepalive adopts the idle timeout the upstream asks for in a response
+func (c *tcpConn) keepalive(r *dns.Msg) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return
+	}
+	for _, e := range opt.Option {
+		if ka, ok := e.(*dns.EDNS0_TCP_KEEPALIVE); ok {
+			c.Lock()
+			c.idle = min(c.pool.idle, time.Duration(ka.Timeout)*100*time.Millisecond)
+			c.Unlock()
+		}
+	}
+}
+
+// done forgets a query that timed out
+func (c *tcpConn) done(id uint16) {
+	c.Lock()
+	defer c.Unlock()
+	c.forget(id)
+}
+
+// forget removes a query and starts the idle timer if it was the last one.
+// Must be called with the lock held.
+func (c *tcpConn) forget(id uint16) {
+	delete(c.pending, id)
+	if len(c.pending) == 0 && c.err == nil {
+		c.timer.Reset(c.idle)
+	}
+}
+
+func (c *tcpConn) closeIdle() {
+	c.Lock()
+	idle := len(c.pending) == 0
+	c.Unlock()
+	if idle {
+		c.close(fmt.Errorf("%w: idle", errConnClosed))
+	}
+}
+
+// close closes the connection and fails its pending queries
+func (c *tcpConn) close(err error) {
+	c.pool.remove(c)
+	c.Lock()
+	defer c.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	c.timer.Stop()
+	c.conn.Close()
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+func (c *tcpConn) closedErr() error {
+	c.Lock()
+	defer c.Unlock()
+	return c.err
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// tcpUpstream accepts connections and passes them to serve
+func tcpUpstream(t *testing.T, serve func(c *dns.Conn)) (string, *int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var accepted int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go serve(&dns.Conn{Conn: conn})
+		}
+	}()
+	return l.Addr().String(), &accepted
+}
+
+func reply(req *dns.Msg, keepalive uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 192.0.2.1")
+	m.Answer = []dns.RR{rr}
+	o := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	o.Option = []dns.EDNS0{&dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Timeout: keepalive}}
+	m.Extra = []dns.RR{o}
+	return m
+}
+
+func TestTCPPoolPipelining(t *testing.T) {
+	// answers pairs of queries in reverse order
+	ns, accepted := tcpUpstream(t, func(c *dns.Conn) {
+		defer c.Close()
+		for {
+			first, err := c.ReadMsg()
+			if err != nil {
+				return
+			}
+			second, err := c.ReadMsg()
+			if err != nil {
+				return
+			}
+			c.WriteMsg(reply(second, 50))
+			c.WriteMsg(reply(first, 50))
+		}
+	})
+
+	p := newTCPPool(time.Second, 10*time.Second)
+	var wg sync.WaitGroup
+	for _, name := range []string{"one.example.com.", "two.example.com."} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			req := new(dns.Msg)
+			req.SetQuestion(name, dns.TypeA)
+			r, err := p.exchange(req, ns)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if r.Id != req.Id || r.Question[0].Name != name {
+				t.Errorf("expected the response to %d %s, got %v", req.Id, name, r)
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(accepted); n != 1 {
+		t.Errorf("expected 1 connection, got %d", n)
+	}
+	p.Lock()
+	c := p.conns[ns]
+	p.Unlock()
+	if c == nil {
+		t.Fatal("expected the connection to be kept open")
+	}
+	c.Lock()
+	idle := c.idle
+	c.Unlock()
+	if idle != 5*time.Second {
+		t.Errorf("expected the idle timeout of the upstream, got %s", idle)
+	}
+}
+
+func TestTCPPoolReconnect(t *testing.T) {
+	// answers one query per connection, with a short keepalive after the
+	// first connection
+	ns, accepted := tcpUpstream(t, func(c *dns.Conn) {
+		defer c.Close()
+		req, err := c.ReadMsg()
+		if err != nil {
+			return
+		}
+		if req.IsEdns0() == nil {
+			t.Error("expected the query to ask for the keepalive")
+		}
+		c.WriteMsg(reply(req, 1))
+	})
+
+	p := newTCPPool(time.Second, 10*time.Second)
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i < 3; i++ {
+		if _, err := p.exchange(req, ns); err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+	}
+	if n := atomic.LoadInt32(accepted); n != 3 {
+		t.Errorf("expected a new connection per query, got %d", n)
+	}
+
+	// closed after the 100ms the upstream asks for
+	time.Sleep(300 * time.Millisecond)
+	p.Lock()
+	n := len(p.conns)
+	p.Unlock()
+	if n != 0 {
+		t.Errorf("expected the idle connection to be closed, got %d", n)
+	}
+}
+
+func TestTCPPoolTimeout(t *testing.T) {
+	ns, _ := tcpUpstream(t, func(c *dns.Conn) {
+		defer c.Close()
+		for {
+			if _, err := c.ReadMsg(); err != nil {
+				return
+			}
+		}
+	})
+
+	p := newTCPPool(100*time.Millisecond, 10*time.Second)
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	_, err := p.exchange(req, ns)
+	if err, ok := err.(net.Error); !ok || !err.Timeout() {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+}
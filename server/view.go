@@ -0,0 +1,171 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/claranet/go-dnsmasq/cache"
+	log "github.com/sirupsen/logrus"
+)
+
+// View is an alternative configuration for the queries of some clients or
+// of some listeners. Options that are not set are taken from the main
+// configuration.
+type View struct {
+	Name string `json:"name"`
+	// Clients the view applies to, as addresses or CIDR networks. Empty matches all clients.
+	Clients []string `json:"clients,omitempty"`
+	// Listener addresses <ip:port> the view applies to, go-dnsmasq listens
+	// on them in addition to the main address. Empty matches all listeners.
+	Listen []string `json:"listen,omitempty"`
+	// Nameservers <ip:port> queries are forwarded to
+	Nameservers []string `json:"nameservers,omitempty"`
+	// Stub zones, domain -> nameservers <ip:port>
+	Stub map[string][]string `json:"stubzones,omitempty"`
+	// Hosts file consulted before the data sources of the main configuration
+	Hostsfile string `json:"hostsfile,omitempty"`
+	// Search domains, setting them enables search
+	SearchDomains []string `json:"search_domains,omitempty"`
+	// Capacity of the response cache of the view
+	RCache int `json:"rcache,omitempty"`
+}
+
+type view struct {
+	*View
+	clients *ACL
+	server  *server
+}
+
+// AddView adds a view answering from hostfile with its own response cache.
+// The upstream connections, cookies, DNSSEC validator and rate limiter are
+// shared with the server. Views are selected in the order they were added.
+func (s *server) AddView(v *View, hostfile Hostfile) error {
+	clients, err := NewACL(v.Clients, nil)
+	if err != nil {
+		return fmt.Errorf("Invalid clients of view %s: %s", v.Name, err)
+	}
+
+	config := *s.config
+	if len(v.Nameservers) > 0 {
+		config.Nameservers = v.Nameservers
+	}
+	if v.Stub != nil {
+		config.Stub = &v.Stub
+	}
+	if len(v.SearchDomains) > 0 {
+		config.SearchDomains = v.SearchDomains
+		config.EnableSearch = true
+	}
+	if v.RCache > 0 {
+		config.RCache = v.RCache
+	}
+	vs := &server{
+		hosts:   hostfile,
+		config:  &config,
+		version: s.version,
+
+		group:        s.group,
+		dnsUDPclient: s.dnsUDPclient,
+		tcpPool:      s.tcpPool,
+		rcache:       cache.New(config.RCache, config.RCacheTtl, config.RStaleTtl, config.RCacheTtlFromResp, config.RCacheTtlMax),
+		limiter:      s.limiter,
+		validator:    s.validator,
+		cookies:      s.cookies,
+	}
+
+	s.views = append(s.views, &view{View: v, clients: clients, server: vs})
+	return nil
+}
+
+// selectView returns the server of the first view matching the client and
+// the listener the query was received on, or nil if no view matches.
+func (s *server) selectView(client net.IP, local net.Addr) *server {
+	for _, v := range s.views {
+		if len(v.Clients) > 0 && !v.clients.Allowed(client) {
+			continue
+		}
+		if len(v.Listen) > 0 && !v.listensOn(local) {
+			continue
+		}
+		log.Debugf("Selected view %s for %s", v.Name, client)
+		return v.server
+	}
+	return nil
+}
+
+func (v *view) listensOn(addr net.Addr) bool {
+	for _, listen := range v.Listen {
+		if matchAddr(listen, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAddr reports whether addr is the listen address <ip:port>. An
+// unspecified IP matches all addresses on the port.
+func matchAddr(listen string, addr net.Addr) bool {
+	if addr == nil {
+		return false
+	}
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+		if strconv.Itoa(a.Port) != port {
+			return false
+		}
+	case *net.TCPAddr:
+		ip = a.IP
+		if strconv.Itoa(a.Port) != port {
+			return false
+		}
+	default:
+		return listen == addr.String()
+	}
+	if host == "" {
+		return true
+	}
+	listenIP := net.ParseIP(host)
+	return listenIP != nil && (listenIP.IsUnspecified() || listenIP.Equal(ip))
+}
+
+// viewListeners returns the addresses the views listen on in addition to
+// the addresses the server is listening on already.
+func (s *server) viewListeners(listening []string) []string {
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, addr := range listening {
+		seen[addr] = true
+	}
+	for _, v := range s.views {
+		for _, addr := range v.Listen {
+			if !seen[addr] {
+				seen[addr] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs
+}
+
+// RemoveCachedName removes all responses for the name from the response
+// caches of the server and its views.
+func (s *server) RemoveCachedName(name string) int {
+	removed := s.rcache.RemoveName(name)
+	for _, v := range s.views {
+		removed += v.server.rcache.RemoveName(name)
+	}
+	return removed
+}
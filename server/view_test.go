@@ -0,0 +1,90 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Fork 2024 maintaining MIT License (MIT)
+
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestViews(t *testing.T) {
+	s := newTestServer(t, testHosts{}, &Config{
+		Nameservers: []string{"192.0.2.53:53"},
+		RCache:      10,
+		DNSSEC:      true,
+		Cookies:     true,
+		RateLimit:   10,
+	})
+
+	views := []*View{
+		{Name: "office", Clients: []string{"10.1.0.0/16"}, Nameservers: []string{"10.1.0.53:53"}},
+		{Name: "guest", Listen: []string{"127.0.0.2:53"}, SearchDomains: []string{"guest.example."}, RCache: 5},
+		{Name: "lab", Clients: []string{"10.2.0.0/16"}, Listen: []string{"127.0.0.2:53", "127.0.0.3:53"}},
+		{Name: "any", Clients: []string{"10.4.0.0/16"}, Listen: []string{"0.0.0.0:5353", "[::]:5353"}},
+	}
+	for _, v := range views {
+		if err := s.AddView(v, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.AddView(&View{Name: "invalid", Clients: []string{"10.0.0.0/33"}}, nil); err == nil {
+		t.Error("expected error for invalid clients")
+	}
+
+	main := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+	guest := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 53}
+	lab := &net.UDPAddr{IP: net.ParseIP("127.0.0.3"), Port: 53}
+	tests := []struct {
+		client string
+		local  net.Addr
+		view   int // -1 for the main configuration
+	}{
+		{"10.1.2.3", main, 0},
+		{"10.1.2.3", guest, 0},
+		{"10.2.0.1", main, -1},
+		{"10.2.0.1", guest, 1},
+		{"10.2.0.1", lab, 2},
+		{"10.3.0.1", lab, -1},
+		{"10.3.0.1", guest, 1},
+		{"10.4.0.1", &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 5353}, 3},
+		{"10.4.0.1", &net.UDPAddr{IP: net.IPv4zero, Port: 5353}, 3},
+		{"10.4.0.1", &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5353}, 3},
+		{"10.4.0.1", main, -1},
+	}
+	for _, tc := range tests {
+		selected := s.selectView(net.ParseIP(tc.client), tc.local)
+		if tc.view < 0 {
+			if selected != nil {
+				t.Errorf("%s on %s: expected the main configuration", tc.client, tc.local)
+			}
+			continue
+		}
+		if selected != s.views[tc.view].server {
+			t.Errorf("%s on %s: expected view %s", tc.client, tc.local, views[tc.view].Name)
+		}
+	}
+
+	office, guestView := s.views[0].server.config, s.views[1].server.config
+	if office.Nameservers[0] != "10.1.0.53:53" || office.EnableSearch || office.RCache != 10 {
+		t.Errorf("unexpected office configuration %+v", office)
+	}
+	if guestView.Nameservers[0] != "192.0.2.53:53" || !guestView.EnableSearch || guestView.RCache != 5 {
+		t.Errorf("unexpected guest configuration %+v", guestView)
+	}
+	vs := s.views[0].server
+	if vs.rcache == s.rcache {
+		t.Error("expected a separate cache for the view")
+	}
+	if vs.validator != s.validator || vs.cookies != s.cookies || vs.limiter != s.limiter || vs.dnsUDPclient != s.dnsUDPclient ||
+		vs.tcpPool != s.tcpPool {
+		t.Error("expected the view to share the upstream connections, cookies, validator and rate limiter")
+	}
+
+	if addrs := s.viewListeners([]string{"127.0.0.1:53", "127.0.0.3:53"}); len(addrs) != 3 || addrs[0] != "127.0.0.2:53" || addrs[1] != "0.0.0.0:5353" {
+		t.Errorf("unexpected listeners %v", addrs)
+	}
+}
@@ -37,6 +37,15 @@ var counters = map[string]*server.Counter{
 	"go-dnsmasq-cache-hit":             &server.StatsCacheHit,
 	"go-dnsmasq-stale-cache-hit":       &server.StatsStaleCacheHit,
 	"go-dnsmasq-stale-request-fail":    &server.StatsRequestFail,
+	"go-dnsmasq-blocked":               &server.StatsBlockedCount,
+	"go-dnsmasq-policy-responses":      &server.StatsPolicyCount,
+	"go-dnsmasq-ratelimited":           &server.StatsRateLimitedCount,
+	"go-dnsmasq-rebind-responses":      &server.StatsRebindCount,
+	"go-dnsmasq-dnssec-secure":         &server.StatsDnssecSecure,
+	"go-dnsmasq-dnssec-bogus":          &server.StatsDnssecBogus,
+	"go-dnsmasq-synthesized-responses": &server.StatsSynthesizedCount,
+	"go-dnsmasq-invalid-requests":      &server.StatsInvalidCount,
+	"go-dnsmasq-bad-cookies":           &server.StatsBadCookieCount,
 }
 
 func init() {